@@ -4,7 +4,9 @@ import (
 	"flag"
 	"fmt"
 	"os"
+	"slices"
 	"strconv"
+	"strings"
 
 	"github.com/goccy/go-yaml"
 )
@@ -15,6 +17,54 @@ type AIConfig struct {
 	BaseURL  string `yaml:"ai_base_url"` // AI服务基础URL
 	Model    string `yaml:"ai_model"`    // AI模型名称
 	Thinking string `yaml:"thinking"`    // AI思考模式
+
+	Models []ModelConfig `yaml:"ai_models"` // 模型目录，为空时只提供ai_model和备用模型，且不限制其能力
+
+	Provider           string `yaml:"ai_provider"`          // 默认的对话服务提供方：openai/anthropic/ollama/fake
+	ModelProviders     string `yaml:"ai_model_providers"`   // 按模型指定提供方，格式为"模型=提供方"，逗号分隔
+	AnthropicApiKey    string `yaml:"anthropic_api_key"`    // Anthropic API密钥
+	AnthropicBaseURL   string `yaml:"anthropic_base_url"`   // Anthropic API基础URL，为空时使用官方地址
+	AnthropicMaxTokens int    `yaml:"anthropic_max_tokens"` // Anthropic单次回答的最大token数
+	OllamaBaseURL      string `yaml:"ollama_base_url"`      // Ollama服务地址，为空时使用http://localhost:11434
+	FakeScript         string `yaml:"fake_script"`          // 模拟提供方的脚本文件（JSON），为空时回显消息
+	FakeLatency        int    `yaml:"fake_latency"`         // 模拟提供方输出片段的间隔（毫秒）
+
+	FallbackModels   string `yaml:"ai_fallback_models"`   // 请求的模型不可用时依次尝试的备用模型，逗号分隔
+	MaxRetries       int    `yaml:"ai_max_retries"`       // 限流或服务端错误时同一上游的最大重试次数
+	RetryBackoff     int    `yaml:"ai_retry_backoff"`     // 首次重试前的等待时间（毫秒），之后每次翻倍
+	BreakerThreshold int    `yaml:"ai_breaker_threshold"` // 上游连续失败多少次后熔断
+	BreakerCooldown  int    `yaml:"ai_breaker_cooldown"`  // 上游熔断后的冷却时间（秒）
+
+	ConnectTimeout    int `yaml:"ai_connect_timeout"`     // 连接上游（含TLS握手）的超时时间（秒）
+	FirstTokenTimeout int `yaml:"ai_first_token_timeout"` // 发出请求后等待首个片段的超时时间（秒）
+	IdleTimeout       int `yaml:"ai_idle_timeout"`        // 两个片段之间的最大间隔（秒）
+
+	MaxConcurrent        int `yaml:"ai_max_concurrent"`          // 全局同时执行的AI生成数量上限，0表示不限制
+	MaxConcurrentPerUser int `yaml:"ai_max_concurrent_per_user"` // 每个用户同时执行的AI生成数量上限，0表示不限制
+	MaxQueue             int `yaml:"ai_max_queue"`               // 排队等待的AI生成数量上限，0表示不限制
+
+	HistoryTurns int `yaml:"ai_history_turns"` // 继续会话时最多回放的历史轮次数，0表示不回放
+	HistoryChars int `yaml:"ai_history_chars"` // 继续会话时回放的历史轮次的总字符数上限
+
+	StoreReasoning bool `yaml:"ai_store_reasoning"` // 是否在AI回答历史中保存思考过程
+
+	DailyTokenQuota   int `yaml:"ai_daily_token_quota"`   // 每个用户每天的token配额，0表示不限制
+	MonthlyTokenQuota int `yaml:"ai_monthly_token_quota"` // 每个用户每月的token配额，0表示不限制
+
+	ImagePrompt string `yaml:"ai_image_prompt"` // 图片请求未携带提示词时使用的默认提示词
+	MaxImages   int    `yaml:"ai_max_images"`   // 单次请求最多携带的图片数量
+}
+
+// ModelConfig 模型目录中的一个模型
+type ModelConfig struct {
+	Name          string   `yaml:"name"`           // 模型名称，即请求上游时使用的模型ID
+	DisplayName   string   `yaml:"display_name"`   // 显示名称，为空时使用模型名称
+	Provider      string   `yaml:"provider"`       // 对话服务提供方，为空时按ai_model_providers或ai_provider选择
+	Capabilities  []string `yaml:"capabilities"`   // 模型能力：vision（图片）、thinking（思考）、tools（工具调用）
+	ContextWindow int      `yaml:"context_window"` // 上下文窗口（token）
+	InputPrice    float64  `yaml:"input_price"`    // 每百万输入token的价格
+	OutputPrice   float64  `yaml:"output_price"`   // 每百万输出token的价格
+	Currency      string   `yaml:"currency"`       // 价格的币种，如USD、CNY
 }
 
 // DatabaseConfig 数据库配置结构体
@@ -43,13 +93,100 @@ type LogConfig struct {
 	ConsoleDatabase bool   `yaml:"log_console_database"` // 是否将数据库操作日志信息输出到控制台
 }
 
+// WebSocketConfig WebSocket连接配置结构体
+type WebSocketConfig struct {
+	SendQueueSize      int    `yaml:"ws_send_queue_size"`      // 每个连接的发送队列长度
+	WriteTimeout       int    `yaml:"ws_write_timeout"`        // 单次写入超时时间（秒）
+	SlowConsumerPolicy string `yaml:"ws_slow_consumer_policy"` // 慢消费者处理策略：drop_oldest/disconnect
+	PingInterval       int    `yaml:"ws_ping_interval"`        // 心跳Ping发送间隔（秒）
+	IdleTimeout        int    `yaml:"ws_idle_timeout"`         // 空闲超时时间（秒），超时未收到任何数据则断开连接
+	ReplayLimit        int    `yaml:"ws_replay_limit"`         // 断线重连时每批查询和重放的离线消息条数
+	MaxImageSize       int    `yaml:"ws_max_image_size"`       // 单张图片的最大大小（KB）
+	UploadTimeout      int    `yaml:"ws_upload_timeout"`       // 分片上传的最长间隔（秒），超时未完成的上传会被丢弃
+	MaxGenerations     int    `yaml:"ws_max_generations"`      // 单个连接同时进行的AI生成数量上限
+}
+
+// BrokerConfig 消息广播后端配置结构体
+type BrokerConfig struct {
+	Backend    string `yaml:"broker_backend"`     // 广播后端：memory（单实例）/mesh（多实例节点互联）
+	NodeID     string `yaml:"broker_node_id"`     // 节点ID，为空时使用主机名和端口
+	ListenAddr string `yaml:"broker_listen_addr"` // mesh模式下接收其他节点转发的监听地址
+	Peers      string `yaml:"broker_peers"`       // mesh模式下其他节点的监听地址，逗号分隔
+	Secret     string `yaml:"broker_secret"`      // mesh模式下节点间认证密钥
+}
+
+// PeerList 获取其他节点的监听地址列表
+func (c BrokerConfig) PeerList() []string {
+	var peers []string
+	for _, peer := range strings.Split(c.Peers, ",") {
+		if peer = strings.TrimSpace(peer); peer != "" {
+			peers = append(peers, peer)
+		}
+	}
+	return peers
+}
+
+// aiProviders 支持的对话服务提供方
+var aiProviders = map[string]bool{"openai": true, "anthropic": true, "ollama": true, "fake": true}
+
+// modelCapabilities 模型目录中支持的模型能力
+var modelCapabilities = map[string]bool{"vision": true, "thinking": true, "tools": true}
+
+// ModelProviderMap 获取按模型指定的提供方，键为模型名称，值为提供方名称
+// 模型目录中指定的提供方优先于ai_model_providers
+func (c AIConfig) ModelProviderMap() map[string]string {
+	modelProviders := make(map[string]string)
+	for _, entry := range strings.Split(c.ModelProviders, ",") {
+		model, provider, ok := strings.Cut(entry, "=")
+		model, provider = strings.TrimSpace(model), strings.TrimSpace(provider)
+		if ok && model != "" && provider != "" {
+			modelProviders[model] = provider
+		}
+	}
+	for _, model := range c.Models {
+		if model.Provider != "" {
+			modelProviders[model.Name] = model.Provider
+		}
+	}
+	return modelProviders
+}
+
+// FallbackModelList 获取备用模型列表
+func (c AIConfig) FallbackModelList() []string {
+	var models []string
+	for _, model := range strings.Split(c.FallbackModels, ",") {
+		if model = strings.TrimSpace(model); model != "" {
+			models = append(models, model)
+		}
+	}
+	return models
+}
+
+// ModelCatalog 获取模型目录
+// 未配置ai_models时，目录中只有ai_model和备用模型，且具备所有能力，与配置模型目录前的行为一致
+func (c AIConfig) ModelCatalog() []ModelConfig {
+	if len(c.Models) > 0 {
+		return c.Models
+	}
+	var models []ModelConfig
+	for _, name := range append([]string{c.Model}, c.FallbackModelList()...) {
+		if slices.ContainsFunc(models, func(model ModelConfig) bool { return model.Name == name }) {
+			continue
+		}
+		models = append(models, ModelConfig{Name: name, Capabilities: []string{"vision", "thinking", "tools"}})
+	}
+	return models
+}
+
 // Config 服务器配置结构体
 type Config struct {
-	Port           int            `yaml:"port"` // 服务器端口
-	AIConfig       AIConfig       // AI服务配置
-	DatabaseConfig DatabaseConfig // 数据库配置
-	JWTConfig      JWTConfig      // JWT配置
-	LogConfig      LogConfig      // 日志配置
+	Port            int             `yaml:"port"` // 服务器端口
+	AIConfig        AIConfig        // AI服务配置
+	DatabaseConfig  DatabaseConfig  // 数据库配置
+	JWTConfig       JWTConfig       // JWT配置
+	LogConfig       LogConfig       // 日志配置
+	WebSocketConfig WebSocketConfig // WebSocket连接配置
+	BrokerConfig    BrokerConfig    // 消息广播后端配置
 }
 
 // Validate 验证配置的有效性
@@ -87,15 +224,185 @@ func (c *Config) Validate() error {
 		return fmt.Errorf("invalid log level: %s, must be one of DEBUG, INFO, WARN, ERROR, FATAL", c.LogConfig.Level)
 	}
 
+	// 验证AI服务提供方配置
+	if !aiProviders[c.AIConfig.Provider] {
+		return fmt.Errorf("invalid ai provider: %s, must be one of openai, anthropic, ollama, fake", c.AIConfig.Provider)
+	}
+	for _, entry := range strings.Split(c.AIConfig.ModelProviders, ",") {
+		if strings.TrimSpace(entry) == "" {
+			continue
+		}
+		model, provider, ok := strings.Cut(entry, "=")
+		if !ok || strings.TrimSpace(model) == "" {
+			return fmt.Errorf("invalid ai model providers entry: %s, must be model=provider", entry)
+		}
+		if !aiProviders[strings.TrimSpace(provider)] {
+			return fmt.Errorf("invalid ai provider for model %s: %s, must be one of openai, anthropic, ollama, fake", strings.TrimSpace(model), strings.TrimSpace(provider))
+		}
+	}
+	if c.AIConfig.AnthropicMaxTokens <= 0 {
+		return fmt.Errorf("anthropic max tokens must be positive")
+	}
+
+	// 验证模型目录配置
+	if err := c.validateModels(); err != nil {
+		return err
+	}
+	if c.AIConfig.FakeLatency < 0 {
+		return fmt.Errorf("fake latency cannot be negative")
+	}
+
+	// 验证AI重试和熔断配置
+	if c.AIConfig.MaxRetries < 0 {
+		return fmt.Errorf("ai max retries cannot be negative")
+	}
+	if c.AIConfig.RetryBackoff <= 0 {
+		return fmt.Errorf("ai retry backoff must be positive")
+	}
+	if c.AIConfig.BreakerThreshold <= 0 {
+		return fmt.Errorf("ai breaker threshold must be positive")
+	}
+	if c.AIConfig.BreakerCooldown <= 0 {
+		return fmt.Errorf("ai breaker cooldown must be positive")
+	}
+
+	// 验证AI超时配置
+	if c.AIConfig.ConnectTimeout <= 0 || c.AIConfig.FirstTokenTimeout <= 0 || c.AIConfig.IdleTimeout <= 0 {
+		return fmt.Errorf("ai timeouts must be positive")
+	}
+
+	// 验证AI并发配置
+	if c.AIConfig.MaxConcurrent < 0 || c.AIConfig.MaxConcurrentPerUser < 0 || c.AIConfig.MaxQueue < 0 {
+		return fmt.Errorf("ai concurrency limits cannot be negative")
+	}
+
+	// 验证AI会话配置
+	if c.AIConfig.HistoryTurns < 0 {
+		return fmt.Errorf("ai history turns cannot be negative")
+	}
+	if c.AIConfig.HistoryChars <= 0 {
+		return fmt.Errorf("ai history chars must be positive")
+	}
+
+	// 验证AI用量配额配置
+	if c.AIConfig.DailyTokenQuota < 0 || c.AIConfig.MonthlyTokenQuota < 0 {
+		return fmt.Errorf("ai token quota cannot be negative")
+	}
+
+	// 验证AI图片请求配置
+	if c.AIConfig.ImagePrompt == "" {
+		return fmt.Errorf("ai image prompt cannot be empty")
+	}
+	if c.AIConfig.MaxImages <= 0 {
+		return fmt.Errorf("ai max images must be positive")
+	}
+
+	// 验证WebSocket配置
+	if c.WebSocketConfig.SendQueueSize <= 0 {
+		return fmt.Errorf("websocket send queue size must be positive")
+	}
+	if c.WebSocketConfig.WriteTimeout <= 0 {
+		return fmt.Errorf("websocket write timeout must be positive")
+	}
+	if c.WebSocketConfig.SlowConsumerPolicy != "drop_oldest" && c.WebSocketConfig.SlowConsumerPolicy != "disconnect" {
+		return fmt.Errorf("invalid websocket slow consumer policy: %s, must be one of drop_oldest, disconnect", c.WebSocketConfig.SlowConsumerPolicy)
+	}
+	if c.WebSocketConfig.PingInterval <= 0 {
+		return fmt.Errorf("websocket ping interval must be positive")
+	}
+	if c.WebSocketConfig.IdleTimeout <= c.WebSocketConfig.PingInterval {
+		return fmt.Errorf("websocket idle timeout must be greater than ping interval")
+	}
+	if c.WebSocketConfig.ReplayLimit <= 0 {
+		return fmt.Errorf("websocket replay limit must be positive")
+	}
+	if c.WebSocketConfig.MaxImageSize <= 0 {
+		return fmt.Errorf("websocket max image size must be positive")
+	}
+	if c.WebSocketConfig.UploadTimeout <= 0 {
+		return fmt.Errorf("websocket upload timeout must be positive")
+	}
+	if c.WebSocketConfig.MaxGenerations <= 0 {
+		return fmt.Errorf("websocket max generations must be positive")
+	}
+
+	// 验证消息广播后端配置
+	switch c.BrokerConfig.Backend {
+	case "memory":
+	case "mesh":
+		if c.BrokerConfig.ListenAddr == "" {
+			return fmt.Errorf("broker listen addr cannot be empty when backend is mesh")
+		}
+		if c.BrokerConfig.Secret == "" {
+			return fmt.Errorf("broker secret cannot be empty when backend is mesh")
+		}
+	default:
+		return fmt.Errorf("invalid broker backend: %s, must be one of memory, mesh", c.BrokerConfig.Backend)
+	}
+
 	return nil
 }
 
-// LoadConfig 加载配置
-// 优先级：命令行参数 > 环境变量 > yaml配置文件 > 默认值
-func LoadConfig() *Config {
-	// 默认配置
-	config := &Config{
+// validateModels 验证模型目录：模型名称不能为空或重复，能力和提供方必须有效，默认模型和备用模型必须在目录中
+func (c *Config) validateModels() error {
+	if len(c.AIConfig.Models) == 0 {
+		return nil
+	}
+	names := make(map[string]bool)
+	for _, model := range c.AIConfig.Models {
+		if model.Name == "" {
+			return fmt.Errorf("ai model name cannot be empty")
+		}
+		if names[model.Name] {
+			return fmt.Errorf("duplicate ai model: %s", model.Name)
+		}
+		names[model.Name] = true
+		if model.Provider != "" && !aiProviders[model.Provider] {
+			return fmt.Errorf("invalid ai provider for model %s: %s, must be one of openai, anthropic, ollama, fake", model.Name, model.Provider)
+		}
+		for _, capability := range model.Capabilities {
+			if !modelCapabilities[capability] {
+				return fmt.Errorf("invalid capability for model %s: %s, must be one of vision, thinking, tools", model.Name, capability)
+			}
+		}
+		if model.ContextWindow < 0 || model.InputPrice < 0 || model.OutputPrice < 0 {
+			return fmt.Errorf("context window and prices of model %s cannot be negative", model.Name)
+		}
+	}
+	if !names[c.AIConfig.Model] {
+		return fmt.Errorf("ai model %s is not in ai_models", c.AIConfig.Model)
+	}
+	for _, fallback := range c.AIConfig.FallbackModelList() {
+		if !names[fallback] {
+			return fmt.Errorf("ai fallback model %s is not in ai_models", fallback)
+		}
+	}
+	return nil
+}
+
+// defaultConfig 创建默认配置
+func defaultConfig() *Config {
+	return &Config{
 		Port: 8080, // 默认端口8080
+		AIConfig: AIConfig{
+			Provider:             "openai", // 默认使用OpenAI兼容接口
+			AnthropicMaxTokens:   4096,     // 默认Anthropic单次回答最多4096个token
+			FakeLatency:          30,       // 默认模拟提供方每30毫秒输出一个片段
+			MaxRetries:           2,        // 默认同一上游最多重试2次
+			RetryBackoff:         500,      // 默认首次重试前等待500毫秒
+			BreakerThreshold:     3,        // 默认连续失败3次后熔断
+			BreakerCooldown:      30,       // 默认熔断30秒
+			ConnectTimeout:       10,       // 默认连接上游10秒超时
+			FirstTokenTimeout:    60,       // 默认60秒内未收到首个片段时超时
+			IdleTimeout:          30,       // 默认两个片段间隔超过30秒时超时
+			MaxConcurrent:        32,       // 默认全局最多同时执行32个AI生成
+			MaxConcurrentPerUser: 3,        // 默认每个用户最多同时执行3个AI生成
+			MaxQueue:             100,      // 默认最多100个AI生成排队等待
+			HistoryTurns:         20,       // 默认最多回放最近20个轮次（10问10答）
+			HistoryChars:         16000,    // 默认回放的历史轮次最多16000字
+			MaxImages:            4,        // 默认单次请求最多携带4张图片
+			ImagePrompt:          "请描述这张图片",
+		},
 		DatabaseConfig: DatabaseConfig{
 			Host:     "127.0.0.1", // 默认数据库主机
 			Port:     3308,        // 默认数据库端口
@@ -116,7 +423,28 @@ func LoadConfig() *Config {
 			ConsoleServer:   true,    // 默认将基本日志信息输出到控制台
 			ConsoleDatabase: true,    // 默认将数据库操作日志信息输出到控制台
 		},
+		WebSocketConfig: WebSocketConfig{
+			SendQueueSize:      256,          // 默认每个连接最多缓存256条待发送消息
+			WriteTimeout:       10,           // 默认写入超时10秒
+			SlowConsumerPolicy: "disconnect", // 默认断开慢消费者
+			PingInterval:       25,           // 默认每25秒发送一次心跳
+			IdleTimeout:        60,           // 默认60秒未收到数据视为连接失效
+			ReplayLimit:        100,          // 默认每批重放100条离线消息
+			MaxImageSize:       10240,        // 默认单张图片最大10MB
+			UploadTimeout:      30,           // 默认分片上传30秒内未完成则丢弃
+			MaxGenerations:     3,            // 默认每个连接最多同时进行3个AI生成
+		},
+		BrokerConfig: BrokerConfig{
+			Backend: "memory", // 默认单实例进程内广播
+		},
 	}
+}
+
+// LoadConfig 加载配置
+// 优先级：命令行参数 > 环境变量 > yaml配置文件 > 默认值
+func LoadConfig() *Config {
+	// 默认配置
+	config := defaultConfig()
 
 	// 从yaml配置文件加载
 	config.loadFromYaml()
@@ -139,6 +467,22 @@ func LoadConfig() *Config {
 	if model := os.Getenv("AI_MODEL"); model != "" {
 		config.AIConfig.Model = model
 	}
+	// 加载AI服务提供方配置
+	if aiProvider := os.Getenv("AI_PROVIDER"); aiProvider != "" {
+		config.AIConfig.Provider = aiProvider
+	}
+	if anthropicApiKey := os.Getenv("ANTHROPIC_API_KEY"); anthropicApiKey != "" {
+		config.AIConfig.AnthropicApiKey = anthropicApiKey
+	}
+	if anthropicBaseURL := os.Getenv("ANTHROPIC_BASE_URL"); anthropicBaseURL != "" {
+		config.AIConfig.AnthropicBaseURL = anthropicBaseURL
+	}
+	if ollamaBaseURL := os.Getenv("OLLAMA_BASE_URL"); ollamaBaseURL != "" {
+		config.AIConfig.OllamaBaseURL = ollamaBaseURL
+	}
+	if fallbackModels := os.Getenv("AI_FALLBACK_MODELS"); fallbackModels != "" {
+		config.AIConfig.FallbackModels = fallbackModels
+	}
 	// 加载数据库配置
 	if dbHost := os.Getenv("DB_HOST"); dbHost != "" {
 		config.DatabaseConfig.Host = dbHost
@@ -166,12 +510,29 @@ func LoadConfig() *Config {
 			config.JWTConfig.ExpireHour = jwtExpire
 		}
 	}
+	// 加载消息广播后端配置
+	if brokerBackend := os.Getenv("BROKER_BACKEND"); brokerBackend != "" {
+		config.BrokerConfig.Backend = brokerBackend
+	}
+	if brokerNodeID := os.Getenv("BROKER_NODE_ID"); brokerNodeID != "" {
+		config.BrokerConfig.NodeID = brokerNodeID
+	}
+	if brokerListen := os.Getenv("BROKER_LISTEN_ADDR"); brokerListen != "" {
+		config.BrokerConfig.ListenAddr = brokerListen
+	}
+	if brokerPeers := os.Getenv("BROKER_PEERS"); brokerPeers != "" {
+		config.BrokerConfig.Peers = brokerPeers
+	}
+	if brokerSecret := os.Getenv("BROKER_SECRET"); brokerSecret != "" {
+		config.BrokerConfig.Secret = brokerSecret
+	}
 
 	// 从命令行参数加载（优先级最高）
 	portFlag := flag.Int("port", 0, "服务器端口")
 	apiKeyFlag := flag.String("ai-api-key", "", "AI服务API密钥")
 	baseURLFlag := flag.String("ai-base-url", "", "AI服务基础URL")
 	modelFlag := flag.String("ai-model", "", "AI模型名称")
+	providerFlag := flag.String("ai-provider", "", "默认的对话服务提供方（openai/anthropic/ollama/fake）")
 	dbHostFlag := flag.String("db-host", "", "数据库主机")
 	dbPortFlag := flag.Int("db-port", 0, "数据库端口")
 	dbUserFlag := flag.String("db-user", "", "数据库用户名")
@@ -179,6 +540,10 @@ func LoadConfig() *Config {
 	dbNameFlag := flag.String("db-name", "", "数据库名称")
 	jwtSecretFlag := flag.String("jwt-secret", "", "JWT密钥")
 	jwtExpireFlag := flag.Int("jwt-expire", 0, "JWT过期时间（小时）")
+	brokerBackendFlag := flag.String("broker-backend", "", "消息广播后端（memory/mesh）")
+	brokerNodeIDFlag := flag.String("broker-node-id", "", "节点ID")
+	brokerListenFlag := flag.String("broker-listen", "", "mesh模式下节点间通信的监听地址")
+	brokerPeersFlag := flag.String("broker-peers", "", "mesh模式下其他节点的监听地址，逗号分隔")
 	flag.Parse()
 
 	if *portFlag != 0 {
@@ -193,6 +558,9 @@ func LoadConfig() *Config {
 	if *modelFlag != "" {
 		config.AIConfig.Model = *modelFlag
 	}
+	if *providerFlag != "" {
+		config.AIConfig.Provider = *providerFlag
+	}
 	if *dbHostFlag != "" {
 		config.DatabaseConfig.Host = *dbHostFlag
 	}
@@ -214,6 +582,24 @@ func LoadConfig() *Config {
 	if *jwtExpireFlag != 0 {
 		config.JWTConfig.ExpireHour = *jwtExpireFlag
 	}
+	if *brokerBackendFlag != "" {
+		config.BrokerConfig.Backend = *brokerBackendFlag
+	}
+	if *brokerNodeIDFlag != "" {
+		config.BrokerConfig.NodeID = *brokerNodeIDFlag
+	}
+	if *brokerListenFlag != "" {
+		config.BrokerConfig.ListenAddr = *brokerListenFlag
+	}
+	if *brokerPeersFlag != "" {
+		config.BrokerConfig.Peers = *brokerPeersFlag
+	}
+
+	// 未指定节点ID时使用主机名和端口
+	if config.BrokerConfig.NodeID == "" {
+		hostname, _ := os.Hostname()
+		config.BrokerConfig.NodeID = fmt.Sprintf("%s:%d", hostname, config.Port)
+	}
 
 	// 验证配置有效性
 	if err := config.Validate(); err != nil {
@@ -238,6 +624,40 @@ type FlatConfig struct {
 	AiBaseUrl string `yaml:"ai_base_url"`
 	AiModel   string `yaml:"ai_model"`
 	Thinking  string `yaml:"thinking"`
+	// AI服务提供方配置
+	AiProvider         string `yaml:"ai_provider"`
+	AiModelProviders   string `yaml:"ai_model_providers"`
+	AnthropicApiKey    string `yaml:"anthropic_api_key"`
+	AnthropicBaseUrl   string `yaml:"anthropic_base_url"`
+	AnthropicMaxTokens int    `yaml:"anthropic_max_tokens"`
+	OllamaBaseUrl      string `yaml:"ollama_base_url"`
+	FakeScript         string `yaml:"fake_script"`
+	FakeLatency        int    `yaml:"fake_latency"`
+	// AI重试和熔断配置
+	AiFallbackModels   string `yaml:"ai_fallback_models"`
+	AiMaxRetries       *int   `yaml:"ai_max_retries"` // 0表示不重试，使用指针区分未配置和显式配置为0
+	AiRetryBackoff     int    `yaml:"ai_retry_backoff"`
+	AiBreakerThreshold int    `yaml:"ai_breaker_threshold"`
+	AiBreakerCooldown  int    `yaml:"ai_breaker_cooldown"`
+	// AI超时和并发配置
+	AiConnectTimeout    int `yaml:"ai_connect_timeout"`
+	AiFirstTokenTimeout int `yaml:"ai_first_token_timeout"`
+	AiIdleTimeout       int `yaml:"ai_idle_timeout"`
+	// 0表示不限制，使用指针区分未配置和显式配置为0
+	AiMaxConcurrent        *int `yaml:"ai_max_concurrent"`
+	AiMaxConcurrentPerUser *int `yaml:"ai_max_concurrent_per_user"`
+	AiMaxQueue             *int `yaml:"ai_max_queue"`
+	// AI会话配置
+	// 使用指针区分未配置和显式配置为0：轮次为0表示不回放，字符数为0会被校验拒绝
+	AiHistoryTurns   *int `yaml:"ai_history_turns"`
+	AiHistoryChars   *int `yaml:"ai_history_chars"`
+	AiStoreReasoning bool `yaml:"ai_store_reasoning"`
+	// AI用量配额配置
+	AiDailyTokenQuota   int `yaml:"ai_daily_token_quota"`
+	AiMonthlyTokenQuota int `yaml:"ai_monthly_token_quota"`
+	// AI图片请求配置
+	AiImagePrompt string `yaml:"ai_image_prompt"`
+	AiMaxImages   int    `yaml:"ai_max_images"`
 	// 日志配置
 	LogLevel           string `yaml:"log_level"`
 	LogFilePath        string `yaml:"log_file_path"`
@@ -246,6 +666,25 @@ type FlatConfig struct {
 	LogCompress        bool   `yaml:"log_compress"`
 	LogConsoleServer   bool   `yaml:"log_console_server"`
 	LogConsoleDatabase bool   `yaml:"log_console_database"`
+	// WebSocket配置
+	WsSendQueueSize      int    `yaml:"ws_send_queue_size"`
+	WsWriteTimeout       int    `yaml:"ws_write_timeout"`
+	WsSlowConsumerPolicy string `yaml:"ws_slow_consumer_policy"`
+	WsPingInterval       int    `yaml:"ws_ping_interval"`
+	WsIdleTimeout        int    `yaml:"ws_idle_timeout"`
+	WsReplayLimit        int    `yaml:"ws_replay_limit"`
+	WsMaxImageSize       int    `yaml:"ws_max_image_size"`
+	WsUploadTimeout      int    `yaml:"ws_upload_timeout"`
+	WsMaxGenerations     int    `yaml:"ws_max_generations"`
+	// 消息广播后端配置
+	BrokerBackend    string `yaml:"broker_backend"`
+	BrokerNodeID     string `yaml:"broker_node_id"`
+	BrokerListenAddr string `yaml:"broker_listen_addr"`
+	BrokerPeers      string `yaml:"broker_peers"`
+	BrokerSecret     string `yaml:"broker_secret"`
+
+	// AI模型目录配置
+	AiModels []ModelConfig `yaml:"ai_models"`
 }
 
 // loadFromYaml 从yaml配置文件加载配置
@@ -256,7 +695,11 @@ func (c *Config) loadFromYaml() {
 		// 如果文件不存在，使用默认配置
 		return
 	}
+	c.loadYamlData(yamlFile)
+}
 
+// loadYamlData 将yaml配置内容覆盖到当前配置上，未配置的项保留原值
+func (c *Config) loadYamlData(yamlFile []byte) {
 	// 直接解析为扁平结构体
 	var flatConfig FlatConfig
 	if err := yaml.Unmarshal(yamlFile, &flatConfig); err != nil {
@@ -299,6 +742,91 @@ func (c *Config) loadFromYaml() {
 		if thinking, ok := rawConfig["thinking"].(string); ok {
 			c.AIConfig.Thinking = thinking
 		}
+		if aiProvider, ok := rawConfig["ai_provider"].(string); ok {
+			c.AIConfig.Provider = aiProvider
+		}
+		if aiModelProviders, ok := rawConfig["ai_model_providers"].(string); ok {
+			c.AIConfig.ModelProviders = aiModelProviders
+		}
+		// 模型目录为列表，重新编码后按结构解析
+		if aiModels, ok := rawConfig["ai_models"]; ok {
+			var models []ModelConfig
+			if data, err := yaml.Marshal(aiModels); err == nil && yaml.Unmarshal(data, &models) == nil {
+				c.AIConfig.Models = models
+			}
+		}
+		if anthropicApiKey, ok := rawConfig["anthropic_api_key"].(string); ok {
+			c.AIConfig.AnthropicApiKey = anthropicApiKey
+		}
+		if anthropicBaseURL, ok := rawConfig["anthropic_base_url"].(string); ok {
+			c.AIConfig.AnthropicBaseURL = anthropicBaseURL
+		}
+		if anthropicMaxTokens, ok := rawConfig["anthropic_max_tokens"].(int); ok {
+			c.AIConfig.AnthropicMaxTokens = anthropicMaxTokens
+		}
+		if ollamaBaseURL, ok := rawConfig["ollama_base_url"].(string); ok {
+			c.AIConfig.OllamaBaseURL = ollamaBaseURL
+		}
+		if fakeScript, ok := rawConfig["fake_script"].(string); ok {
+			c.AIConfig.FakeScript = fakeScript
+		}
+		if fakeLatency, ok := rawConfig["fake_latency"].(int); ok {
+			c.AIConfig.FakeLatency = fakeLatency
+		}
+		if aiFallbackModels, ok := rawConfig["ai_fallback_models"].(string); ok {
+			c.AIConfig.FallbackModels = aiFallbackModels
+		}
+		if aiMaxRetries, ok := rawConfig["ai_max_retries"].(int); ok {
+			c.AIConfig.MaxRetries = aiMaxRetries
+		}
+		if aiRetryBackoff, ok := rawConfig["ai_retry_backoff"].(int); ok {
+			c.AIConfig.RetryBackoff = aiRetryBackoff
+		}
+		if aiBreakerThreshold, ok := rawConfig["ai_breaker_threshold"].(int); ok {
+			c.AIConfig.BreakerThreshold = aiBreakerThreshold
+		}
+		if aiBreakerCooldown, ok := rawConfig["ai_breaker_cooldown"].(int); ok {
+			c.AIConfig.BreakerCooldown = aiBreakerCooldown
+		}
+		if aiConnectTimeout, ok := rawConfig["ai_connect_timeout"].(int); ok {
+			c.AIConfig.ConnectTimeout = aiConnectTimeout
+		}
+		if aiFirstTokenTimeout, ok := rawConfig["ai_first_token_timeout"].(int); ok {
+			c.AIConfig.FirstTokenTimeout = aiFirstTokenTimeout
+		}
+		if aiIdleTimeout, ok := rawConfig["ai_idle_timeout"].(int); ok {
+			c.AIConfig.IdleTimeout = aiIdleTimeout
+		}
+		if aiMaxConcurrent, ok := rawConfig["ai_max_concurrent"].(int); ok {
+			c.AIConfig.MaxConcurrent = aiMaxConcurrent
+		}
+		if aiMaxConcurrentPerUser, ok := rawConfig["ai_max_concurrent_per_user"].(int); ok {
+			c.AIConfig.MaxConcurrentPerUser = aiMaxConcurrentPerUser
+		}
+		if aiMaxQueue, ok := rawConfig["ai_max_queue"].(int); ok {
+			c.AIConfig.MaxQueue = aiMaxQueue
+		}
+		if aiHistoryTurns, ok := rawConfig["ai_history_turns"].(int); ok {
+			c.AIConfig.HistoryTurns = aiHistoryTurns
+		}
+		if aiHistoryChars, ok := rawConfig["ai_history_chars"].(int); ok {
+			c.AIConfig.HistoryChars = aiHistoryChars
+		}
+		if aiStoreReasoning, ok := rawConfig["ai_store_reasoning"].(bool); ok {
+			c.AIConfig.StoreReasoning = aiStoreReasoning
+		}
+		if aiDailyTokenQuota, ok := rawConfig["ai_daily_token_quota"].(int); ok {
+			c.AIConfig.DailyTokenQuota = aiDailyTokenQuota
+		}
+		if aiMonthlyTokenQuota, ok := rawConfig["ai_monthly_token_quota"].(int); ok {
+			c.AIConfig.MonthlyTokenQuota = aiMonthlyTokenQuota
+		}
+		if aiImagePrompt, ok := rawConfig["ai_image_prompt"].(string); ok {
+			c.AIConfig.ImagePrompt = aiImagePrompt
+		}
+		if aiMaxImages, ok := rawConfig["ai_max_images"].(int); ok {
+			c.AIConfig.MaxImages = aiMaxImages
+		}
 		// 日志配置
 		if logLevel, ok := rawConfig["log_level"].(string); ok {
 			c.LogConfig.Level = logLevel
@@ -321,6 +849,50 @@ func (c *Config) loadFromYaml() {
 		if logConsoleDatabase, ok := rawConfig["log_console_database"].(bool); ok {
 			c.LogConfig.ConsoleDatabase = logConsoleDatabase
 		}
+		// WebSocket配置
+		if wsSendQueueSize, ok := rawConfig["ws_send_queue_size"].(int); ok {
+			c.WebSocketConfig.SendQueueSize = wsSendQueueSize
+		}
+		if wsWriteTimeout, ok := rawConfig["ws_write_timeout"].(int); ok {
+			c.WebSocketConfig.WriteTimeout = wsWriteTimeout
+		}
+		if wsSlowConsumerPolicy, ok := rawConfig["ws_slow_consumer_policy"].(string); ok {
+			c.WebSocketConfig.SlowConsumerPolicy = wsSlowConsumerPolicy
+		}
+		if wsPingInterval, ok := rawConfig["ws_ping_interval"].(int); ok {
+			c.WebSocketConfig.PingInterval = wsPingInterval
+		}
+		if wsIdleTimeout, ok := rawConfig["ws_idle_timeout"].(int); ok {
+			c.WebSocketConfig.IdleTimeout = wsIdleTimeout
+		}
+		if wsReplayLimit, ok := rawConfig["ws_replay_limit"].(int); ok {
+			c.WebSocketConfig.ReplayLimit = wsReplayLimit
+		}
+		if wsMaxImageSize, ok := rawConfig["ws_max_image_size"].(int); ok {
+			c.WebSocketConfig.MaxImageSize = wsMaxImageSize
+		}
+		if wsUploadTimeout, ok := rawConfig["ws_upload_timeout"].(int); ok {
+			c.WebSocketConfig.UploadTimeout = wsUploadTimeout
+		}
+		if wsMaxGenerations, ok := rawConfig["ws_max_generations"].(int); ok {
+			c.WebSocketConfig.MaxGenerations = wsMaxGenerations
+		}
+		// 消息广播后端配置
+		if brokerBackend, ok := rawConfig["broker_backend"].(string); ok {
+			c.BrokerConfig.Backend = brokerBackend
+		}
+		if brokerNodeID, ok := rawConfig["broker_node_id"].(string); ok {
+			c.BrokerConfig.NodeID = brokerNodeID
+		}
+		if brokerListenAddr, ok := rawConfig["broker_listen_addr"].(string); ok {
+			c.BrokerConfig.ListenAddr = brokerListenAddr
+		}
+		if brokerPeers, ok := rawConfig["broker_peers"].(string); ok {
+			c.BrokerConfig.Peers = brokerPeers
+		}
+		if brokerSecret, ok := rawConfig["broker_secret"].(string); ok {
+			c.BrokerConfig.Secret = brokerSecret
+		}
 		return
 	}
 
@@ -357,6 +929,85 @@ func (c *Config) loadFromYaml() {
 	if flatConfig.Thinking != "" {
 		c.AIConfig.Thinking = flatConfig.Thinking
 	}
+	if flatConfig.AiProvider != "" {
+		c.AIConfig.Provider = flatConfig.AiProvider
+	}
+	if flatConfig.AiModelProviders != "" {
+		c.AIConfig.ModelProviders = flatConfig.AiModelProviders
+	}
+	if len(flatConfig.AiModels) > 0 {
+		c.AIConfig.Models = flatConfig.AiModels
+	}
+	if flatConfig.AnthropicApiKey != "" {
+		c.AIConfig.AnthropicApiKey = flatConfig.AnthropicApiKey
+	}
+	if flatConfig.AnthropicBaseUrl != "" {
+		c.AIConfig.AnthropicBaseURL = flatConfig.AnthropicBaseUrl
+	}
+	if flatConfig.AnthropicMaxTokens != 0 {
+		c.AIConfig.AnthropicMaxTokens = flatConfig.AnthropicMaxTokens
+	}
+	if flatConfig.OllamaBaseUrl != "" {
+		c.AIConfig.OllamaBaseURL = flatConfig.OllamaBaseUrl
+	}
+	if flatConfig.FakeScript != "" {
+		c.AIConfig.FakeScript = flatConfig.FakeScript
+	}
+	if flatConfig.FakeLatency != 0 {
+		c.AIConfig.FakeLatency = flatConfig.FakeLatency
+	}
+	if flatConfig.AiFallbackModels != "" {
+		c.AIConfig.FallbackModels = flatConfig.AiFallbackModels
+	}
+	if flatConfig.AiMaxRetries != nil {
+		c.AIConfig.MaxRetries = *flatConfig.AiMaxRetries
+	}
+	if flatConfig.AiRetryBackoff != 0 {
+		c.AIConfig.RetryBackoff = flatConfig.AiRetryBackoff
+	}
+	if flatConfig.AiBreakerThreshold != 0 {
+		c.AIConfig.BreakerThreshold = flatConfig.AiBreakerThreshold
+	}
+	if flatConfig.AiBreakerCooldown != 0 {
+		c.AIConfig.BreakerCooldown = flatConfig.AiBreakerCooldown
+	}
+	if flatConfig.AiConnectTimeout != 0 {
+		c.AIConfig.ConnectTimeout = flatConfig.AiConnectTimeout
+	}
+	if flatConfig.AiFirstTokenTimeout != 0 {
+		c.AIConfig.FirstTokenTimeout = flatConfig.AiFirstTokenTimeout
+	}
+	if flatConfig.AiIdleTimeout != 0 {
+		c.AIConfig.IdleTimeout = flatConfig.AiIdleTimeout
+	}
+	if flatConfig.AiMaxConcurrent != nil {
+		c.AIConfig.MaxConcurrent = *flatConfig.AiMaxConcurrent
+	}
+	if flatConfig.AiMaxConcurrentPerUser != nil {
+		c.AIConfig.MaxConcurrentPerUser = *flatConfig.AiMaxConcurrentPerUser
+	}
+	if flatConfig.AiMaxQueue != nil {
+		c.AIConfig.MaxQueue = *flatConfig.AiMaxQueue
+	}
+	if flatConfig.AiHistoryTurns != nil {
+		c.AIConfig.HistoryTurns = *flatConfig.AiHistoryTurns
+	}
+	if flatConfig.AiHistoryChars != nil {
+		c.AIConfig.HistoryChars = *flatConfig.AiHistoryChars
+	}
+	c.AIConfig.StoreReasoning = flatConfig.AiStoreReasoning
+	if flatConfig.AiDailyTokenQuota != 0 {
+		c.AIConfig.DailyTokenQuota = flatConfig.AiDailyTokenQuota
+	}
+	if flatConfig.AiMonthlyTokenQuota != 0 {
+		c.AIConfig.MonthlyTokenQuota = flatConfig.AiMonthlyTokenQuota
+	}
+	if flatConfig.AiImagePrompt != "" {
+		c.AIConfig.ImagePrompt = flatConfig.AiImagePrompt
+	}
+	if flatConfig.AiMaxImages != 0 {
+		c.AIConfig.MaxImages = flatConfig.AiMaxImages
+	}
 	// 日志配置
 	if flatConfig.LogLevel != "" {
 		c.LogConfig.Level = flatConfig.LogLevel
@@ -374,4 +1025,47 @@ func (c *Config) loadFromYaml() {
 	c.LogConfig.Compress = flatConfig.LogCompress
 	c.LogConfig.ConsoleServer = flatConfig.LogConsoleServer
 	c.LogConfig.ConsoleDatabase = flatConfig.LogConsoleDatabase
+	// WebSocket配置
+	if flatConfig.WsSendQueueSize != 0 {
+		c.WebSocketConfig.SendQueueSize = flatConfig.WsSendQueueSize
+	}
+	if flatConfig.WsWriteTimeout != 0 {
+		c.WebSocketConfig.WriteTimeout = flatConfig.WsWriteTimeout
+	}
+	if flatConfig.WsSlowConsumerPolicy != "" {
+		c.WebSocketConfig.SlowConsumerPolicy = flatConfig.WsSlowConsumerPolicy
+	}
+	if flatConfig.WsPingInterval != 0 {
+		c.WebSocketConfig.PingInterval = flatConfig.WsPingInterval
+	}
+	if flatConfig.WsIdleTimeout != 0 {
+		c.WebSocketConfig.IdleTimeout = flatConfig.WsIdleTimeout
+	}
+	if flatConfig.WsReplayLimit != 0 {
+		c.WebSocketConfig.ReplayLimit = flatConfig.WsReplayLimit
+	}
+	if flatConfig.WsMaxImageSize != 0 {
+		c.WebSocketConfig.MaxImageSize = flatConfig.WsMaxImageSize
+	}
+	if flatConfig.WsUploadTimeout != 0 {
+		c.WebSocketConfig.UploadTimeout = flatConfig.WsUploadTimeout
+	}
+	if flatConfig.WsMaxGenerations != 0 {
+		c.WebSocketConfig.MaxGenerations = flatConfig.WsMaxGenerations
+	}
+	if flatConfig.BrokerBackend != "" {
+		c.BrokerConfig.Backend = flatConfig.BrokerBackend
+	}
+	if flatConfig.BrokerNodeID != "" {
+		c.BrokerConfig.NodeID = flatConfig.BrokerNodeID
+	}
+	if flatConfig.BrokerListenAddr != "" {
+		c.BrokerConfig.ListenAddr = flatConfig.BrokerListenAddr
+	}
+	if flatConfig.BrokerPeers != "" {
+		c.BrokerConfig.Peers = flatConfig.BrokerPeers
+	}
+	if flatConfig.BrokerSecret != "" {
+		c.BrokerConfig.Secret = flatConfig.BrokerSecret
+	}
 }
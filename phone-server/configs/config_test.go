@@ -0,0 +1,71 @@
+package configs
+
+import (
+	"testing"
+)
+
+func TestLoadYamlExplicitZero(t *testing.T) {
+	tests := []struct {
+		name  string
+		yaml  string
+		check func(t *testing.T, c *Config)
+	}{
+		{
+			name: "未配置时保留默认值",
+			yaml: "port: 9090\n",
+			check: func(t *testing.T, c *Config) {
+				if c.AIConfig.MaxConcurrent != 32 || c.AIConfig.MaxConcurrentPerUser != 3 || c.AIConfig.MaxQueue != 100 {
+					t.Fatalf("并发配置 = %d/%d/%d，期望保留默认值 32/3/100",
+						c.AIConfig.MaxConcurrent, c.AIConfig.MaxConcurrentPerUser, c.AIConfig.MaxQueue)
+				}
+			},
+		},
+		{
+			name: "并发和排队上限配置为0表示不限制",
+			yaml: "ai_max_concurrent: 0\nai_max_concurrent_per_user: 0\nai_max_queue: 0\n",
+			check: func(t *testing.T, c *Config) {
+				if c.AIConfig.MaxConcurrent != 0 || c.AIConfig.MaxConcurrentPerUser != 0 || c.AIConfig.MaxQueue != 0 {
+					t.Fatalf("并发配置 = %d/%d/%d，期望 0/0/0",
+						c.AIConfig.MaxConcurrent, c.AIConfig.MaxConcurrentPerUser, c.AIConfig.MaxQueue)
+				}
+			},
+		},
+		{
+			name: "历史轮次配置为0表示不回放",
+			yaml: "ai_history_turns: 0\n",
+			check: func(t *testing.T, c *Config) {
+				if c.AIConfig.HistoryTurns != 0 {
+					t.Fatalf("HistoryTurns = %d，期望 0", c.AIConfig.HistoryTurns)
+				}
+			},
+		},
+		{
+			name: "历史字符数配置为0时生效并由校验拒绝",
+			yaml: "ai_history_chars: 0\n",
+			check: func(t *testing.T, c *Config) {
+				if c.AIConfig.HistoryChars != 0 {
+					t.Fatalf("HistoryChars = %d，期望 0", c.AIConfig.HistoryChars)
+				}
+				if err := c.Validate(); err == nil {
+					t.Fatal("ai_history_chars为0时校验应失败")
+				}
+			},
+		},
+		{
+			name: "重试次数配置为0表示不重试",
+			yaml: "ai_max_retries: 0\n",
+			check: func(t *testing.T, c *Config) {
+				if c.AIConfig.MaxRetries != 0 {
+					t.Fatalf("MaxRetries = %d，期望 0", c.AIConfig.MaxRetries)
+				}
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			config := defaultConfig()
+			config.loadYamlData([]byte(tt.yaml))
+			tt.check(t, config)
+		})
+	}
+}
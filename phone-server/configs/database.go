@@ -63,8 +63,14 @@ func migrateDatabase(db *gorm.DB) error {
 	return db.AutoMigrate(
 		&models.User{},
 		&models.Device{},
+		&models.DevicePresence{},
 		&models.Message{},
 		&models.AIResult{},
+		&models.MessageReceipt{},
+		&models.PairingCode{},
+		&models.Conversation{},
+		&models.ConversationTurn{},
+		&models.AIUsage{},
 	)
 }
 
@@ -0,0 +1,37 @@
+package handlers
+
+import (
+	"phone-server/services"
+	"phone-server/utils"
+
+	"github.com/gin-gonic/gin"
+)
+
+// AIModelHandler AI模型目录接口处理器
+type AIModelHandler struct {
+	catalog *services.ModelCatalog // 模型目录
+}
+
+// NewAIModelHandler 创建AI模型目录接口处理器实例
+func NewAIModelHandler(catalog *services.ModelCatalog) *AIModelHandler {
+	return &AIModelHandler{
+		catalog: catalog,
+	}
+}
+
+// ListModels 查询可用的AI模型
+// @Summary 查询AI模型目录
+// @Description 按配置顺序返回可用的模型及其显示名称、能力（vision/thinking/tools）、上下文窗口和每百万token的价格，以及未指定模型时使用的默认模型
+// @Description 聊天请求的model字段需为目录中的模型；向不具备vision能力的模型发送图片，或向不具备thinking能力的模型开启思考模式会被拒绝
+// @Tags ai
+// @Produce json
+// @Security ApiKeyAuth
+// @Success 200 {object} map[string]interface{} "模型目录"
+// @Failure 401 {object} map[string]interface{} "未授权"
+// @Router /api/ai/models [get]
+func (h *AIModelHandler) ListModels(c *gin.Context) {
+	utils.SuccessResponse(c, gin.H{
+		"models":  h.catalog.List(),
+		"default": h.catalog.Default(),
+	})
+}
@@ -0,0 +1,203 @@
+package handlers
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+
+	"phone-server/models"
+	"phone-server/services"
+	"phone-server/utils"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+const (
+	// defaultAIResultLimit 查询AI结果时默认返回的条数
+	defaultAIResultLimit = 20
+	// maxAIResultLimit 查询AI结果时最多返回的条数
+	maxAIResultLimit = 100
+)
+
+// AIResultHandler AI结果接口处理器
+type AIResultHandler struct {
+	db            *gorm.DB                  // 数据库连接
+	resultService *services.AIResultService // AI结果服务
+}
+
+// ResendAIResultRequest 转发AI结果请求参数
+type ResendAIResultRequest struct {
+	Target         string `json:"target"`           // 投递目标：all/others/pc/phone/device，默认为phone
+	TargetDeviceID uint   `json:"target_device_id"` // Target为device时的目标设备ID
+}
+
+// NewAIResultHandler 创建AI结果接口处理器实例
+func NewAIResultHandler(db *gorm.DB, resultService *services.AIResultService) *AIResultHandler {
+	return &AIResultHandler{
+		db:            db,
+		resultService: resultService,
+	}
+}
+
+// ListResults 查询当前用户的AI回答历史
+// @Summary 查询AI回答历史
+// @Description 按时间倒序返回当前用户的AI回答，包括被取消或中止的回答。使用上一页最后一条的id作为before_id翻页
+// @Tags ai
+// @Produce json
+// @Security ApiKeyAuth
+// @Param conversation_id query int false "仅查询该会话的回答"
+// @Param before_id query int false "仅查询ID小于该值的回答"
+// @Param limit query int false "返回条数，默认20，最多100"
+// @Success 200 {object} map[string]interface{} "AI回答列表"
+// @Failure 400 {object} map[string]interface{} "请求参数错误"
+// @Failure 401 {object} map[string]interface{} "未授权"
+// @Failure 500 {object} map[string]interface{} "服务器内部错误"
+// @Router /api/ai/results [get]
+func (h *AIResultHandler) ListResults(c *gin.Context) {
+	// 从上下文获取用户ID
+	userID, exists := c.Get("userID")
+	if !exists {
+		utils.UnauthorizedResponse(c, "未授权的请求")
+		return
+	}
+
+	conversationID, err := strconv.ParseUint(c.DefaultQuery("conversation_id", "0"), 10, 64)
+	if err != nil {
+		utils.BadRequestResponse(c, "无效的会话ID")
+		return
+	}
+	beforeID, err := strconv.ParseUint(c.DefaultQuery("before_id", "0"), 10, 64)
+	if err != nil {
+		utils.BadRequestResponse(c, "无效的before_id")
+		return
+	}
+	limit, err := strconv.Atoi(c.DefaultQuery("limit", strconv.Itoa(defaultAIResultLimit)))
+	if err != nil || limit <= 0 {
+		utils.BadRequestResponse(c, "无效的limit")
+		return
+	}
+	limit = min(limit, maxAIResultLimit)
+
+	results, err := h.resultService.List(userID.(uint), uint(conversationID), uint(beforeID), limit)
+	if err != nil {
+		utils.Errorf("查询AI回答历史失败: %v", err)
+		utils.InternalServerErrorResponse(c, "查询AI回答历史失败")
+		return
+	}
+
+	utils.SuccessResponse(c, gin.H{
+		"results": results,
+	})
+}
+
+// GetResult 按提问消息ID查询AI回答
+// @Summary 查询AI回答
+// @Description 按提问消息ID返回AI回答及其提问消息
+// @Tags ai
+// @Produce json
+// @Security ApiKeyAuth
+// @Param message_id path int true "提问消息ID"
+// @Success 200 {object} map[string]interface{} "AI回答"
+// @Failure 400 {object} map[string]interface{} "请求参数错误"
+// @Failure 401 {object} map[string]interface{} "未授权"
+// @Failure 404 {object} map[string]interface{} "AI回答不存在"
+// @Router /api/ai/results/{message_id} [get]
+func (h *AIResultHandler) GetResult(c *gin.Context) {
+	// 从上下文获取用户ID
+	userID, exists := c.Get("userID")
+	if !exists {
+		utils.UnauthorizedResponse(c, "未授权的请求")
+		return
+	}
+
+	messageID, err := strconv.ParseUint(c.Param("message_id"), 10, 64)
+	if err != nil {
+		utils.BadRequestResponse(c, "无效的消息ID")
+		return
+	}
+
+	result, err := h.resultService.Get(userID.(uint), uint(messageID))
+	if errors.Is(err, services.ErrAIResultNotFound) {
+		utils.ErrorResponse(c, http.StatusNotFound, err.Error())
+		return
+	}
+	if err != nil {
+		utils.Errorf("查询AI回答失败: %v", err)
+		utils.InternalServerErrorResponse(c, "查询AI回答失败")
+		return
+	}
+
+	utils.SuccessResponse(c, gin.H{
+		"result":  result,
+		"message": result.Message,
+	})
+}
+
+// ResendResult 将AI回答转发给其他设备
+// @Summary 转发AI回答
+// @Description 将AI回答作为新的文本消息通过WebSocket转发给指定设备，默认仅投递给手机端设备
+// @Tags ai
+// @Accept json
+// @Produce json
+// @Security ApiKeyAuth
+// @Param message_id path int true "提问消息ID"
+// @Param request body ResendAIResultRequest false "投递目标"
+// @Success 200 {object} map[string]interface{} "成功响应"
+// @Failure 400 {object} map[string]interface{} "请求参数错误"
+// @Failure 401 {object} map[string]interface{} "未授权"
+// @Failure 404 {object} map[string]interface{} "AI回答不存在"
+// @Router /api/ai/results/{message_id}/resend [post]
+func (h *AIResultHandler) ResendResult(c *gin.Context) {
+	var req ResendAIResultRequest
+
+	// 绑定请求参数，请求体可以为空
+	if c.Request.ContentLength > 0 {
+		if err := c.ShouldBindJSON(&req); err != nil {
+			utils.Errorf("绑定转发AI回答请求失败: %v", err)
+			utils.BadRequestResponse(c, "请求参数错误")
+			return
+		}
+	}
+
+	// 从上下文获取用户ID
+	userID, exists := c.Get("userID")
+	if !exists {
+		utils.UnauthorizedResponse(c, "未授权的请求")
+		return
+	}
+
+	messageID, err := strconv.ParseUint(c.Param("message_id"), 10, 64)
+	if err != nil {
+		utils.BadRequestResponse(c, "无效的消息ID")
+		return
+	}
+
+	// 校验投递目标
+	if req.Target == "" {
+		req.Target = models.MessageTargetPhone
+	}
+	if errMsg := validateMessageTarget(h.db, userID.(uint), req.Target, req.TargetDeviceID); errMsg != "" {
+		utils.BadRequestResponse(c, errMsg)
+		return
+	}
+	// 使用设备凭证认证时，以认证的设备作为发送设备
+	var senderDeviceID uint
+	if deviceID, ok := c.Get("deviceID"); ok {
+		senderDeviceID = deviceID.(uint)
+	}
+
+	message, err := h.resultService.Resend(userID.(uint), uint(messageID), senderDeviceID, req.Target, req.TargetDeviceID)
+	if errors.Is(err, services.ErrAIResultNotFound) {
+		utils.ErrorResponse(c, http.StatusNotFound, err.Error())
+		return
+	}
+	if err != nil {
+		utils.Errorf("转发AI回答失败: %v", err)
+		utils.InternalServerErrorResponse(c, "转发AI回答失败")
+		return
+	}
+
+	utils.Infof("用户 %d 转发AI回答，提问消息ID: %d, 新消息ID: %d", userID.(uint), messageID, message.ID)
+	utils.SuccessResponse(c, gin.H{"message": "消息发送成功", "message_id": message.ID})
+}
@@ -0,0 +1,79 @@
+package handlers
+
+import (
+	"strconv"
+	"time"
+
+	"phone-server/models"
+	"phone-server/services"
+	"phone-server/utils"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	// defaultAIUsageDays 查询AI用量时默认返回的天数
+	defaultAIUsageDays = 30
+	// maxAIUsageDays 查询AI用量时最多返回的天数
+	maxAIUsageDays = 366
+)
+
+// AIUsageHandler AI用量接口处理器
+type AIUsageHandler struct {
+	usageService *services.UsageService // AI用量服务
+}
+
+// NewAIUsageHandler 创建AI用量接口处理器实例
+func NewAIUsageHandler(usageService *services.UsageService) *AIUsageHandler {
+	return &AIUsageHandler{
+		usageService: usageService,
+	}
+}
+
+// GetUsage 查询当前用户的AI用量
+// @Summary 查询AI用量
+// @Description 返回当前用户今日和本月的token用量及配额，以及最近若干天每天每个模型的用量明细。上游未返回用量时按内容长度估算，估算的部分计入estimated_tokens
+// @Tags ai
+// @Produce json
+// @Security ApiKeyAuth
+// @Param days query int false "明细的天数，默认30，最多366"
+// @Success 200 {object} map[string]interface{} "AI用量"
+// @Failure 400 {object} map[string]interface{} "请求参数错误"
+// @Failure 401 {object} map[string]interface{} "未授权"
+// @Failure 500 {object} map[string]interface{} "服务器内部错误"
+// @Router /api/ai/usage [get]
+func (h *AIUsageHandler) GetUsage(c *gin.Context) {
+	// 从上下文获取用户ID
+	userID, exists := c.Get("userID")
+	if !exists {
+		utils.UnauthorizedResponse(c, "未授权的请求")
+		return
+	}
+
+	days, err := strconv.Atoi(c.DefaultQuery("days", strconv.Itoa(defaultAIUsageDays)))
+	if err != nil || days <= 0 {
+		utils.BadRequestResponse(c, "无效的days")
+		return
+	}
+	days = min(days, maxAIUsageDays)
+
+	today, month, err := h.usageService.Summary(userID.(uint))
+	if err != nil {
+		utils.Errorf("查询AI用量失败: %v", err)
+		utils.InternalServerErrorResponse(c, "查询AI用量失败")
+		return
+	}
+	since := time.Now().AddDate(0, 0, 1-days).Format(models.AIUsageDateFormat)
+	records, err := h.usageService.List(userID.(uint), since)
+	if err != nil {
+		utils.Errorf("查询AI用量明细失败: %v", err)
+		utils.InternalServerErrorResponse(c, "查询AI用量失败")
+		return
+	}
+
+	utils.SuccessResponse(c, gin.H{
+		"today":   today,
+		"month":   month,
+		"records": records,
+	})
+}
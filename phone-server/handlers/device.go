@@ -0,0 +1,402 @@
+package handlers
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"phone-server/models"
+	"phone-server/services"
+	"phone-server/utils"
+
+	"github.com/gin-gonic/gin"
+)
+
+// DeviceHandler 设备接口处理器
+type DeviceHandler struct {
+	deviceService  *services.DeviceService  // 设备在线状态服务
+	pairingService *services.PairingService // 设备配对服务
+}
+
+// CreatePairingRequest 申请配对码请求
+type CreatePairingRequest struct {
+	DeviceType string `json:"device_type" binding:"omitempty,oneof=pc phone"` // 申请配对的设备类型，默认为pc
+	ClientID   string `json:"client_id" binding:"max=64"`                     // 客户端设备标识，同一标识再次配对时复用原设备记录
+	Name       string `json:"name" binding:"max=50"`                          // 设备名称
+}
+
+// ClaimPairingRequest 认领配对码请求
+type ClaimPairingRequest struct {
+	Code string `json:"code" binding:"required"` // 配对码，可从二维码中解析
+	Name string `json:"name" binding:"max=50"`   // 设备名称，为空时使用PC端申请时提供的名称
+}
+
+// RenameDeviceRequest 修改设备名称请求
+type RenameDeviceRequest struct {
+	Name string `json:"name" binding:"required,max=50"` // 设备名称
+}
+
+// OnlineDevice 在线设备信息
+type OnlineDevice struct {
+	DeviceID        uint       `json:"device_id"`         // 设备ID
+	DeviceType      string     `json:"device_type"`       // 设备类型
+	ClientID        string     `json:"client_id"`         // 客户端上报的设备标识
+	IP              string     `json:"ip"`                // 客户端IP
+	ConnectedAt     *time.Time `json:"connected_at"`      // 上线时间
+	LastHeartbeatAt time.Time  `json:"last_heartbeat_at"` // 最后一次心跳时间
+}
+
+// NewDeviceHandler 创建设备接口处理器实例
+func NewDeviceHandler(deviceService *services.DeviceService, pairingService *services.PairingService) *DeviceHandler {
+	return &DeviceHandler{
+		deviceService:  deviceService,
+		pairingService: pairingService,
+	}
+}
+
+// GetDeviceStatus 获取当前用户各设备的在线状态
+// @Summary 获取设备在线状态
+// @Description 返回当前用户的设备列表及在线状态，PC端可在发送问题前确认手机是否可达
+// @Tags device
+// @Produce json
+// @Security ApiKeyAuth
+// @Param device_type query string false "设备类型（pc/phone）"
+// @Success 200 {object} map[string]interface{} "设备状态列表"
+// @Failure 401 {object} map[string]interface{} "未授权"
+// @Failure 500 {object} map[string]interface{} "服务器内部错误"
+// @Router /api/devices/status [get]
+func (h *DeviceHandler) GetDeviceStatus(c *gin.Context) {
+	// 从上下文获取用户ID
+	userID, exists := c.Get("userID")
+	if !exists {
+		utils.UnauthorizedResponse(c, "未授权的请求")
+		return
+	}
+
+	deviceType := c.Query("device_type")
+	if deviceType != "" && deviceType != models.DeviceTypePC && deviceType != models.DeviceTypePhone {
+		utils.BadRequestResponse(c, "无效的设备类型")
+		return
+	}
+
+	devices, err := h.deviceService.ListDevices(userID.(uint), deviceType)
+	if err != nil {
+		utils.Errorf("查询设备状态失败: %v", err)
+		utils.InternalServerErrorResponse(c, "查询设备状态失败")
+		return
+	}
+
+	// 判断是否有手机端设备在线
+	phoneOnline := false
+	for _, device := range devices {
+		if device.DeviceType == models.DeviceTypePhone && device.Status == models.DeviceStatusOnline {
+			phoneOnline = true
+			break
+		}
+	}
+
+	utils.SuccessResponse(c, gin.H{
+		"devices":      devices,
+		"phone_online": phoneOnline,
+	})
+}
+
+// GetOnlineDevices 获取当前用户在线的设备
+// @Summary 获取在线设备
+// @Description 返回当前用户所有已连接（WebSocket或SSE）的设备，包括设备类型、IP、上线时间和最后一次心跳时间（精度为30秒）
+// @Tags device
+// @Produce json
+// @Security ApiKeyAuth
+// @Success 200 {object} map[string]interface{} "在线设备列表"
+// @Failure 401 {object} map[string]interface{} "未授权"
+// @Failure 500 {object} map[string]interface{} "服务器内部错误"
+// @Router /api/devices/online [get]
+func (h *DeviceHandler) GetOnlineDevices(c *gin.Context) {
+	// 从上下文获取用户ID
+	userID, exists := c.Get("userID")
+	if !exists {
+		utils.UnauthorizedResponse(c, "未授权的请求")
+		return
+	}
+
+	devices, err := h.deviceService.ListOnlineDevices(userID.(uint))
+	if err != nil {
+		utils.Errorf("查询在线设备失败: %v", err)
+		utils.InternalServerErrorResponse(c, "查询在线设备失败")
+		return
+	}
+
+	online := make([]OnlineDevice, 0, len(devices))
+	for _, device := range devices {
+		online = append(online, OnlineDevice{
+			DeviceID:        device.ID,
+			DeviceType:      device.DeviceType,
+			ClientID:        device.ClientID,
+			IP:              device.LastIP,
+			ConnectedAt:     device.ConnectedAt,
+			LastHeartbeatAt: device.LastActiveAt,
+		})
+	}
+
+	utils.SuccessResponse(c, gin.H{
+		"devices": online,
+	})
+}
+
+// ListDevices 获取当前用户已注册的设备
+// @Summary 获取设备列表
+// @Description 返回当前用户所有未撤销的设备，包括设备名称、类型和在线状态
+// @Tags device
+// @Produce json
+// @Security ApiKeyAuth
+// @Success 200 {object} map[string]interface{} "设备列表"
+// @Failure 401 {object} map[string]interface{} "未授权"
+// @Failure 500 {object} map[string]interface{} "服务器内部错误"
+// @Router /api/devices [get]
+func (h *DeviceHandler) ListDevices(c *gin.Context) {
+	// 从上下文获取用户ID
+	userID, exists := c.Get("userID")
+	if !exists {
+		utils.UnauthorizedResponse(c, "未授权的请求")
+		return
+	}
+
+	devices, err := h.deviceService.ListDevices(userID.(uint), "")
+	if err != nil {
+		utils.Errorf("查询设备列表失败: %v", err)
+		utils.InternalServerErrorResponse(c, "查询设备列表失败")
+		return
+	}
+
+	utils.SuccessResponse(c, gin.H{
+		"devices": devices,
+	})
+}
+
+// RenameDevice 修改设备名称
+// @Summary 修改设备名称
+// @Description 修改当前用户指定设备的名称
+// @Tags device
+// @Accept json
+// @Produce json
+// @Security ApiKeyAuth
+// @Param id path int true "设备ID"
+// @Param request body RenameDeviceRequest true "设备名称"
+// @Success 200 {object} map[string]interface{} "修改后的设备"
+// @Failure 400 {object} map[string]interface{} "请求参数错误"
+// @Failure 401 {object} map[string]interface{} "未授权"
+// @Failure 403 {object} map[string]interface{} "设备凭证无权执行该操作"
+// @Failure 404 {object} map[string]interface{} "设备不存在"
+// @Router /api/devices/{id} [patch]
+func (h *DeviceHandler) RenameDevice(c *gin.Context) {
+	var req RenameDeviceRequest
+
+	// 绑定请求参数
+	if err := c.ShouldBindJSON(&req); err != nil {
+		utils.Errorf("绑定修改设备名称请求失败: %v", err)
+		utils.BadRequestResponse(c, "请求参数错误")
+		return
+	}
+
+	// 从上下文获取用户ID
+	userID, exists := c.Get("userID")
+	if !exists {
+		utils.UnauthorizedResponse(c, "未授权的请求")
+		return
+	}
+
+	deviceID, err := strconv.ParseUint(c.Param("id"), 10, 64)
+	if err != nil {
+		utils.BadRequestResponse(c, "无效的设备ID")
+		return
+	}
+
+	device, err := h.deviceService.RenameDevice(userID.(uint), uint(deviceID), strings.TrimSpace(req.Name))
+	if errors.Is(err, services.ErrDeviceNotFound) {
+		utils.ErrorResponse(c, http.StatusNotFound, err.Error())
+		return
+	}
+	if err != nil {
+		utils.Errorf("修改设备名称失败: %v", err)
+		utils.InternalServerErrorResponse(c, "修改设备名称失败")
+		return
+	}
+
+	utils.SuccessResponse(c, device)
+}
+
+// RevokeDevice 撤销设备
+// @Summary 撤销设备
+// @Description 作废设备凭证并禁止该设备再次连接，该设备当前的WebSocket和SSE连接会被立即断开（WebSocket关闭码1008）
+// @Tags device
+// @Produce json
+// @Security ApiKeyAuth
+// @Param id path int true "设备ID"
+// @Success 200 {object} map[string]interface{} "撤销成功"
+// @Failure 400 {object} map[string]interface{} "请求参数错误"
+// @Failure 401 {object} map[string]interface{} "未授权"
+// @Failure 403 {object} map[string]interface{} "设备凭证无权执行该操作"
+// @Failure 404 {object} map[string]interface{} "设备不存在"
+// @Router /api/devices/{id} [delete]
+func (h *DeviceHandler) RevokeDevice(c *gin.Context) {
+	// 从上下文获取用户ID
+	userID, exists := c.Get("userID")
+	if !exists {
+		utils.UnauthorizedResponse(c, "未授权的请求")
+		return
+	}
+
+	deviceID, err := strconv.ParseUint(c.Param("id"), 10, 64)
+	if err != nil {
+		utils.BadRequestResponse(c, "无效的设备ID")
+		return
+	}
+
+	err = h.deviceService.RevokeDevice(userID.(uint), uint(deviceID))
+	if errors.Is(err, services.ErrDeviceNotFound) {
+		utils.ErrorResponse(c, http.StatusNotFound, err.Error())
+		return
+	}
+	if err != nil {
+		utils.Errorf("撤销设备失败: %v", err)
+		utils.InternalServerErrorResponse(c, "撤销设备失败")
+		return
+	}
+
+	utils.SuccessResponse(c, gin.H{
+		"device_id": deviceID,
+		"revoked":   true,
+	})
+}
+
+// CreatePairing 新设备申请配对码
+// @Summary 申请配对码
+// @Description 新设备（默认为PC端）申请一个短时有效的配对码，qr_payload可直接渲染为二维码供已登录的手机端扫描。申请方使用pairing_secret轮询配对结果，认领后获得设备凭证
+// @Tags pairing
+// @Accept json
+// @Produce json
+// @Param request body CreatePairingRequest false "设备信息"
+// @Success 200 {object} map[string]interface{} "配对码"
+// @Failure 400 {object} map[string]interface{} "请求参数错误"
+// @Failure 500 {object} map[string]interface{} "服务器内部错误"
+// @Router /api/pairing [post]
+func (h *DeviceHandler) CreatePairing(c *gin.Context) {
+	var req CreatePairingRequest
+
+	// 绑定请求参数，请求体可以为空
+	if c.Request.ContentLength > 0 {
+		if err := c.ShouldBindJSON(&req); err != nil {
+			utils.Errorf("绑定申请配对码请求失败: %v", err)
+			utils.BadRequestResponse(c, "请求参数错误")
+			return
+		}
+	}
+
+	deviceType := req.DeviceType
+	if deviceType == "" {
+		deviceType = models.DeviceTypePC
+	}
+	pairing, secret, err := h.pairingService.CreatePairing(deviceType, req.ClientID, strings.TrimSpace(req.Name))
+	if err != nil {
+		utils.Errorf("申请配对码失败: %v", err)
+		utils.InternalServerErrorResponse(c, "申请配对码失败")
+		return
+	}
+
+	utils.SuccessResponse(c, gin.H{
+		"code":           pairing.Code,
+		"pairing_secret": secret,
+		"qr_payload":     fmt.Sprintf(services.PairingQRScheme, pairing.Code),
+		"expires_at":     pairing.ExpiresAt,
+	})
+}
+
+// GetPairingResult PC端查询配对结果
+// @Summary 查询配对结果
+// @Description 申请方使用申请配对码时返回的pairing_secret轮询配对结果。认领后的第一次查询签发并返回设备凭证（dt_前缀），凭证只返回一次，之后可代替JWT用于Authorization头或/ws、/api/events的token参数
+// @Tags pairing
+// @Produce json
+// @Param code path string true "配对码"
+// @Param secret query string true "申请配对码时返回的pairing_secret"
+// @Success 200 {object} services.PairingResult "配对结果"
+// @Failure 400 {object} map[string]interface{} "请求参数错误"
+// @Failure 403 {object} map[string]interface{} "设备已被撤销"
+// @Failure 404 {object} map[string]interface{} "配对码不存在或已过期"
+// @Router /api/pairing/{code} [get]
+func (h *DeviceHandler) GetPairingResult(c *gin.Context) {
+	secret := c.Query("secret")
+	if secret == "" {
+		utils.BadRequestResponse(c, "缺少secret参数")
+		return
+	}
+
+	result, err := h.pairingService.GetPairingResult(strings.ToUpper(c.Param("code")), secret)
+	if errors.Is(err, services.ErrPairingNotFound) {
+		utils.ErrorResponse(c, http.StatusNotFound, err.Error())
+		return
+	}
+	if errors.Is(err, services.ErrDeviceRevoked) {
+		utils.ErrorResponse(c, http.StatusForbidden, err.Error())
+		return
+	}
+	if err != nil {
+		utils.Errorf("查询配对结果失败: %v", err)
+		utils.InternalServerErrorResponse(c, "查询配对结果失败")
+		return
+	}
+
+	utils.SuccessResponse(c, result)
+}
+
+// ClaimPairing 手机端认领配对码
+// @Summary 认领配对码
+// @Description 已登录的手机端输入或扫码获得配对码后认领，服务端为申请方注册设备，设备凭证在申请方查询配对结果时签发
+// @Tags pairing
+// @Accept json
+// @Produce json
+// @Security ApiKeyAuth
+// @Param request body ClaimPairingRequest true "配对码"
+// @Success 200 {object} map[string]interface{} "已注册的设备"
+// @Failure 400 {object} map[string]interface{} "请求参数错误"
+// @Failure 401 {object} map[string]interface{} "未授权"
+// @Failure 403 {object} map[string]interface{} "设备凭证无权执行该操作"
+// @Failure 404 {object} map[string]interface{} "配对码不存在或已过期"
+// @Failure 409 {object} map[string]interface{} "配对码已被认领"
+// @Router /api/devices/pair [post]
+func (h *DeviceHandler) ClaimPairing(c *gin.Context) {
+	var req ClaimPairingRequest
+
+	// 绑定请求参数
+	if err := c.ShouldBindJSON(&req); err != nil {
+		utils.Errorf("绑定认领配对码请求失败: %v", err)
+		utils.BadRequestResponse(c, "请求参数错误")
+		return
+	}
+
+	// 从上下文获取用户ID
+	userID, exists := c.Get("userID")
+	if !exists {
+		utils.UnauthorizedResponse(c, "未授权的请求")
+		return
+	}
+
+	code := strings.ToUpper(strings.TrimSpace(req.Code))
+	device, err := h.pairingService.ClaimPairing(userID.(uint), code, strings.TrimSpace(req.Name))
+	switch {
+	case errors.Is(err, services.ErrPairingNotFound):
+		utils.ErrorResponse(c, http.StatusNotFound, err.Error())
+		return
+	case errors.Is(err, services.ErrPairingClaimed):
+		utils.ErrorResponse(c, http.StatusConflict, err.Error())
+		return
+	case err != nil:
+		utils.Errorf("认领配对码失败: %v", err)
+		utils.InternalServerErrorResponse(c, "认领配对码失败")
+		return
+	}
+
+	utils.SuccessResponse(c, device)
+}
@@ -0,0 +1,161 @@
+package handlers
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"phone-server/configs"
+	"phone-server/models"
+	"phone-server/services"
+	"phone-server/utils"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+// sseRetryInterval 建议客户端断线后重连的间隔（毫秒）
+const sseRetryInterval = 3000
+
+// EventsHandler SSE事件流处理器，为无法使用WebSocket的客户端提供广播消息的只读推送
+type EventsHandler struct {
+	broker        services.Broker         // 消息广播服务
+	db            *gorm.DB                // 数据库连接
+	deviceService *services.DeviceService // 设备在线状态服务
+	jwtSecret     string                  // JWT密钥
+	replayLimit   int                     // 断线重连时每批查询和重放的离线消息条数
+	pingInterval  time.Duration           // 保活注释的发送间隔
+}
+
+// NewEventsHandler 创建SSE事件流处理器实例
+func NewEventsHandler(broker services.Broker, db *gorm.DB, deviceService *services.DeviceService, jwtSecret string, wsConfig configs.WebSocketConfig) *EventsHandler {
+	return &EventsHandler{
+		broker:        broker,
+		db:            db,
+		deviceService: deviceService,
+		jwtSecret:     jwtSecret,
+		replayLimit:   wsConfig.ReplayLimit,
+		pingInterval:  time.Duration(wsConfig.PingInterval) * time.Second,
+	}
+}
+
+// HandleEvents 以SSE方式推送广播消息
+// @Summary 订阅广播消息（SSE）
+// @Description 与WebSocket客户端订阅同一广播，每个事件的data为当前协议的封装帧；消息事件带有id，可通过Last-Event-ID断线续传。发送消息仍使用REST接口
+// @Tags events
+// @Produce text/event-stream
+// @Param token query string false "JWT令牌或设备凭证（EventSource无法设置请求头时使用）"
+// @Param Authorization header string false "JWT令牌或设备凭证"
+// @Param device_type query string false "设备类型（pc/phone），默认为pc，使用设备凭证时忽略"
+// @Param device_id query string false "客户端设备标识，使用设备凭证时忽略"
+// @Param Last-Event-ID header string false "最后收到的消息ID"
+// @Param last_event_id query string false "最后收到的消息ID（无法设置请求头时使用）"
+// @Success 200 {string} string "事件流"
+// @Failure 400 {object} map[string]interface{} "参数错误"
+// @Failure 401 {object} map[string]interface{} "未授权"
+// @Router /api/events [get]
+func (h *EventsHandler) HandleEvents(c *gin.Context) {
+	clientIP := c.ClientIP()
+
+	// 认证并确定连接所属的设备，EventSource无法设置请求头，因此也支持查询参数传递Token
+	device, status, errMsg := authenticateConnection(c, h.deviceService, h.jwtSecret, models.DeviceTypePC)
+	if device == nil {
+		utils.Warnfc(c.Request.Context(), "[SSE] 连接认证失败: %s, 客户端IP: %s", errMsg, clientIP)
+		utils.ErrorResponse(c, status, errMsg)
+		return
+	}
+
+	// 获取断线续传游标，浏览器自动重连时会携带Last-Event-ID头
+	lastEventID := c.GetHeader("Last-Event-ID")
+	if lastEventID == "" {
+		lastEventID = c.Query("last_event_id")
+	}
+	var err error
+	var lastMessageID uint64
+	if lastEventID != "" {
+		if lastMessageID, err = strconv.ParseUint(lastEventID, 10, 64); err != nil {
+			utils.BadRequestResponse(c, "无效的Last-Event-ID")
+			return
+		}
+	}
+	resume := lastMessageID > 0
+
+	// 标记设备在线
+	if err := h.deviceService.Connect(device, clientIP); err != nil {
+		utils.Errorfc(c.Request.Context(), "[SSE] 更新设备在线状态失败: %v, 用户ID: %d, 客户端IP: %s", err, device.UserID, clientIP)
+		utils.InternalServerErrorResponse(c, "更新设备在线状态失败")
+		return
+	}
+	defer h.deviceService.Disconnect(device.ID)
+
+	// 订阅消息广播服务，与WebSocket客户端共用同一广播
+	client := h.broker.Subscribe(device, clientIP, models.ProtocolVersion, resume)
+	defer h.broker.UnregisterClient(client)
+	utils.Infofc(c.Request.Context(), "[SSE] 事件流已订阅，用户ID: %d, 设备ID: %d, 客户端IP: %s", device.UserID, device.ID, clientIP)
+
+	// 设置SSE响应头
+	c.Header("Content-Type", "text/event-stream")
+	c.Header("Cache-Control", "no-cache")
+	c.Header("Connection", "keep-alive")
+	c.Header("X-Accel-Buffering", "no")
+	c.Status(http.StatusOK)
+	fmt.Fprintf(c.Writer, "retry: %d\n\n", sseRetryInterval)
+	c.Writer.Flush()
+
+	// 发送握手帧
+	client.SendFrame(models.FrameHello, "", 0, models.HelloPayload{
+		ProtocolVersion: models.ProtocolVersion,
+		DeviceID:        device.ID,
+		DeviceType:      device.DeviceType,
+	}, nil)
+
+	// 重放离线期间错过的消息，完成后切换为实时推送
+	// 重放等待发送队列，而发送队列由下面的循环消费，因此在单独的协程中重放
+	if resume {
+		ctx := c.Request.Context()
+		go func() {
+			replayed, err := replayMissedMessages(h.db, client, device, uint(lastMessageID), time.Time{}, h.replayLimit)
+			if err != nil {
+				utils.Errorfc(ctx, "[SSE] 重放离线消息失败: %v, 用户ID: %d, 客户端IP: %s", err, device.UserID, clientIP)
+				client.Close()
+				return
+			}
+			utils.Infofc(ctx, "[SSE] 已重放 %d 条离线消息，用户ID: %d, 客户端IP: %s", replayed, device.UserID, clientIP)
+		}()
+	}
+
+	ticker := time.NewTicker(h.pingInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case frame := <-client.Frames():
+			if frame.MessageID != 0 {
+				fmt.Fprintf(c.Writer, "id: %d\n", frame.MessageID)
+			}
+			if _, err := fmt.Fprintf(c.Writer, "data: %s\n\n", frame.Data); err != nil {
+				utils.Errorf("[SSE] 发送事件失败: %v, 用户ID: %d, 客户端IP: %s", err, device.UserID, clientIP)
+				return
+			}
+			c.Writer.Flush()
+			client.MarkSent()
+
+		case <-ticker.C:
+			// 发送保活注释，防止代理因空闲断开连接
+			if _, err := fmt.Fprint(c.Writer, ": ping\n\n"); err != nil {
+				return
+			}
+			c.Writer.Flush()
+			h.deviceService.Touch(device.ID)
+
+		case <-client.Done():
+			utils.Infof("[SSE] 事件流被服务端关闭，用户ID: %d, 客户端IP: %s", device.UserID, clientIP)
+			return
+
+		case <-c.Request.Context().Done():
+			utils.Infof("[SSE] 事件流连接关闭，用户ID: %d, 设备ID: %d, 客户端IP: %s", device.UserID, device.ID, clientIP)
+			return
+		}
+	}
+}
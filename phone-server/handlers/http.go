@@ -2,9 +2,11 @@ package handlers
 
 import (
 	"encoding/base64"
+	"errors"
 	"fmt"
 	"io"
 	"net/http"
+	"strconv"
 	"strings"
 
 	"phone-server/models"
@@ -17,34 +19,74 @@ import (
 
 // HTTPHandler HTTP接口处理器
 type HTTPHandler struct {
-	broker    *services.Broker    // 消息广播服务
-	db        *gorm.DB            // 数据库连接
-	aiService *services.AIService // AI服务
+	broker              services.Broker               // 消息广播服务
+	db                  *gorm.DB                      // 数据库连接
+	conversationService *services.ConversationService // AI会话服务
+	receiptService      *services.ReceiptService      // 消息回执服务
 }
 
 // SendTextMessageRequest 发送文本消息请求参数
 type SendTextMessageRequest struct {
-	Content string `json:"content" binding:"required"`
+	Content        string `json:"content" binding:"required"`
+	Target         string `json:"target"`           // 投递目标：all/others/pc/phone/device，默认为phone
+	TargetDeviceID uint   `json:"target_device_id"` // Target为device时的目标设备ID
+	SenderDeviceID uint   `json:"sender_device_id"` // 发送方PC设备ID，Target为others时排除该设备
 }
 
 // ChatWithAIRequest 与AI聊天请求参数
 type ChatWithAIRequest struct {
-	Type    string `json:"type" binding:"required,oneof=text image"`
-	Content string `json:"content" binding:"required"`
+	Type           string   `json:"type" binding:"required,oneof=text image"`
+	Content        string   `json:"content" binding:"required_if=Type text"`                  // 文本内容；type为image时为图片base64或data URL，可以与images一起使用
+	Images         []string `json:"images"`                                                   // 图片base64或data URL，仅type为image时有效
+	Prompt         string   `json:"prompt"`                                                   // 对图片的提问，仅type为image时有效，为空时使用配置的默认提示词
+	ConversationID uint     `json:"conversation_id"`                                          // 继续的会话ID，为空时创建新会话
+	Thinking       string   `json:"thinking" binding:"omitempty,oneof=enabled disabled auto"` // 思考模式，为空时使用配置的思考模式
+	Model          string   `json:"model"`                                                    // 模型名称，为空时使用默认模型
 }
 
 // NewHTTPHandler 创建HTTP接口处理器实例
-func NewHTTPHandler(broker *services.Broker, db *gorm.DB, aiService *services.AIService) *HTTPHandler {
+func NewHTTPHandler(broker services.Broker, db *gorm.DB, conversationService *services.ConversationService, receiptService *services.ReceiptService) *HTTPHandler {
 	return &HTTPHandler{
-		broker:    broker,
-		db:        db,
-		aiService: aiService,
+		broker:              broker,
+		db:                  db,
+		conversationService: conversationService,
+		receiptService:      receiptService,
 	}
 }
 
+// validateMessageTarget 校验投递目标及相关设备是否属于该用户，返回错误信息，校验通过时返回空字符串
+func validateMessageTarget(db *gorm.DB, userID uint, target string, targetDeviceID uint) string {
+	if !models.IsValidMessageTarget(target) {
+		return "无效的投递目标"
+	}
+	if target != models.MessageTargetDevice {
+		return ""
+	}
+	if targetDeviceID == 0 {
+		return "缺少目标设备ID"
+	}
+	var count int64
+	if err := db.Model(&models.Device{}).Where("id = ? AND user_id = ? AND revoked_at IS NULL", targetDeviceID, userID).Count(&count).Error; err != nil || count == 0 {
+		return "目标设备不存在"
+	}
+	return ""
+}
+
+// validateSenderDevice 校验发送设备是否为该用户的PC端设备
+func validateSenderDevice(db *gorm.DB, userID uint, senderDeviceID uint) bool {
+	if senderDeviceID == 0 {
+		return true
+	}
+	var count int64
+	err := db.Model(&models.Device{}).
+		Where("id = ? AND user_id = ? AND device_type = ? AND revoked_at IS NULL", senderDeviceID, userID, models.DeviceTypePC).
+		Count(&count).Error
+	return err == nil && count > 0
+}
+
 // SendTextMessage 处理发送文本消息的HTTP请求
 // @Summary 发送文本消息
-// @Description 接收文本消息并通过WebSocket转发给客户端
+// @Description 接收文本消息并通过WebSocket转发给客户端，默认仅投递给手机端设备
 // @Tags message
 // @Accept json
 // @Produce json
@@ -71,8 +113,26 @@ func (h *HTTPHandler) SendTextMessage(c *gin.Context) {
 		return
 	}
 
+	// 校验投递目标
+	if req.Target == "" {
+		req.Target = models.MessageTargetPhone
+	}
+	if errMsg := validateMessageTarget(h.db, userID.(uint), req.Target, req.TargetDeviceID); errMsg != "" {
+		utils.BadRequestResponse(c, errMsg)
+		return
+	}
+	// 使用设备凭证认证时，未指定发送设备则以认证的设备作为发送设备
+	if deviceID, ok := c.Get("deviceID"); ok && req.SenderDeviceID == 0 {
+		req.SenderDeviceID = deviceID.(uint)
+	}
+	if !validateSenderDevice(h.db, userID.(uint), req.SenderDeviceID) {
+		utils.BadRequestResponse(c, "发送设备不存在")
+		return
+	}
+
 	// 创建文本消息
-	message := models.NewTextMessage(userID.(uint), req.Content, models.SenderTypePC)
+	message := models.NewTextMessage(userID.(uint), req.Content, models.SenderTypePC).
+		RouteTo(req.SenderDeviceID, req.Target, req.TargetDeviceID)
 
 	// 将消息存储到数据库
 	if result := h.db.Create(message); result.Error != nil {
@@ -87,17 +147,20 @@ func (h *HTTPHandler) SendTextMessage(c *gin.Context) {
 	utils.Infof("用户 %d 发送文本消息: %s", userID.(uint), req.Content)
 
 	// 返回成功响应
-	utils.SuccessResponse(c, gin.H{"message": "消息发送成功"})
+	utils.SuccessResponse(c, gin.H{"message": "消息发送成功", "message_id": message.ID})
 }
 
 // SendImageMessage 处理发送图片消息的HTTP请求
 // @Summary 发送图片消息
-// @Description 接收图片文件并通过WebSocket转发给客户端
+// @Description 接收图片文件并通过WebSocket转发给客户端，默认仅投递给手机端设备
 // @Tags message
 // @Accept multipart/form-data
 // @Produce json
 // @Security ApiKeyAuth
 // @Param image formData file true "图片文件"
+// @Param target formData string false "投递目标：all/others/pc/phone/device，默认为phone"
+// @Param target_device_id formData int false "Target为device时的目标设备ID"
+// @Param sender_device_id formData int false "发送方PC设备ID，Target为others时排除该设备"
 // @Success 200 {object} map[string]interface{} "成功响应"
 // @Failure 400 {object} map[string]interface{} "请求参数错误"
 // @Failure 401 {object} map[string]interface{} "未授权"
@@ -130,13 +193,30 @@ func (h *HTTPHandler) SendImageMessage(c *gin.Context) {
 		return
 	}
 
+	// 校验投递目标
+	target := c.DefaultPostForm("target", models.MessageTargetPhone)
+	targetDeviceID, _ := strconv.ParseUint(c.PostForm("target_device_id"), 10, 64)
+	senderDeviceID, _ := strconv.ParseUint(c.PostForm("sender_device_id"), 10, 64)
+	if deviceID, ok := c.Get("deviceID"); ok && senderDeviceID == 0 {
+		senderDeviceID = uint64(deviceID.(uint))
+	}
+	if errMsg := validateMessageTarget(h.db, userID.(uint), target, uint(targetDeviceID)); errMsg != "" {
+		utils.BadRequestResponse(c, errMsg)
+		return
+	}
+	if !validateSenderDevice(h.db, userID.(uint), uint(senderDeviceID)) {
+		utils.BadRequestResponse(c, "发送设备不存在")
+		return
+	}
+
 	// 将图片内容转换为base64编码
 	base64Content := base64.StdEncoding.EncodeToString(fileContent)
 	// 添加base64前缀，使其符合Data URL格式
 	base64Content = "data:image/jpeg;base64," + base64Content
 
 	// 创建图片消息
-	message := models.NewImageMessage(userID.(uint), base64Content, models.SenderTypePC)
+	message := models.NewImageMessage(userID.(uint), base64Content, models.SenderTypePC).
+		RouteTo(uint(senderDeviceID), target, uint(targetDeviceID))
 
 	// 将消息存储到数据库
 	if result := h.db.Create(message); result.Error != nil {
@@ -151,27 +231,125 @@ func (h *HTTPHandler) SendImageMessage(c *gin.Context) {
 	utils.Infof("用户 %d 发送图片消息，大小: %d bytes", userID.(uint), len(fileContent))
 
 	// 返回成功响应
-	utils.SuccessResponse(c, gin.H{"message": "图片发送成功"})
+	utils.SuccessResponse(c, gin.H{"message": "图片发送成功", "message_id": message.ID})
+}
+
+// GetMessageReceipts 查询消息在各设备上的送达和已读状态
+// @Summary 查询消息回执
+// @Description 返回消息在各设备上的送达和已读状态，状态变更也会通过WebSocket以receipt事件推送
+// @Tags message
+// @Produce json
+// @Security ApiKeyAuth
+// @Param id path int true "消息ID"
+// @Success 200 {object} map[string]interface{} "回执列表"
+// @Failure 400 {object} map[string]interface{} "请求参数错误"
+// @Failure 401 {object} map[string]interface{} "未授权"
+// @Failure 500 {object} map[string]interface{} "服务器内部错误"
+// @Router /api/message/{id}/receipts [get]
+func (h *HTTPHandler) GetMessageReceipts(c *gin.Context) {
+	// 从上下文获取用户ID
+	userID, exists := c.Get("userID")
+	if !exists {
+		utils.UnauthorizedResponse(c, "未授权的请求")
+		return
+	}
+
+	messageID, err := strconv.ParseUint(c.Param("id"), 10, 64)
+	if err != nil {
+		utils.BadRequestResponse(c, "无效的消息ID")
+		return
+	}
+
+	receipts, err := h.receiptService.GetReceipts(userID.(uint), uint(messageID))
+	if err != nil {
+		utils.Errorf("查询消息回执失败: %v", err)
+		utils.InternalServerErrorResponse(c, "查询消息回执失败")
+		return
+	}
+
+	// 统计送达和已读设备数
+	deliveredCount, readCount := 0, 0
+	for _, receipt := range receipts {
+		deliveredCount++
+		if receipt.Status == models.ReceiptStatusRead {
+			readCount++
+		}
+	}
+
+	utils.SuccessResponse(c, gin.H{
+		"message_id":      messageID,
+		"receipts":        receipts,
+		"delivered_count": deliveredCount,
+		"read_count":      readCount,
+	})
+}
+
+// SSE模式下的事件类型，回答片段使用默认的message事件
+const (
+	// sseEventReasoning 思考过程片段
+	sseEventReasoning = "reasoning"
+	// sseEventQueued 排队位置，数据为{"position": 排队位置}
+	sseEventQueued = "queued"
+)
+
+// writeSSEEvent 发送一个SSE事件，多行内容拆分为多个data行，event为空时使用默认事件类型
+func writeSSEEvent(c *gin.Context, event string, data string) error {
+	var buf strings.Builder
+	if event != "" {
+		fmt.Fprintf(&buf, "event: %s\n", event)
+	}
+	for _, line := range strings.Split(data, "\n") {
+		fmt.Fprintf(&buf, "data: %s\n", line)
+	}
+	buf.WriteString("\n")
+	if _, err := c.Writer.WriteString(buf.String()); err != nil {
+		return err
+	}
+	c.Writer.Flush()
+	return nil
+}
+
+// imageParts 将图片base64或data URL转换为图片片段，跳过空内容，带data URL前缀时保留其中的图片类型
+func imageParts(contents []string) []services.ChatPart {
+	var parts []services.ChatPart
+	for _, content := range contents {
+		switch {
+		case content == "":
+			continue
+		case strings.HasPrefix(content, "data:image/"):
+			parts = append(parts, services.ImageURLPart(content))
+		default:
+			parts = append(parts, services.ImagePart("", content))
+		}
+	}
+	return parts
 }
 
 // ChatWithAI 处理与AI聊天的HTTP请求
 // @Summary 与AI聊天
-// @Description 接收文本或图片，获取AI回复（支持普通HTTP和SSE流式输出）
+// @Description 接收文本或图片，获取AI回复（支持普通HTTP和SSE流式输出）。携带conversation_id时继续该会话，之前的轮次会一并发送给AI；未携带时创建新会话，会话ID在响应的conversation_id字段（SSE模式下为X-Conversation-ID响应头）中返回。
+// @Description 思考过程在SSE模式下以reasoning事件发送，普通模式下在reasoning字段中返回；thinking可覆盖配置的思考模式
+// @Description model可指定模型目录（GET /api/ai/models）中的模型，未指定时使用默认模型；模型不支持图片或思考模式时返回400
+// @Description AI服务繁忙需要排队时，SSE模式下以queued事件发送排队位置；普通模式的请求排在流式请求之后
 // @Tags ai
 // @Accept json
 // @Produce json
 // @Produce text/event-stream
 // @Security ApiKeyAuth
-// @Param request body ChatWithAIRequest true "聊天请求" SchemaExample({"type": "text", "content": "你好"})
+// @Description 图片聊天可以在content或images中携带一张或多张图片，prompt为对图片的提问，未携带时使用配置的默认提示词
+// @Param request body ChatWithAIRequest true "聊天请求" SchemaExample({"type": "image", "images": ["<base64>"], "prompt": "翻译图片中的文字"})
 // @Success 200 {object} map[string]interface{} "AI回复"
 // @Success 200 {string} text/event-stream "AI回复流"
-// @Failure 400 {object} map[string]interface{} "请求参数错误"
+// @Failure 400 {object} map[string]interface{} "请求参数错误或模型不支持"
 // @Failure 401 {object} map[string]interface{} "未授权"
+// @Failure 404 {object} map[string]interface{} "会话不存在"
+// @Failure 429 {object} map[string]interface{} "AI用量超出配额"
 // @Failure 500 {object} map[string]interface{} "服务器内部错误"
+// @Failure 503 {object} map[string]interface{} "排队人数已满"
 // @Router /api/ai/chat [post]
 func (h *HTTPHandler) ChatWithAI(c *gin.Context) {
 	// 从上下文获取用户ID
-	_, exists := c.Get("userID")
+	userID, exists := c.Get("userID")
 	if !exists {
 		utils.UnauthorizedResponse(c, "未授权的请求")
 		return
@@ -189,6 +367,55 @@ func (h *HTTPHandler) ChatWithAI(c *gin.Context) {
 	// 创建上下文
 	ctx := c.Request.Context()
 
+	// 构建对话消息
+	var message services.ChatMessage
+	switch req.Type {
+	case "text":
+		// 文本聊天
+		message = services.NewChatMessage(services.ChatRoleUser, services.TextPart(req.Content))
+	case "image":
+		// 图片聊天，content和images中的图片按顺序发送
+		images := imageParts(append([]string{req.Content}, req.Images...))
+		if len(images) == 0 {
+			utils.BadRequestResponse(c, "缺少图片内容")
+			return
+		}
+		var err error
+		if message, err = h.conversationService.ImageMessage(req.Prompt, images); err != nil {
+			utils.BadRequestResponse(c, err.Error())
+			return
+		}
+	}
+
+	options := services.ChatOptions{Model: req.Model, Thinking: req.Thinking}
+
+	// 使用设备凭证认证时，以认证的设备作为提问设备
+	var senderDeviceID uint
+	if deviceID, ok := c.Get("deviceID"); ok {
+		senderDeviceID = deviceID.(uint)
+	}
+
+	// 打开会话
+	conversation, err := h.conversationService.Open(userID.(uint), req.ConversationID, message, options)
+	if errors.Is(err, services.ErrUnsupportedModel) {
+		utils.BadRequestResponse(c, err.Error())
+		return
+	}
+	if errors.Is(err, services.ErrConversationNotFound) {
+		utils.ErrorResponse(c, http.StatusNotFound, err.Error())
+		return
+	}
+	if errors.Is(err, services.ErrQuotaExceeded) {
+		utils.Warnf("用户 %d 的AI用量超出配额: %v", userID.(uint), err)
+		utils.ErrorResponse(c, http.StatusTooManyRequests, err.Error())
+		return
+	}
+	if err != nil {
+		utils.Errorf("打开会话失败: %v", err)
+		utils.InternalServerErrorResponse(c, "打开会话失败")
+		return
+	}
+
 	// 检查是否支持SSE流式响应
 	acceptHeader := c.GetHeader("Accept")
 	supportsSSE := strings.Contains(acceptHeader, "text/event-stream")
@@ -201,75 +428,73 @@ func (h *HTTPHandler) ChatWithAI(c *gin.Context) {
 		c.Header("Connection", "keep-alive")
 		c.Header("Transfer-Encoding", "chunked")
 		c.Header("Access-Control-Allow-Origin", "*")
+		c.Header("X-Conversation-ID", strconv.FormatUint(uint64(conversation.ID), 10))
 
 		// 定义流式响应回调函数
-		streamCallback := func(chunk string) error {
-			// 发送SSE格式的响应
-			if _, err := c.Writer.WriteString(fmt.Sprintf("data: %s\n\n", chunk)); err != nil {
+		streamCallback := func(chunk services.StreamChunk) error {
+			// 发送SSE格式的响应，思考过程以reasoning事件单独发送
+			event := ""
+			if chunk.Type == services.ChunkReasoning {
+				event = sseEventReasoning
+			}
+			if err := writeSSEEvent(c, event, chunk.Text); err != nil {
 				utils.Errorf("发送AI流式响应失败: %v", err)
 				return err
 			}
-			c.Writer.Flush()
 			return nil
 		}
 
-		// 调用AI服务
-		var err error
-		switch req.Type {
-		case "text":
-			// 文本聊天
-			err = h.aiService.ChatWithText(ctx, req.Content, streamCallback)
-		case "image":
-			// 图片聊天
-			// 提取base64内容（去掉前缀）
-			base64Content := req.Content
-			if strings.HasPrefix(base64Content, "data:image/") {
-				// 去掉前缀
-				base64Content = base64Content[strings.Index(base64Content, ",")+1:]
+		// 排队期间发送排队位置
+		options.Priority = services.PriorityNormal
+		options.OnQueued = func(position int) {
+			if err := writeSSEEvent(c, sseEventQueued, fmt.Sprintf(`{"position":%d}`, position)); err != nil {
+				utils.Errorf("发送排队位置失败: %v", err)
 			}
-			err = h.aiService.ChatWithImage(ctx, base64Content, "请描述这张图片", streamCallback)
 		}
 
-		if err != nil {
+		// 调用AI服务
+		err := h.conversationService.Chat(ctx, conversation, message, options, models.SenderTypePC, senderDeviceID, streamCallback)
+		if errors.Is(err, services.ErrQueueFull) {
+			utils.Warnf("用户 %d 的AI请求排队失败: %v", userID.(uint), err)
+			writeSSEEvent(c, "", err.Error())
+		} else if err != nil {
 			utils.Errorf("AI聊天失败: %v", err)
 			// 发送错误消息
-			c.Writer.WriteString(fmt.Sprintf("data: %s\n\n", "抱歉，AI服务暂时不可用，请稍后重试"))
-			c.Writer.Flush()
+			writeSSEEvent(c, "", "抱歉，AI服务暂时不可用，请稍后重试")
 		}
 	} else {
 		// 普通HTTP响应模式
-		var fullResponse strings.Builder
+		var fullResponse, reasoning strings.Builder
 
 		// 定义收集完整响应的回调函数
-		collectCallback := func(chunk string) error {
-			fullResponse.WriteString(chunk)
+		collectCallback := func(chunk services.StreamChunk) error {
+			if chunk.Type == services.ChunkReasoning {
+				reasoning.WriteString(chunk.Text)
+			} else {
+				fullResponse.WriteString(chunk.Text)
+			}
 			return nil
 		}
 
-		// 调用AI服务
-		var err error
-		switch req.Type {
-		case "text":
-			// 文本聊天
-			err = h.aiService.ChatWithText(ctx, req.Content, collectCallback)
-		case "image":
-			// 图片聊天
-			// 提取base64内容（去掉前缀）
-			base64Content := req.Content
-			if strings.HasPrefix(base64Content, "data:image/") {
-				// 去掉前缀
-				base64Content = base64Content[strings.Index(base64Content, ",")+1:]
-			}
-			err = h.aiService.ChatWithImage(ctx, base64Content, "请描述这张图片", collectCallback)
+		// 调用AI服务，非流式请求以低优先级排队
+		options.Priority = services.PriorityLow
+		err := h.conversationService.Chat(ctx, conversation, message, options, models.SenderTypePC, senderDeviceID, collectCallback)
+		if errors.Is(err, services.ErrQueueFull) {
+			utils.Warnf("用户 %d 的AI请求排队失败: %v", userID.(uint), err)
+			utils.ErrorResponse(c, http.StatusServiceUnavailable, err.Error())
+			return
 		}
-
 		if err != nil {
 			utils.Errorf("AI聊天失败: %v", err)
 			utils.InternalServerErrorResponse(c, "AI请求失败，请稍后重试")
 			return
 		}
 
-		// 返回完整的JSON响应
-		utils.SuccessResponse(c, gin.H{"content": fullResponse.String()})
+		// 返回完整的JSON响应，有思考过程时一并返回
+		response := gin.H{"content": fullResponse.String(), "conversation_id": conversation.ID}
+		if reasoning.Len() > 0 {
+			response["reasoning"] = reasoning.String()
+		}
+		utils.SuccessResponse(c, response)
 	}
 }
@@ -2,8 +2,14 @@ package handlers
 
 import (
 	"context"
+	"errors"
+	"fmt"
 	"net/http"
+	"strconv"
+	"time"
+	"unicode/utf8"
 
+	"phone-server/configs"
 	"phone-server/models"
 	"phone-server/services"
 	"phone-server/utils"
@@ -13,23 +19,45 @@ import (
 	"gorm.io/gorm"
 )
 
+// maxLogPreview 日志中记录的客户端消息内容的最大字节数
+const maxLogPreview = 256
+
 // WebSocketHandler WebSocket处理器
 type WebSocketHandler struct {
-	broker    *services.Broker    // 消息广播服务
-	db        *gorm.DB            // 数据库连接
-	aiService *services.AIService // AI服务
-	jwtSecret string              // JWT密钥
-	upgrader  websocket.Upgrader  // WebSocket连接升级器
+	broker              services.Broker               // 消息广播服务
+	db                  *gorm.DB                      // 数据库连接
+	conversationService *services.ConversationService // AI会话服务
+	deviceService       *services.DeviceService       // 设备在线状态服务
+	receiptService      *services.ReceiptService      // 消息回执服务
+	jwtSecret           string                        // JWT密钥
+	idleTimeout         time.Duration                 // 空闲超时时间，超时未收到任何数据则断开连接
+	replayLimit         int                           // 断线重连时每批查询和重放的离线消息条数
+	maxImageSize        int                           // 单张图片的最大字节数
+	maxFrameSize        int64                         // 单个WebSocket帧的最大字节数
+	uploadTimeout       time.Duration                 // 分片上传的最长间隔，超时未完成的上传会被丢弃
+	maxGenerations      int                           // 单个连接同时进行的AI生成数量上限
+	upgrader            websocket.Upgrader            // WebSocket连接升级器
 }
 
 // NewWebSocketHandler 创建WebSocket处理器实例
-func NewWebSocketHandler(broker *services.Broker, db *gorm.DB, aiService *services.AIService, jwtSecret string) *WebSocketHandler {
+func NewWebSocketHandler(broker services.Broker, db *gorm.DB, conversationService *services.ConversationService, deviceService *services.DeviceService, receiptService *services.ReceiptService, jwtSecret string, wsConfig configs.WebSocketConfig) *WebSocketHandler {
 	return &WebSocketHandler{
-		broker:    broker,
-		db:        db,
-		aiService: aiService,
-		jwtSecret: jwtSecret,
+		broker:              broker,
+		db:                  db,
+		conversationService: conversationService,
+		deviceService:       deviceService,
+		receiptService:      receiptService,
+		jwtSecret:           jwtSecret,
+		idleTimeout:         time.Duration(wsConfig.IdleTimeout) * time.Second,
+		replayLimit:         wsConfig.ReplayLimit,
+		maxImageSize:        wsConfig.MaxImageSize * 1024,
+		// base64编码会使图片体积增大约1/3，额外预留64KB给JSON字段
+		maxFrameSize:   int64(wsConfig.MaxImageSize*1024)*4/3 + 64*1024,
+		uploadTimeout:  time.Duration(wsConfig.UploadTimeout) * time.Second,
+		maxGenerations: wsConfig.MaxGenerations,
 		upgrader: websocket.Upgrader{
+			// 支持通过子协议协商当前协议版本
+			Subprotocols: []string{models.ProtocolSubprotocol},
 			// 允许所有来源的跨域请求
 			CheckOrigin: func(r *http.Request) bool {
 				return true
@@ -44,63 +72,129 @@ func NewWebSocketHandler(broker *services.Broker, db *gorm.DB, aiService *servic
 // @Tags websocket
 // @Accept json
 // @Produce json
+// @Param token query string false "JWT令牌或配对签发的设备凭证（也可通过Authorization头传递）"
+// @Param device_type query string false "设备类型（pc/phone），默认为phone，使用设备凭证时忽略"
+// @Param device_id query string false "客户端生成的稳定设备标识，使用设备凭证时忽略"
+// @Param protocol query int false "协议版本，2表示使用Envelope封装（也可通过子协议phone.v2协商），默认为1"
+// @Param last_message_id query int false "最后收到的消息ID，重连时重放之后的离线消息"
+// @Param since query string false "最后收到消息的时间（RFC3339），未提供last_message_id时使用"
 // @Success 101 {string} string "Switching Protocols"
 // @Router /ws [get]
 func (h *WebSocketHandler) HandleWebSocket(c *gin.Context) {
 	clientIP := c.ClientIP()
 	utils.Infofc(c.Request.Context(), "[WS] 收到WebSocket连接请求，客户端IP: %s", clientIP)
 
-	// 从查询参数获取Token
-	token := c.Query("token")
-	if token == "" {
-		// 也可以从Authorization头获取
-		token = c.GetHeader("Authorization")
-		utils.Debugfc(c.Request.Context(), "[WS] 从Authorization头获取Token: %s", token)
-	} else {
-		utils.Debugfc(c.Request.Context(), "[WS] 从查询参数获取Token: %s", token)
-	}
-
-	if token == "" {
-		utils.Warnfc(c.Request.Context(), "[WS] 缺少Token，客户端IP: %s", clientIP)
-		c.JSON(http.StatusUnauthorized, gin.H{"code": http.StatusUnauthorized, "message": "缺少Token"})
+	// 认证并确定连接所属的设备
+	device, status, errMsg := authenticateConnection(c, h.deviceService, h.jwtSecret, models.DeviceTypePhone)
+	if device == nil {
+		utils.Warnfc(c.Request.Context(), "[WS] 连接认证失败: %s, 客户端IP: %s", errMsg, clientIP)
+		c.JSON(status, gin.H{"code": status, "message": errMsg})
 		return
 	}
+	utils.Infofc(c.Request.Context(), "[WS] 认证成功，用户ID: %d, 设备ID: %d, 客户端IP: %s", device.UserID, device.ID, clientIP)
 
-	// 解析Token
-	claims, err := utils.ParseToken(token, h.jwtSecret)
-	if err != nil {
-		utils.Errorfc(c.Request.Context(), "[WS] 无效的Token: %v, 客户端IP: %s", err, clientIP)
-		c.JSON(http.StatusUnauthorized, gin.H{"code": http.StatusUnauthorized, "message": "无效的Token: " + err.Error()})
-		return
+	// 获取断线续传游标
+	var err error
+	var lastMessageID uint64
+	if lastIDStr := c.Query("last_message_id"); lastIDStr != "" {
+		if lastMessageID, err = strconv.ParseUint(lastIDStr, 10, 64); err != nil {
+			utils.Warnfc(c.Request.Context(), "[WS] 无效的last_message_id: %s, 客户端IP: %s", lastIDStr, clientIP)
+			c.JSON(http.StatusBadRequest, gin.H{"code": http.StatusBadRequest, "message": "无效的last_message_id"})
+			return
+		}
 	}
-	utils.Infofc(c.Request.Context(), "[WS] Token验证成功，用户ID: %d, 客户端IP: %s", claims.UserID, clientIP)
+	var since time.Time
+	if sinceStr := c.Query("since"); sinceStr != "" && lastMessageID == 0 {
+		if since, err = time.Parse(time.RFC3339, sinceStr); err != nil {
+			utils.Warnfc(c.Request.Context(), "[WS] 无效的since: %s, 客户端IP: %s", sinceStr, clientIP)
+			c.JSON(http.StatusBadRequest, gin.H{"code": http.StatusBadRequest, "message": "无效的since，需为RFC3339格式"})
+			return
+		}
+	}
+	resume := lastMessageID > 0 || !since.IsZero()
 
 	// 将HTTP连接升级为WebSocket连接
 	conn, err := h.upgrader.Upgrade(c.Writer, c.Request, nil)
 	if err != nil {
-		utils.Errorfc(c.Request.Context(), "[WS] WebSocket连接升级失败: %v, 用户ID: %d, 客户端IP: %s", err, claims.UserID, clientIP)
+		utils.Errorfc(c.Request.Context(), "[WS] WebSocket连接升级失败: %v, 用户ID: %d, 客户端IP: %s", err, device.UserID, clientIP)
+		return
+	}
+	utils.Infofc(c.Request.Context(), "[WS] WebSocket连接升级成功，用户ID: %d, 客户端IP: %s", device.UserID, clientIP)
+
+	// 标记设备在线
+	if err := h.deviceService.Connect(device, clientIP); err != nil {
+		utils.Errorfc(c.Request.Context(), "[WS] 更新设备在线状态失败: %v, 用户ID: %d, 客户端IP: %s", err, device.UserID, clientIP)
+		conn.Close()
 		return
 	}
-	utils.Infofc(c.Request.Context(), "[WS] WebSocket连接升级成功，用户ID: %d, 客户端IP: %s", claims.UserID, clientIP)
 
-	// 将客户端注册到消息广播服务
-	h.broker.RegisterClient(conn, claims.UserID)
-	utils.Infofc(c.Request.Context(), "[WS] 客户端已注册到消息广播服务，用户ID: %d, 客户端IP: %s", claims.UserID, clientIP)
+	// 协商协议版本
+	protocol := models.ProtocolVersionLegacy
+	if conn.Subprotocol() == models.ProtocolSubprotocol || c.Query("protocol") == strconv.Itoa(models.ProtocolVersion) {
+		protocol = models.ProtocolVersion
+	}
+
+	// 将客户端注册到消息广播服务，所有写操作都经由该客户端的发送队列完成
+	client := h.broker.RegisterClient(conn, device, protocol, resume)
+	utils.Infofc(c.Request.Context(), "[WS] 客户端已注册到消息广播服务，用户ID: %d, 设备ID: %d, 协议版本: %d, 客户端IP: %s", device.UserID, device.ID, protocol, clientIP)
+
+	// 发送握手帧（仅当前协议）
+	client.SendFrame(models.FrameHello, "", 0, models.HelloPayload{
+		ProtocolVersion: protocol,
+		DeviceID:        device.ID,
+		DeviceType:      device.DeviceType,
+	}, nil)
+
+	// 重放离线期间错过的消息，完成后切换为实时推送
+	if resume {
+		replayed, err := replayMissedMessages(h.db, client, device, uint(lastMessageID), since, h.replayLimit)
+		if err != nil {
+			utils.Errorfc(c.Request.Context(), "[WS] 重放离线消息失败: %v, 用户ID: %d, 客户端IP: %s", err, device.UserID, clientIP)
+			h.broker.UnregisterClient(client)
+			h.deviceService.Disconnect(device.ID)
+			return
+		}
+		utils.Infofc(c.Request.Context(), "[WS] 已重放 %d 条离线消息，用户ID: %d, 客户端IP: %s", replayed, device.UserID, clientIP)
+	}
 
 	// 启动协程处理WebSocket连接
-	go h.handleConnection(conn, claims.UserID, clientIP)
+	go h.handleConnection(conn, client, device, device.UserID, clientIP)
 }
 
 // handleConnection 处理WebSocket连接
-func (h *WebSocketHandler) handleConnection(conn *websocket.Conn, userID uint, clientIP string) {
-	utils.Infof("[WS] WebSocket连接建立成功，用户ID: %d, 客户端IP: %s", userID, clientIP)
+func (h *WebSocketHandler) handleConnection(conn *websocket.Conn, client *services.Client, device *models.Device, userID uint, clientIP string) {
+	utils.Infof("[WS] WebSocket连接建立成功，用户ID: %d, 设备ID: %d, 客户端IP: %s", userID, device.ID, clientIP)
 
 	defer func() {
-		// 连接关闭时，将客户端从消息广播服务中注销
-		h.broker.UnregisterClient(conn, userID)
-		utils.Infof("[WS] WebSocket连接关闭，用户ID: %d, 客户端IP: %s", userID, clientIP)
+		// 连接关闭时，将客户端从消息广播服务中注销，并更新设备在线状态
+		h.broker.UnregisterClient(client)
+		h.deviceService.Disconnect(device.ID)
+		utils.Infof("[WS] WebSocket连接关闭，用户ID: %d, 设备ID: %d, 客户端IP: %s", userID, device.ID, clientIP)
 	}()
 
+	// 限制单帧大小，并为二进制分片上传创建重组器
+	conn.SetReadLimit(h.maxFrameSize)
+	uploads := newUploadAssembler(h.maxImageSize, h.uploadTimeout)
+
+	// AI生成在独立协程中执行，读循环可以继续处理心跳和取消消息；连接关闭时中止所有生成
+	// 旧版协议的响应不带stream_id，无法区分并发的回答，因此按顺序排队执行
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	parallel := h.maxGenerations
+	if client.ProtocolVersion() < models.ProtocolVersion {
+		parallel = 1
+	}
+	generations := newGenerationRegistry(ctx, parallel, h.maxGenerations)
+	go uploads.run(ctx.Done())
+
+	// 设置空闲超时：收到Pong或任何消息都会延长读取截止时间
+	conn.SetReadDeadline(time.Now().Add(h.idleTimeout))
+	conn.SetPongHandler(func(string) error {
+		conn.SetReadDeadline(time.Now().Add(h.idleTimeout))
+		h.deviceService.Touch(device.ID)
+		return nil
+	})
+
 	// 循环接收客户端消息
 	for {
 		// 读取消息
@@ -113,110 +207,273 @@ func (h *WebSocketHandler) handleConnection(conn *websocket.Conn, userID uint, c
 			}
 			break
 		}
+		conn.SetReadDeadline(time.Now().Add(h.idleTimeout))
+		h.deviceService.Touch(device.ID)
 
-		// 仅处理文本消息
+		// 文本帧按协议解析，二进制帧按图片分片处理
 		if messageType == websocket.TextMessage {
-			utils.Infof("[WS] 用户 %d 收到WebSocket客户端消息: %s, 客户端IP: %s", userID, string(message), clientIP)
+			// 消息内容可能包含用户隐私且体积较大，只在Debug级别截断后记录
+			utils.Debugf("[WS] 用户 %d 收到WebSocket客户端消息: %s, 客户端IP: %s", userID, previewMessage(message), clientIP)
 
-			// 解析客户端消息
-			msgType, msgContent, err := utils.ParseClientMessage(string(message))
+			// 按协议版本解析客户端帧
+			env, err := utils.ParseEnvelope(message, client.ProtocolVersion())
 			if err != nil {
 				utils.Errorf("[WS] 解析客户端消息失败: %v, 用户ID: %d, 客户端IP: %s", err, userID, clientIP)
+				sendError(client, "", models.ErrorCodeBadRequest, "消息格式错误: "+err.Error())
 				continue
 			}
-			utils.Debugfc(context.Background(), "[WS] 解析客户端消息成功，类型: %s, 内容: %s, 用户ID: %d, 客户端IP: %s", msgType, msgContent, userID, clientIP)
+			utils.Infof("[WS] 收到客户端消息，类型: %s, 帧ID: %s, 大小: %d字节, 用户ID: %d, 客户端IP: %s", env.Type, env.ID, len(message), userID, clientIP)
 
 			// 根据消息类型处理
-			switch msgType {
+			switch env.Type {
 			case "text":
 				// 处理文本消息
-				h.handleTextMessage(conn, userID, msgContent, clientIP)
+				chat, err := utils.ParseAIChatMessage(string(env.Payload))
+				if err != nil || chat.Content == "" {
+					sendError(client, env.ID, models.ErrorCodeBadRequest, "缺少文本内容")
+					continue
+				}
+				if chat.Thinking != "" && !services.IsValidThinkingMode(chat.Thinking) {
+					sendError(client, env.ID, models.ErrorCodeBadRequest, "无效的思考模式: "+chat.Thinking)
+					continue
+				}
+				h.handleTextMessage(client, generations, env.ID, chat.Content, chat.ConversationID, services.ChatOptions{Model: chat.Model, Thinking: chat.Thinking}, clientIP)
 			case "image":
 				// 处理图片消息
-				h.handleImageMessage(conn, userID, msgContent, clientIP)
+				chat, err := utils.ParseAIChatMessage(string(env.Payload))
+				var images []services.ChatPart
+				if err == nil {
+					images = imageParts(append([]string{chat.Content}, chat.Images...))
+				}
+				if len(images) == 0 {
+					sendError(client, env.ID, models.ErrorCodeBadRequest, "缺少图片内容")
+					continue
+				}
+				if chat.Thinking != "" && !services.IsValidThinkingMode(chat.Thinking) {
+					sendError(client, env.ID, models.ErrorCodeBadRequest, "无效的思考模式: "+chat.Thinking)
+					continue
+				}
+				h.handleImageMessage(client, generations, env.ID, chat.Prompt, images, chat.ConversationID, services.ChatOptions{Model: chat.Model, Thinking: chat.Thinking}, clientIP)
+			case "message":
+				// 处理设备间转发消息
+				route, err := utils.ParseRouteMessage(string(env.Payload))
+				if err != nil {
+					utils.Errorf("[WS] 解析转发消息失败: %v, 用户ID: %d, 客户端IP: %s", err, userID, clientIP)
+					sendError(client, env.ID, models.ErrorCodeBadRequest, "转发消息格式错误")
+					continue
+				}
+				h.handleRouteMessage(client, device, env.ID, route, clientIP)
+			case "cancel":
+				// 取消进行中的AI生成
+				h.handleCancelMessage(client, generations, env, clientIP)
+			case "ack", "read":
+				// 处理送达/已读回执
+				h.handleAckMessage(client, device, env, clientIP)
 			default:
-				utils.Errorf("[WS] 未知的消息类型: %s, 用户ID: %d, 客户端IP: %s", msgType, userID, clientIP)
+				utils.Errorf("[WS] 未知的消息类型: %s, 用户ID: %d, 客户端IP: %s", env.Type, userID, clientIP)
+				sendError(client, env.ID, models.ErrorCodeUnknownType, "未知的消息类型: "+env.Type)
 			}
+		} else if messageType == websocket.BinaryMessage {
+			// 处理二进制图片分片
+			h.handleBinaryMessage(client, device, uploads, generations, message, clientIP)
 		} else {
-			utils.Warnf("[WS] 收到非文本消息，类型: %d, 用户ID: %d, 客户端IP: %s", messageType, userID, clientIP)
+			utils.Warnf("[WS] 收到不支持的消息，类型: %d, 用户ID: %d, 客户端IP: %s", messageType, userID, clientIP)
 		}
 	}
 }
 
-// handleTextMessage 处理客户端发送的文本消息
-func (h *WebSocketHandler) handleTextMessage(conn *websocket.Conn, userID uint, content string, clientIP string) {
-	utils.Infof("[WS] 用户 %d 处理文本消息: %s, 客户端IP: %s", userID, content, clientIP)
-
-	// 创建上下文
-	ctx := context.Background()
-
-	// 定义流式响应回调函数
-	streamCallback := func(chunk string) error {
-		// 构造响应消息
-		aiResponse := &models.Message{
-			Type:    "text",
-			Content: chunk,
-		}
+// authenticateConnection 认证WebSocket/SSE连接并确定连接所属的设备
+// Token可以是用户登录的JWT，也可以是配对签发的设备凭证；使用JWT时按device_type和device_id查找已注册的设备，
+// 只有用户的第一台设备可以通过JWT注册，之后的新设备需通过配对获取设备凭证
+// 认证失败时返回nil以及应返回的HTTP状态码和错误信息
+func authenticateConnection(c *gin.Context, deviceService *services.DeviceService, jwtSecret string, defaultDeviceType string) (*models.Device, int, string) {
+	// 从查询参数获取Token，也可以从Authorization头获取
+	token := c.Query("token")
+	if token == "" {
+		token = c.GetHeader("Authorization")
+	}
+	if token == "" {
+		return nil, http.StatusUnauthorized, "缺少Token"
+	}
 
-		// 将响应发送回当前客户端
-		if err := conn.WriteJSON(aiResponse); err != nil {
-			utils.Errorf("[WS] 发送AI文本响应失败: %v, 用户ID: %d, 客户端IP: %s", err, userID, clientIP)
-			return err
+	// 设备凭证认证
+	if services.IsDeviceToken(token) {
+		device, err := deviceService.AuthenticateToken(token)
+		if err != nil {
+			return nil, http.StatusUnauthorized, "无效的设备凭证: " + err.Error()
 		}
-		utils.Debugfc(ctx, "[WS] 发送AI文本响应成功，用户ID: %d, 客户端IP: %s, 响应内容: %s", userID, clientIP, chunk)
-		return nil
+		return device, 0, ""
 	}
 
-	// 调用AI服务进行文本对话（流式）
-	if err := h.aiService.ChatWithText(ctx, content, streamCallback); err != nil {
-		utils.Errorf("[WS] AI文本对话失败: %v, 用户ID: %d, 客户端IP: %s", err, userID, clientIP)
-		// 发送错误消息给客户端
-		errorMsg := &models.Message{
-			Type:    "text",
-			Content: "抱歉，AI服务暂时不可用，请稍后重试",
+	// 解析Token
+	claims, err := utils.ParseToken(token, jwtSecret)
+	if err != nil {
+		return nil, http.StatusUnauthorized, "无效的Token: " + err.Error()
+	}
+
+	// 获取设备信息
+	deviceType := c.DefaultQuery("device_type", defaultDeviceType)
+	if deviceType != models.DeviceTypePC && deviceType != models.DeviceTypePhone {
+		return nil, http.StatusBadRequest, "无效的设备类型"
+	}
+	clientID := c.Query("device_id")
+	if len(clientID) > 64 {
+		return nil, http.StatusBadRequest, "设备标识过长"
+	}
+
+	device, err := deviceService.ResolveDevice(claims.UserID, deviceType, clientID)
+	if errors.Is(err, services.ErrDeviceRevoked) || errors.Is(err, services.ErrDeviceNotPaired) {
+		return nil, http.StatusForbidden, err.Error()
+	}
+	if err != nil {
+		utils.Errorfc(c.Request.Context(), "查询设备失败: %v, 用户ID: %d", err, claims.UserID)
+		return nil, http.StatusInternalServerError, "查询设备失败"
+	}
+	return device, 0, ""
+}
+
+// previewMessage 截断客户端消息用于日志记录，不截断在多字节字符中间
+func previewMessage(message []byte) string {
+	if len(message) <= maxLogPreview {
+		return string(message)
+	}
+	end := maxLogPreview
+	for end > 0 && !utf8.RuneStart(message[end]) {
+		end--
+	}
+	return fmt.Sprintf("%s...（共%d字节）", message[:end], len(message))
+}
+
+// replayMissedMessages 按ID升序分批重放游标之后投递目标包含该设备的所有已持久化消息，完成后切换为实时推送
+// afterID优先于since，每批最多pageSize条，返回重放的消息条数
+func replayMissedMessages(db *gorm.DB, client *services.Client, device *models.Device, afterID uint, since time.Time, pageSize int) (int, error) {
+	replayed := 0
+	for {
+		messages, err := loadMissedMessages(db, device, afterID, since, pageSize)
+		if err != nil {
+			return replayed, err
+		}
+		if err := client.ReplayMessages(messages); err != nil {
+			return replayed, err
 		}
-		if err := conn.WriteJSON(errorMsg); err != nil {
-			utils.Errorf("[WS] 发送错误消息失败: %v, 用户ID: %d, 客户端IP: %s", err, userID, clientIP)
+		replayed += len(messages)
+		if len(messages) > 0 {
+			afterID = messages[len(messages)-1].ID
 		}
+		if len(messages) == pageSize {
+			continue
+		}
+		finished, err := client.FinishReplay()
+		if err != nil || finished {
+			return replayed, err
+		}
+		// FinishReplay可能已投递了部分暂存的实时消息，从连接已投递的位置继续，避免重复重放
+		// 一条都未投递时仍按since查询
+		afterID = max(afterID, client.LastMessageID())
 	}
 }
 
-// handleImageMessage 处理客户端发送的图片消息
-func (h *WebSocketHandler) handleImageMessage(conn *websocket.Conn, userID uint, imageBase64 string, clientIP string) {
-	utils.Infof("[WS] 用户 %d 处理图片消息，图片大小: %d字节, 客户端IP: %s", userID, len(imageBase64), clientIP)
+// loadMissedMessages 查询游标之后投递目标包含该设备的已持久化消息，按ID升序返回最早的limit条
+// afterID优先于since
+func loadMissedMessages(db *gorm.DB, device *models.Device, afterID uint, since time.Time, limit int) ([]*models.Message, error) {
+	query := db.Where("user_id = ?", device.UserID).
+		Where("(target IN ? OR (target = ? AND sender_device_id <> ?) OR target = ? OR (target = ? AND target_device_id = ?))",
+			[]string{"", models.MessageTargetAll},
+			models.MessageTargetOthers, device.ID,
+			device.DeviceType,
+			models.MessageTargetDevice, device.ID)
+	if afterID > 0 {
+		query = query.Where("id > ?", afterID)
+	} else {
+		query = query.Where("created_at > ?", since)
+	}
 
-	// 创建上下文
-	ctx := context.Background()
+	var messages []*models.Message
+	if err := query.Order("id ASC").Limit(limit).Find(&messages).Error; err != nil {
+		return nil, err
+	}
+	return messages, nil
+}
 
-	// 定义流式响应回调函数
-	streamCallback := func(chunk string) error {
-		// 构造响应消息
-		aiResponse := &models.Message{
-			Type:    "text",
-			Content: chunk,
-		}
+// handleRouteMessage 处理客户端发送给其他设备的消息，持久化后按投递目标广播
+func (h *WebSocketHandler) handleRouteMessage(client *services.Client, device *models.Device, replyTo string, route *utils.RouteMessage, clientIP string) {
+	if route.Target == "" {
+		route.Target = models.MessageTargetOthers
+	}
+	if errMsg := validateMessageTarget(h.db, device.UserID, route.Target, route.TargetDeviceID); errMsg != "" {
+		utils.Warnf("[WS] 转发消息目标无效: %s, 用户ID: %d, 客户端IP: %s", errMsg, device.UserID, clientIP)
+		sendError(client, replyTo, models.ErrorCodeBadRequest, errMsg)
+		return
+	}
 
-		// 将响应发送回当前客户端
-		if err := conn.WriteJSON(aiResponse); err != nil {
-			utils.Errorf("[WS] 发送AI图片响应失败: %v, 用户ID: %d, 客户端IP: %s", err, userID, clientIP)
-			return err
-		}
-		utils.Debugfc(ctx, "[WS] 发送AI图片响应成功，用户ID: %d, 客户端IP: %s, 响应内容: %s", userID, clientIP, chunk)
-		return nil
+	// 创建消息，发送者类型与设备类型一致
+	var msg *models.Message
+	switch models.MessageType(route.MessageType) {
+	case models.MessageTypeImage:
+		msg = models.NewImageMessage(device.UserID, route.Content, models.SenderType(device.DeviceType))
+	case models.MessageTypeText, "":
+		msg = models.NewTextMessage(device.UserID, route.Content, models.SenderType(device.DeviceType))
+	default:
+		utils.Warnf("[WS] 未知的转发消息类型: %s, 用户ID: %d, 客户端IP: %s", route.MessageType, device.UserID, clientIP)
+		sendError(client, replyTo, models.ErrorCodeBadRequest, "未知的转发消息类型: "+route.MessageType)
+		return
 	}
+	msg.RouteTo(device.ID, route.Target, route.TargetDeviceID)
+
+	// 将消息存储到数据库
+	if result := h.db.Create(msg); result.Error != nil {
+		utils.Errorf("[WS] 保存转发消息失败: %v, 用户ID: %d, 客户端IP: %s", result.Error, device.UserID, clientIP)
+		sendError(client, replyTo, models.ErrorCodeInternal, "保存消息失败")
+		return
+	}
+
+	// 通过消息广播服务转发消息，并告知发送方消息ID
+	h.broker.BroadcastMessage(msg, device.UserID)
+	if err := client.SendFrame(models.FrameMessageSent, replyTo, 0, gin.H{"message_id": msg.ID},
+		gin.H{"type": models.FrameMessageSent, "message_id": msg.ID}); err != nil {
+		utils.Errorf("[WS] 发送消息确认失败: %v, 用户ID: %d, 客户端IP: %s", err, device.UserID, clientIP)
+	}
+	utils.Infof("[WS] 设备 %d 转发消息，类型: %s，目标: %s", device.ID, msg.Type, msg.Target)
+}
+
+// handleAckMessage 处理客户端发送的送达/已读回执
+func (h *WebSocketHandler) handleAckMessage(client *services.Client, device *models.Device, env *models.Envelope, clientIP string) {
+	ack, err := utils.ParseAckMessage(string(env.Payload))
+	if err != nil {
+		utils.Errorf("[WS] 解析回执消息失败: %v, 用户ID: %d, 客户端IP: %s", err, device.UserID, clientIP)
+		sendError(client, env.ID, models.ErrorCodeBadRequest, "回执消息格式错误")
+		return
+	}
+
+	if env.Type == "read" {
+		_, err = h.receiptService.MarkRead(device, ack.MessageIDs)
+	} else {
+		_, err = h.receiptService.MarkDelivered(device, ack.MessageIDs)
+	}
+	if err != nil {
+		utils.Errorf("[WS] 记录消息回执失败: %v, 用户ID: %d, 设备ID: %d, 客户端IP: %s", err, device.UserID, device.ID, clientIP)
+		sendError(client, env.ID, models.ErrorCodeInternal, "记录消息回执失败")
+	}
+}
+
+// handleTextMessage 处理客户端发送的文本消息
+func (h *WebSocketHandler) handleTextMessage(client *services.Client, generations *generationRegistry, replyTo string, content string, conversationID uint, options services.ChatOptions, clientIP string) {
+	utils.Infof("[WS] 用户 %d 处理文本消息: %s, 会话ID: %d, 思考模式: %s, 客户端IP: %s", client.UserID(), content, conversationID, options.Thinking, clientIP)
+
+	// 调用AI服务进行文本对话（流式）
+	message := services.NewChatMessage(services.ChatRoleUser, services.TextPart(content))
+	h.runConversation(client, generations, replyTo, conversationID, message, options, clientIP)
+}
+
+// handleImageMessage 处理客户端发送的图片消息，prompt为空时使用配置的默认提示词
+func (h *WebSocketHandler) handleImageMessage(client *services.Client, generations *generationRegistry, replyTo string, prompt string, images []services.ChatPart, conversationID uint, options services.ChatOptions, clientIP string) {
+	utils.Infof("[WS] 用户 %d 处理图片消息，图片数: %d, 提示词: %s, 会话ID: %d, 思考模式: %s, 客户端IP: %s", client.UserID(), len(images), prompt, conversationID, options.Thinking, clientIP)
 
 	// 调用AI服务进行图片对话（流式）
-	// 这里可以添加额外的提示文本，例如"请描述这张图片"，或者使用客户端提供的提示
-	prompt := "请描述这张图片"
-	if err := h.aiService.ChatWithImage(ctx, imageBase64, prompt, streamCallback); err != nil {
-		utils.Errorf("[WS] AI图片对话失败: %v, 用户ID: %d, 客户端IP: %s", err, userID, clientIP)
-		// 发送错误消息给客户端
-		errorMsg := &models.Message{
-			Type:    "text",
-			Content: "抱歉，AI服务暂时不可用，请稍后重试",
-		}
-		if err := conn.WriteJSON(errorMsg); err != nil {
-			utils.Errorf("[WS] 发送错误消息失败: %v, 用户ID: %d, 客户端IP: %s", err, userID, clientIP)
-		}
+	message, err := h.conversationService.ImageMessage(prompt, images)
+	if err != nil {
+		sendError(client, replyTo, models.ErrorCodeBadRequest, err.Error())
+		return
 	}
+	h.runConversation(client, generations, replyTo, conversationID, message, options, clientIP)
 }
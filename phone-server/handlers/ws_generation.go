@@ -0,0 +1,231 @@
+package handlers
+
+import (
+	"context"
+	"errors"
+	"sync"
+
+	"phone-server/models"
+	"phone-server/services"
+	"phone-server/utils"
+)
+
+// generation 一次进行中的AI生成
+type generation struct {
+	id        string                  // 生成ID，与流ID相同
+	requestID string                  // 发起生成的请求帧ID
+	ctx       context.Context         // 生成上下文，取消后中止上游AI请求
+	cancel    context.CancelCauseFunc // 取消生成，客户端主动取消时原因为services.ErrChatCancelled
+	running   bool                    // 是否已占用生成名额，仅在生成协程中访问
+}
+
+// cancelled 生成是否被客户端主动取消
+func (g *generation) cancelled() bool {
+	return errors.Is(context.Cause(g.ctx), services.ErrChatCancelled)
+}
+
+// errTooManyGenerations 连接上进行中的生成数量已达上限
+var errTooManyGenerations = errors.New("进行中的AI生成数量已达上限")
+
+// generationRegistry 单个连接上进行中的AI生成
+// 所有生成的上下文都派生自连接上下文，连接关闭时全部中止
+type generationRegistry struct {
+	ctx       context.Context        // 连接上下文
+	mux       sync.Mutex             // 保护active的互斥锁
+	active    map[string]*generation // 按生成ID索引的进行中生成（含排队中的生成）
+	maxActive int                    // 进行中的生成数量上限
+	slots     chan struct{}          // 生成名额，限制同时执行的生成数量
+}
+
+// newGenerationRegistry 创建AI生成注册表
+// parallel为同时执行的生成数量，maxActive为进行中（执行中和排队中）的生成数量上限
+func newGenerationRegistry(ctx context.Context, parallel int, maxActive int) *generationRegistry {
+	return &generationRegistry{
+		ctx:       ctx,
+		active:    make(map[string]*generation),
+		maxActive: maxActive,
+		slots:     make(chan struct{}, parallel),
+	}
+}
+
+// begin 登记一次生成，进行中的生成数量已达上限时返回errTooManyGenerations
+func (r *generationRegistry) begin(id string, requestID string) (*generation, error) {
+	r.mux.Lock()
+	defer r.mux.Unlock()
+	if len(r.active) >= r.maxActive {
+		return nil, errTooManyGenerations
+	}
+
+	ctx, cancel := context.WithCancelCause(r.ctx)
+	g := &generation{
+		id:        id,
+		requestID: requestID,
+		ctx:       ctx,
+		cancel:    cancel,
+	}
+	r.active[id] = g
+	return g, nil
+}
+
+// acquire 等待生成名额，生成在获得名额前被取消时返回false
+func (r *generationRegistry) acquire(g *generation) bool {
+	select {
+	case r.slots <- struct{}{}:
+		g.running = true
+		return true
+	case <-g.ctx.Done():
+		return false
+	}
+}
+
+// finish 结束生成，释放名额并移除登记
+func (r *generationRegistry) finish(g *generation) {
+	if g.running {
+		<-r.slots
+		g.running = false
+	}
+	g.cancel(nil)
+
+	r.mux.Lock()
+	delete(r.active, g.id)
+	r.mux.Unlock()
+}
+
+// cancel 取消生成ID或请求帧ID匹配的生成，id为空时取消所有生成，返回取消的数量
+func (r *generationRegistry) cancel(id string) int {
+	r.mux.Lock()
+	defer r.mux.Unlock()
+
+	count := 0
+	for _, g := range r.active {
+		if id != "" && g.id != id && g.requestID != id {
+			continue
+		}
+		g.cancel(services.ErrChatCancelled)
+		count++
+	}
+	return count
+}
+
+// chatFunc 以指定上下文调用AI服务，排队等待生成名额期间通过onQueued通知排队位置
+type chatFunc func(ctx context.Context, onQueued func(position int), streamCallback services.StreamResponseFunc) error
+
+// runGeneration 在独立协程中执行一次AI生成，并以流的形式返回给客户端
+// 同一连接上的多个生成并发执行，以stream_id区分；所有帧经由连接的写协程串行写出
+// 生成可以被客户端通过cancel消息取消，连接关闭时也会中止上游请求
+func (h *WebSocketHandler) runGeneration(client *services.Client, generations *generationRegistry, replyTo string, conversationID uint, clientIP string, chat chatFunc) {
+	userID := client.UserID()
+	stream := newWSStream(client, replyTo, conversationID)
+	g, err := generations.begin(stream.streamID, replyTo)
+	if err != nil {
+		utils.Warnf("[WS] %v, 用户ID: %d, 客户端IP: %s", err, userID, clientIP)
+		sendError(client, replyTo, models.ErrorCodeTooManyGenerations, err.Error())
+		return
+	}
+
+	// 先发送流开始帧，客户端在生成排队期间即可按stream_id取消
+	if err := stream.Start(); err != nil {
+		utils.Errorf("[WS] 发送流开始帧失败: %v, 用户ID: %d, 客户端IP: %s", err, userID, clientIP)
+		generations.finish(g)
+		return
+	}
+
+	go func() {
+		defer generations.finish(g)
+
+		var err error
+		if generations.acquire(g) {
+			// 定义流式响应回调函数
+			streamCallback := func(chunk services.StreamChunk) error {
+				// 将响应发送回当前客户端，思考过程以reasoning帧单独发送
+				send := stream.Chunk
+				if chunk.Type == services.ChunkReasoning {
+					send = stream.Reasoning
+				}
+				if err := send(chunk.Text); err != nil {
+					utils.Errorf("[WS] 发送AI响应失败: %v, 用户ID: %d, 客户端IP: %s", err, userID, clientIP)
+					return err
+				}
+				utils.Debugfc(g.ctx, "[WS] 发送AI响应成功，用户ID: %d, 客户端IP: %s, 片段类型: %s, 响应内容: %s", userID, clientIP, chunk.Type, chunk.Text)
+				return nil
+			}
+			// 排队位置以queued帧发送，发送失败不影响排队
+			onQueued := func(position int) {
+				if err := stream.Queued(position); err != nil {
+					utils.Errorf("[WS] 发送排队位置失败: %v, 用户ID: %d, 客户端IP: %s", err, userID, clientIP)
+				}
+			}
+			err = chat(g.ctx, onQueued, streamCallback)
+		} else {
+			err = g.ctx.Err()
+		}
+
+		switch {
+		case err == nil:
+			stream.End(models.FinishReasonStop)
+		case g.cancelled():
+			utils.Infof("[WS] AI生成已被客户端取消，生成ID: %s, 用户ID: %d, 客户端IP: %s", g.id, userID, clientIP)
+			if err := stream.Cancelled(); err != nil {
+				utils.Errorf("[WS] 发送取消帧失败: %v, 用户ID: %d, 客户端IP: %s", err, userID, clientIP)
+			}
+		case g.ctx.Err() != nil:
+			utils.Infof("[WS] 连接已关闭，中止AI生成，生成ID: %s, 用户ID: %d, 客户端IP: %s", g.id, userID, clientIP)
+		case errors.Is(err, services.ErrQueueFull):
+			utils.Warnf("[WS] %v, 用户ID: %d, 客户端IP: %s", err, userID, clientIP)
+			if err := stream.Fail(models.ErrorCodeQueueFull, err.Error()); err != nil {
+				utils.Errorf("[WS] 发送错误消息失败: %v, 用户ID: %d, 客户端IP: %s", err, userID, clientIP)
+			}
+		default:
+			utils.Errorf("[WS] AI对话失败: %v, 用户ID: %d, 客户端IP: %s", err, userID, clientIP)
+			// 发送错误消息给客户端
+			if err := stream.Fail(models.ErrorCodeAIUnavailable, aiUnavailableMessage); err != nil {
+				utils.Errorf("[WS] 发送错误消息失败: %v, 用户ID: %d, 客户端IP: %s", err, userID, clientIP)
+			}
+		}
+	}()
+}
+
+// runConversation 打开会话后在会话中执行一次AI生成，之前的轮次会一并发送给AI
+func (h *WebSocketHandler) runConversation(client *services.Client, generations *generationRegistry, replyTo string, conversationID uint, message services.ChatMessage, options services.ChatOptions, clientIP string) {
+	conversation, err := h.conversationService.Open(client.UserID(), conversationID, message, options)
+	if errors.Is(err, services.ErrUnsupportedModel) {
+		sendError(client, replyTo, models.ErrorCodeUnsupportedModel, err.Error())
+		return
+	}
+	if errors.Is(err, services.ErrConversationNotFound) {
+		sendError(client, replyTo, models.ErrorCodeBadRequest, err.Error())
+		return
+	}
+	if errors.Is(err, services.ErrQuotaExceeded) {
+		utils.Warnf("[WS] %v, 用户ID: %d, 客户端IP: %s", err, client.UserID(), clientIP)
+		sendError(client, replyTo, models.ErrorCodeQuotaExceeded, err.Error())
+		return
+	}
+	if err != nil {
+		utils.Errorf("[WS] 打开会话失败: %v, 用户ID: %d, 客户端IP: %s", err, client.UserID(), clientIP)
+		sendError(client, replyTo, models.ErrorCodeInternal, "打开会话失败")
+		return
+	}
+
+	h.runGeneration(client, generations, replyTo, conversation.ID, clientIP, func(ctx context.Context, onQueued func(position int), streamCallback services.StreamResponseFunc) error {
+		options.Priority = services.PriorityNormal
+		options.OnQueued = onQueued
+		return h.conversationService.Chat(ctx, conversation, message, options, models.SenderType(client.DeviceType()), client.DeviceID(), streamCallback)
+	})
+}
+
+// handleCancelMessage 处理客户端取消AI生成的消息
+func (h *WebSocketHandler) handleCancelMessage(client *services.Client, generations *generationRegistry, env *models.Envelope, clientIP string) {
+	cancel, err := utils.ParseCancelMessage(string(env.Payload))
+	if err != nil {
+		utils.Errorf("[WS] 解析取消消息失败: %v, 用户ID: %d, 客户端IP: %s", err, client.UserID(), clientIP)
+		sendError(client, env.ID, models.ErrorCodeBadRequest, "取消消息格式错误")
+		return
+	}
+
+	if count := generations.cancel(cancel.GenerationID); count == 0 {
+		sendError(client, env.ID, models.ErrorCodeBadRequest, "没有可取消的生成: "+cancel.GenerationID)
+		return
+	}
+	utils.Infof("[WS] 用户 %d 取消AI生成: %s, 客户端IP: %s", client.UserID(), cancel.GenerationID, clientIP)
+}
@@ -0,0 +1,89 @@
+package handlers
+
+import (
+	"phone-server/models"
+	"phone-server/services"
+	"phone-server/utils"
+
+	"github.com/gin-gonic/gin"
+)
+
+// aiUnavailableMessage AI服务不可用时返回给客户端的提示
+const aiUnavailableMessage = "抱歉，AI服务暂时不可用，请稍后重试"
+
+// wsStream 按连接的协议版本发送一次AI流式响应
+// 当前协议下依次发送stream_start、chunk/reasoning、stream_end帧；旧版协议下仅把回答片段作为文本消息发送
+type wsStream struct {
+	client         *services.Client // 客户端连接
+	replyTo        string           // 对应的请求帧ID
+	streamID       string           // 流ID
+	conversationID uint             // 生成所属的会话ID
+	seq            int              // 已发送的片段序号
+}
+
+// newWSStream 创建AI流式响应
+func newWSStream(client *services.Client, replyTo string, conversationID uint) *wsStream {
+	return &wsStream{
+		client:         client,
+		replyTo:        replyTo,
+		streamID:       utils.NewFrameID(),
+		conversationID: conversationID,
+	}
+}
+
+// Start 发送流开始帧，携带会话ID供客户端继续会话
+func (s *wsStream) Start() error {
+	return s.client.SendFrame(models.FrameStreamStart, s.replyTo, 0,
+		models.StreamPayload{StreamID: s.streamID, ConversationID: s.conversationID}, nil)
+}
+
+// Queued 发送排队位置，旧版协议下不发送
+func (s *wsStream) Queued(position int) error {
+	return s.client.SendFrame(models.FrameQueued, s.replyTo, 0,
+		models.StreamPayload{StreamID: s.streamID, QueuePosition: position}, nil)
+}
+
+// Chunk 发送响应片段
+func (s *wsStream) Chunk(content string) error {
+	s.seq++
+	return s.client.SendFrame(models.FrameChunk, s.replyTo, s.seq,
+		models.StreamPayload{StreamID: s.streamID, Content: content},
+		&models.Message{Type: models.MessageTypeText, Content: content})
+}
+
+// Reasoning 发送思考过程片段，与回答片段共用序号；旧版协议下不发送
+func (s *wsStream) Reasoning(content string) error {
+	s.seq++
+	return s.client.SendFrame(models.FrameReasoning, s.replyTo, s.seq,
+		models.StreamPayload{StreamID: s.streamID, Content: content}, nil)
+}
+
+// End 发送流结束帧
+func (s *wsStream) End(finishReason string) error {
+	return s.client.SendFrame(models.FrameStreamEnd, s.replyTo, s.seq+1,
+		models.StreamPayload{StreamID: s.streamID, FinishReason: finishReason}, nil)
+}
+
+// Cancelled 发送生成已取消的结束帧，旧版协议下发送cancelled消息
+func (s *wsStream) Cancelled() error {
+	return s.client.SendFrame(models.FrameStreamEnd, s.replyTo, s.seq+1,
+		models.StreamPayload{StreamID: s.streamID, FinishReason: models.FinishReasonCancelled},
+		gin.H{"type": models.FinishReasonCancelled, "stream_id": s.streamID})
+}
+
+// Fail 发送错误帧，旧版协议下以文本消息提示
+func (s *wsStream) Fail(code string, message string) error {
+	return s.client.SendFrame(models.FrameError, s.replyTo, 0,
+		gin.H{"stream_id": s.streamID, "code": code, "message": message},
+		&models.Message{Type: models.MessageTypeText, Content: message})
+}
+
+// sendError 向客户端发送结构化错误帧
+func sendError(client *services.Client, replyTo string, code string, message string) {
+	err := client.SendFrame(models.FrameError, replyTo, 0,
+		models.ErrorPayload{Code: code, Message: message},
+		gin.H{"type": models.FrameError, "code": code, "message": message})
+	if err != nil {
+		utils.Errorf("[WS] 发送错误帧失败: %v, 用户ID: %d", err, client.UserID())
+	}
+}
@@ -0,0 +1,227 @@
+package handlers
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"phone-server/models"
+	"phone-server/services"
+	"phone-server/utils"
+)
+
+const (
+	// maxBinaryHeaderSize 二进制帧头部JSON的最大字节数
+	maxBinaryHeaderSize = 1024
+	// maxConcurrentUploads 单个连接同时进行的分片上传数量上限
+	maxConcurrentUploads = 4
+)
+
+// binaryHeader 二进制帧头部
+// 帧格式：2字节大端序头部长度N + N字节JSON头部 + 图片原始字节
+type binaryHeader struct {
+	ID             string `json:"id"`               // 上传ID，同一张图片的所有分片相同，也作为响应帧的reply_to
+	Type           string `json:"type"`             // image：发送给AI识别；message：转发给其他设备
+	Seq            int    `json:"seq"`              // 分片序号，从0开始
+	Final          bool   `json:"final"`            // 是否为最后一个分片
+	Mime           string `json:"mime"`             // 图片MIME类型，默认image/jpeg
+	Target         string `json:"target"`           // 转发消息的投递目标，仅type为message时有效
+	TargetDeviceID uint   `json:"target_device_id"` // 目标设备ID，仅target为device时有效
+	ConversationID uint   `json:"conversation_id"`  // 继续的会话ID，仅type为image时有效
+	Thinking       string `json:"thinking"`         // 思考模式，仅type为image时有效
+	Model          string `json:"model"`            // 模型名称，仅type为image时有效
+	Prompt         string `json:"prompt"`           // 对图片的提问，仅type为image时有效，为空时使用配置的默认提示词
+}
+
+// parseBinaryFrame 解析二进制帧，返回头部和图片数据
+func parseBinaryFrame(data []byte) (*binaryHeader, []byte, error) {
+	if len(data) < 2 {
+		return nil, nil, errors.New("二进制帧长度不足")
+	}
+	headerLen := int(binary.BigEndian.Uint16(data[:2]))
+	if headerLen == 0 || headerLen > maxBinaryHeaderSize {
+		return nil, nil, fmt.Errorf("二进制帧头部长度无效: %d", headerLen)
+	}
+	if len(data) < 2+headerLen {
+		return nil, nil, errors.New("二进制帧头部不完整")
+	}
+
+	var header binaryHeader
+	if err := json.Unmarshal(data[2:2+headerLen], &header); err != nil {
+		return nil, nil, fmt.Errorf("二进制帧头部格式错误: %w", err)
+	}
+	if header.ID == "" {
+		return nil, nil, errors.New("二进制帧缺少上传ID")
+	}
+	if header.Type != "image" && header.Type != "message" {
+		return nil, nil, fmt.Errorf("不支持的二进制帧类型: %s", header.Type)
+	}
+	if header.Mime == "" {
+		header.Mime = services.DefaultImageMimeType
+	}
+	if !strings.HasPrefix(header.Mime, "image/") {
+		return nil, nil, fmt.Errorf("不支持的MIME类型: %s", header.Mime)
+	}
+	if header.Thinking != "" && !services.IsValidThinkingMode(header.Thinking) {
+		return nil, nil, fmt.Errorf("无效的思考模式: %s", header.Thinking)
+	}
+	return &header, data[2+headerLen:], nil
+}
+
+// imageUpload 正在重组的分片上传
+type imageUpload struct {
+	header    *binaryHeader // 第一个分片的头部
+	data      bytes.Buffer  // 已接收的图片数据
+	nextSeq   int           // 期望的下一个分片序号
+	updatedAt time.Time     // 最后一次收到分片的时间
+}
+
+// uploadAssembler 分片上传重组器，由连接的读协程添加分片，run协程定期清理超时的上传
+type uploadAssembler struct {
+	mu      sync.Mutex              // 保护uploads
+	uploads map[string]*imageUpload // 按上传ID索引的未完成上传
+	maxSize int                     // 单张图片的最大字节数
+	timeout time.Duration           // 分片之间的最长间隔
+}
+
+// newUploadAssembler 创建分片上传重组器
+func newUploadAssembler(maxSize int, timeout time.Duration) *uploadAssembler {
+	return &uploadAssembler{
+		uploads: make(map[string]*imageUpload),
+		maxSize: maxSize,
+		timeout: timeout,
+	}
+}
+
+// run 定期丢弃超时未完成的上传，done关闭时（连接关闭）丢弃所有未完成的上传并返回
+// 放弃的上传不必等到下一个二进制帧或连接关闭才释放已缓存的数据
+func (a *uploadAssembler) run(done <-chan struct{}) {
+	ticker := time.NewTicker(a.timeout)
+	defer ticker.Stop()
+	for {
+		select {
+		case now := <-ticker.C:
+			a.mu.Lock()
+			a.purge(now)
+			a.mu.Unlock()
+		case <-done:
+			a.mu.Lock()
+			clear(a.uploads)
+			a.mu.Unlock()
+			return
+		}
+	}
+}
+
+// purge 丢弃超时未完成的上传，调用方需持有mu
+func (a *uploadAssembler) purge(now time.Time) {
+	for id, upload := range a.uploads {
+		if now.Sub(upload.updatedAt) > a.timeout {
+			utils.Warnf("[WS] 分片上传超时，已丢弃，上传ID: %s", id)
+			delete(a.uploads, id)
+		}
+	}
+}
+
+// add 添加一个分片，上传完成时返回第一个分片的头部和完整图片数据，未完成时返回nil
+func (a *uploadAssembler) add(header *binaryHeader, chunk []byte) (*binaryHeader, []byte, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	now := time.Now()
+	a.purge(now)
+
+	upload, ok := a.uploads[header.ID]
+	if !ok {
+		if header.Seq != 0 {
+			return nil, nil, fmt.Errorf("上传不存在或已超时，分片序号: %d", header.Seq)
+		}
+		if header.Final {
+			// 单帧上传，无需重组
+			if len(chunk) > a.maxSize {
+				return nil, nil, fmt.Errorf("图片大小超过限制（%d字节）", a.maxSize)
+			}
+			return header, chunk, nil
+		}
+		if len(a.uploads) >= maxConcurrentUploads {
+			return nil, nil, fmt.Errorf("同时进行的上传数量超过限制（%d个）", maxConcurrentUploads)
+		}
+		upload = &imageUpload{header: header}
+		a.uploads[header.ID] = upload
+	} else if header.Seq != upload.nextSeq {
+		delete(a.uploads, header.ID)
+		return nil, nil, fmt.Errorf("分片序号错误，期望: %d，实际: %d", upload.nextSeq, header.Seq)
+	}
+
+	if upload.data.Len()+len(chunk) > a.maxSize {
+		delete(a.uploads, header.ID)
+		return nil, nil, fmt.Errorf("图片大小超过限制（%d字节）", a.maxSize)
+	}
+	upload.data.Write(chunk)
+	upload.nextSeq++
+	upload.updatedAt = now
+
+	if !header.Final {
+		return nil, nil, nil
+	}
+	delete(a.uploads, header.ID)
+	return upload.header, upload.data.Bytes(), nil
+}
+
+// handleBinaryMessage 处理客户端发送的二进制图片分片，图片接收完整后按头部类型处理
+func (h *WebSocketHandler) handleBinaryMessage(client *services.Client, device *models.Device, uploads *uploadAssembler, generations *generationRegistry, message []byte, clientIP string) {
+	userID := client.UserID()
+
+	header, chunk, err := parseBinaryFrame(message)
+	if err != nil {
+		utils.Errorf("[WS] 解析二进制帧失败: %v, 用户ID: %d, 客户端IP: %s", err, userID, clientIP)
+		sendError(client, "", models.ErrorCodeBadRequest, err.Error())
+		return
+	}
+
+	first, image, err := uploads.add(header, chunk)
+	if err != nil {
+		utils.Errorf("[WS] 重组图片分片失败: %v, 用户ID: %d, 客户端IP: %s", err, userID, clientIP)
+		sendError(client, header.ID, models.ErrorCodeBadRequest, err.Error())
+		return
+	}
+	if first == nil {
+		// 等待后续分片
+		return
+	}
+	header = first
+	if len(image) == 0 {
+		sendError(client, header.ID, models.ErrorCodeBadRequest, "缺少图片内容")
+		return
+	}
+
+	// 以内容检测结果校验声明的类型，无法识别的格式（如HEIC）按声明的类型处理
+	detected := http.DetectContentType(image)
+	if detected != "application/octet-stream" && !strings.HasPrefix(detected, "image/") {
+		utils.Warnf("[WS] 二进制帧内容不是图片: %s, 用户ID: %d, 客户端IP: %s", detected, userID, clientIP)
+		sendError(client, header.ID, models.ErrorCodeBadRequest, "图片内容无效")
+		return
+	}
+	utils.Infof("[WS] 用户 %d 接收二进制图片完成，大小: %d字节, 类型: %s, 客户端IP: %s", userID, len(image), header.Mime, clientIP)
+
+	imageBase64 := base64.StdEncoding.EncodeToString(image)
+	switch header.Type {
+	case "image":
+		images := []services.ChatPart{services.ImagePart(header.Mime, imageBase64)}
+		h.handleImageMessage(client, generations, header.ID, header.Prompt, images, header.ConversationID, services.ChatOptions{Model: header.Model, Thinking: header.Thinking}, clientIP)
+	case "message":
+		h.handleRouteMessage(client, device, header.ID, &utils.RouteMessage{
+			MessageType:    string(models.MessageTypeImage),
+			Content:        fmt.Sprintf("data:%s;base64,%s", header.Mime, imageBase64),
+			Target:         header.Target,
+			TargetDeviceID: header.TargetDeviceID,
+		}, clientIP)
+	}
+}
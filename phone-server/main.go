@@ -5,6 +5,7 @@ import (
 	"os"
 	"os/signal"
 	"syscall"
+	"time"
 
 	"phone-server/configs"
 	"phone-server/handlers"
@@ -73,29 +74,135 @@ func main() {
 	utils.Infof("数据库连接成功")
 
 	// 创建消息广播服务并启动
-	broker := services.NewBroker()
+	brokerConfig := services.BrokerConfig{
+		SendQueueSize:      cfg.WebSocketConfig.SendQueueSize,
+		WriteTimeout:       time.Duration(cfg.WebSocketConfig.WriteTimeout) * time.Second,
+		SlowConsumerPolicy: services.SlowConsumerPolicy(cfg.WebSocketConfig.SlowConsumerPolicy),
+		PingInterval:       time.Duration(cfg.WebSocketConfig.PingInterval) * time.Second,
+	}
+	var broker services.Broker
+	if cfg.BrokerConfig.Backend == "mesh" {
+		meshBroker, err := services.NewMeshBroker(brokerConfig, services.MeshConfig{
+			NodeID:     cfg.BrokerConfig.NodeID,
+			ListenAddr: cfg.BrokerConfig.ListenAddr,
+			Peers:      cfg.BrokerConfig.PeerList(),
+			Secret:     cfg.BrokerConfig.Secret,
+		})
+		if err != nil {
+			utils.Fatalf("节点互联监听失败: %v", err)
+		}
+		broker = meshBroker
+	} else {
+		broker = services.NewMemoryBroker(brokerConfig)
+	}
 	go broker.Start()
-	utils.Infof("消息广播服务已启动")
+	utils.Infof("消息广播服务已启动，后端: %s，节点ID: %s", cfg.BrokerConfig.Backend, cfg.BrokerConfig.NodeID)
+
+	// 创建设备在线状态服务，清理本节点上次运行遗留的在线记录后定期刷新本节点的在线记录
+	// 其他节点上的设备在其节点停止刷新后由存活节点标记为离线
+	deviceService := services.NewDeviceService(db, broker, cfg.BrokerConfig.NodeID)
+	if err := deviceService.ClearNodePresence(); err != nil {
+		utils.Errorf("清理本节点在线记录失败: %v", err)
+	}
+	go deviceService.Start()
+
+	// 创建消息回执服务
+	receiptService := services.NewReceiptService(db, broker)
+
+	// 创建AI服务实例，所有提供方共用请求上游的HTTP客户端
+	upstreamClient := services.NewUpstreamClient(time.Duration(cfg.AIConfig.ConnectTimeout) * time.Second)
+	providers := map[string]services.ChatProvider{
+		services.ProviderOpenAI:    services.NewOpenAIProvider(upstreamClient, cfg.AIConfig.BaseURL, cfg.AIConfig.ApiKey, cfg.AIConfig.Thinking),
+		services.ProviderAnthropic: services.NewAnthropicProvider(upstreamClient, cfg.AIConfig.AnthropicBaseURL, cfg.AIConfig.AnthropicApiKey, cfg.AIConfig.AnthropicMaxTokens, cfg.AIConfig.Thinking),
+		services.ProviderOllama:    services.NewOllamaProvider(upstreamClient, cfg.AIConfig.OllamaBaseURL, cfg.AIConfig.Thinking),
+	}
+	var fakeScripts []services.FakeScript
+	if cfg.AIConfig.FakeScript != "" {
+		if fakeScripts, err = services.LoadFakeScripts(cfg.AIConfig.FakeScript); err != nil {
+			utils.Fatalf("加载模拟脚本失败: %v", err)
+		}
+	}
+	providers[services.ProviderFake] = services.NewFakeProvider(fakeScripts, time.Duration(cfg.AIConfig.FakeLatency)*time.Millisecond, cfg.AIConfig.Thinking)
+	var catalogModels []services.ModelInfo
+	modelProviders := cfg.AIConfig.ModelProviderMap()
+	for _, model := range cfg.AIConfig.ModelCatalog() {
+		provider := modelProviders[model.Name]
+		if provider == "" {
+			provider = cfg.AIConfig.Provider
+		}
+		capabilities := make([]services.ModelCapability, 0, len(model.Capabilities))
+		for _, capability := range model.Capabilities {
+			capabilities = append(capabilities, services.ModelCapability(capability))
+		}
+		catalogModels = append(catalogModels, services.ModelInfo{
+			Name:          model.Name,
+			DisplayName:   model.DisplayName,
+			Provider:      provider,
+			Capabilities:  capabilities,
+			ContextWindow: model.ContextWindow,
+			InputPrice:    model.InputPrice,
+			OutputPrice:   model.OutputPrice,
+			Currency:      model.Currency,
+		})
+	}
+	catalog := services.NewModelCatalog(catalogModels, cfg.AIConfig.Model)
+	breaker := services.NewCircuitBreaker(cfg.AIConfig.BreakerThreshold, time.Duration(cfg.AIConfig.BreakerCooldown)*time.Second)
+	aiService := services.NewAIService(providers, cfg.AIConfig.Provider, modelProviders, catalog,
+		cfg.AIConfig.FallbackModelList(), cfg.AIConfig.MaxRetries, time.Duration(cfg.AIConfig.RetryBackoff)*time.Millisecond, breaker,
+		time.Duration(cfg.AIConfig.FirstTokenTimeout)*time.Second, time.Duration(cfg.AIConfig.IdleTimeout)*time.Second)
+	utils.Infof("AI服务实例创建成功，模型: %s, 默认提供方: %s, 备用模型: %v, 思考模式: %s, 模型目录: %d个模型",
+		cfg.AIConfig.Model, cfg.AIConfig.Provider, cfg.AIConfig.FallbackModelList(), cfg.AIConfig.Thinking, len(catalogModels))
+
+	// 创建AI结果服务
+	resultService := services.NewAIResultService(db, broker)
 
-	// 创建AI服务实例
-	aiService := services.NewAIService(cfg.AIConfig.ApiKey, cfg.AIConfig.BaseURL, cfg.AIConfig.Model, cfg.AIConfig.Thinking)
-	utils.Infof("AI服务实例创建成功，模型: %s, 思考模式: %s",
-		cfg.AIConfig.Model, cfg.AIConfig.Thinking)
+	// 创建AI用量服务
+	usageService := services.NewUsageService(db, int64(cfg.AIConfig.DailyTokenQuota), int64(cfg.AIConfig.MonthlyTokenQuota))
+
+	// 创建AI生成并发限制器
+	limiter := services.NewGenerationLimiter(cfg.AIConfig.MaxConcurrent, cfg.AIConfig.MaxConcurrentPerUser, cfg.AIConfig.MaxQueue)
+
+	// 创建AI会话服务
+	conversationService := services.NewConversationService(db, aiService, resultService, usageService, limiter, cfg.AIConfig.HistoryTurns, cfg.AIConfig.HistoryChars, cfg.AIConfig.StoreReasoning,
+		cfg.AIConfig.ImagePrompt, cfg.AIConfig.MaxImages)
 
 	// 创建认证处理器
 	authHandler := handlers.NewAuthHandler(db, cfg.JWTConfig.SecretKey, cfg.JWTConfig.ExpireHour)
 	utils.Infof("认证处理器创建成功")
 
 	// 创建HTTP处理器
-	httpHandler := handlers.NewHTTPHandler(broker, db, aiService)
+	httpHandler := handlers.NewHTTPHandler(broker, db, conversationService, receiptService)
 	utils.Infof("HTTP处理器创建成功")
 
 	// 创建WebSocket处理器
-	wsHandler := handlers.NewWebSocketHandler(broker, db, aiService, cfg.JWTConfig.SecretKey)
+	wsHandler := handlers.NewWebSocketHandler(broker, db, conversationService, deviceService, receiptService, cfg.JWTConfig.SecretKey, cfg.WebSocketConfig)
 	utils.Infof("WebSocket处理器创建成功")
 
+	// 创建设备配对服务
+	pairingService := services.NewPairingService(db)
+
+	// 创建设备处理器
+	deviceHandler := handlers.NewDeviceHandler(deviceService, pairingService)
+	utils.Infof("设备处理器创建成功")
+
+	// 创建AI结果处理器
+	resultHandler := handlers.NewAIResultHandler(db, resultService)
+	utils.Infof("AI结果处理器创建成功")
+
+	// 创建AI用量处理器
+	usageHandler := handlers.NewAIUsageHandler(usageService)
+	utils.Infof("AI用量处理器创建成功")
+
+	// 创建AI模型目录处理器
+	modelHandler := handlers.NewAIModelHandler(catalog)
+	utils.Infof("AI模型目录处理器创建成功")
+
+	// 创建SSE事件流处理器
+	eventsHandler := handlers.NewEventsHandler(broker, db, deviceService, cfg.JWTConfig.SecretKey, cfg.WebSocketConfig)
+	utils.Infof("SSE事件流处理器创建成功")
+
 	// 初始化路由
-	router := router.SetupRouter(httpHandler, wsHandler, authHandler, cfg.JWTConfig.SecretKey)
+	router := router.SetupRouter(httpHandler, wsHandler, authHandler, deviceHandler, eventsHandler, resultHandler, usageHandler, modelHandler, deviceService, cfg.JWTConfig.SecretKey)
 	utils.Infof("路由初始化成功")
 
 	// 显示启动提示信息
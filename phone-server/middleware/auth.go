@@ -3,13 +3,15 @@ package middleware
 import (
 	"net/http"
 
+	"phone-server/services"
 	"phone-server/utils"
 
 	"github.com/gin-gonic/gin"
 )
 
 // AuthMiddleware JWT认证中间件
-func AuthMiddleware(jwtSecret string) gin.HandlerFunc {
+// 已配对的设备也可以使用设备凭证认证，此时上下文中额外保存deviceID
+func AuthMiddleware(jwtSecret string, deviceService *services.DeviceService) gin.HandlerFunc {
 	return func(c *gin.Context) {
 		// 从Authorization头获取Token
 		authHeader := c.GetHeader("Authorization")
@@ -19,6 +21,20 @@ func AuthMiddleware(jwtSecret string) gin.HandlerFunc {
 			return
 		}
 
+		// 设备凭证认证
+		if services.IsDeviceToken(authHeader) {
+			device, err := deviceService.AuthenticateToken(authHeader)
+			if err != nil {
+				c.JSON(http.StatusUnauthorized, gin.H{"code": http.StatusUnauthorized, "message": "无效的设备凭证: " + err.Error()})
+				c.Abort()
+				return
+			}
+			c.Set("userID", device.UserID)
+			c.Set("deviceID", device.ID)
+			c.Next()
+			return
+		}
+
 		// 解析Token
 		claims, err := utils.ParseToken(authHeader, jwtSecret)
 		if err != nil {
@@ -32,4 +48,16 @@ func AuthMiddleware(jwtSecret string) gin.HandlerFunc {
 		c.Set("username", claims.Username)
 		c.Next()
 	}
-}
\ No newline at end of file
+}
+// RequireUserToken 要求使用用户登录获得的JWT认证，需在AuthMiddleware之后使用
+// 配对、改名、撤销等设备管理操作只允许用户本人执行，设备凭证泄露时不能借此认领新设备或撤销其他设备
+func RequireUserToken() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if _, ok := c.Get("deviceID"); ok {
+			c.JSON(http.StatusForbidden, gin.H{"code": http.StatusForbidden, "message": "设备凭证无权执行该操作，请使用账号登录"})
+			c.Abort()
+			return
+		}
+		c.Next()
+	}
+}
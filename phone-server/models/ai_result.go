@@ -6,14 +6,31 @@ import (
 	"gorm.io/gorm"
 )
 
-// AIResult AI结果模型
+// AI结果的结束原因，正常结束和被取消时与流式响应的结束原因相同
+const (
+	// FinishReasonAborted 连接关闭导致生成中止
+	FinishReasonAborted = "aborted"
+	// FinishReasonTimeout 上游响应超时（等待首个片段或片段间隔过长）
+	FinishReasonTimeout = "timeout"
+	// FinishReasonError AI服务出错
+	FinishReasonError = "error"
+)
+
+// AIResult AI结果模型，记录每次生成的提问消息和完整回答
 type AIResult struct {
-	ID        uint           `gorm:"primaryKey" json:"id"`
-	UserID    uint           `gorm:"index;not null" json:"user_id"`
-	MessageID uint           `gorm:"uniqueIndex;not null" json:"message_id"`
-	Content   string         `gorm:"type:text;not null" json:"content"`
-	CreatedAt time.Time      `json:"created_at"`
-	DeletedAt gorm.DeletedAt `gorm:"index" json:"-"`
-	User      User           `gorm:"foreignKey:UserID" json:"-"`
-	Message   Message        `gorm:"foreignKey:MessageID" json:"-"`
+	ID               uint           `gorm:"primaryKey" json:"id"`
+	UserID           uint           `gorm:"index;not null" json:"user_id"`
+	MessageID        uint           `gorm:"uniqueIndex;not null" json:"message_id"` // 提问消息ID
+	ConversationID   uint           `gorm:"index;not null;default:0" json:"conversation_id"`
+	Model            string         `gorm:"size:100" json:"model"`                       // 生成回答的模型
+	LatencyMs        int64          `gorm:"not null;default:0" json:"latency_ms"`        // 生成耗时（毫秒）
+	FinishReason     string         `gorm:"size:20;not null" json:"finish_reason"`       // stop、cancelled、aborted、timeout 或 error
+	Content          string         `gorm:"type:text;not null" json:"content"`           // 回答内容，中止时为已生成的部分
+	Reasoning        string         `gorm:"type:text" json:"reasoning,omitempty"`        // 思考过程，仅开启ai_store_reasoning时保存
+	PromptTokens     int64          `gorm:"not null;default:0" json:"prompt_tokens"`     // 输入token数
+	CompletionTokens int64          `gorm:"not null;default:0" json:"completion_tokens"` // 输出token数
+	CreatedAt        time.Time      `json:"created_at"`
+	DeletedAt        gorm.DeletedAt `gorm:"index" json:"-"`
+	User             User           `gorm:"foreignKey:UserID" json:"-"`
+	Message          Message        `gorm:"foreignKey:MessageID" json:"-"`
 }
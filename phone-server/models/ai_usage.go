@@ -0,0 +1,27 @@
+package models
+
+import (
+	"time"
+)
+
+// AIUsageDateFormat AI用量记录的日期格式
+const AIUsageDateFormat = "2006-01-02"
+
+// AIUsage AI用量模型，按用户、模型和日期汇总token用量
+type AIUsage struct {
+	ID               uint      `gorm:"primaryKey" json:"-"`
+	UserID           uint      `gorm:"uniqueIndex:idx_ai_usage_user_model_date;not null" json:"-"`
+	Model            string    `gorm:"uniqueIndex:idx_ai_usage_user_model_date;size:100;not null" json:"model"`
+	Date             string    `gorm:"uniqueIndex:idx_ai_usage_user_model_date;size:10;not null" json:"date"` // 日期，格式为YYYY-MM-DD
+	Requests         int64     `gorm:"not null;default:0" json:"requests"`                                    // 请求次数
+	PromptTokens     int64     `gorm:"not null;default:0" json:"prompt_tokens"`                               // 输入token数
+	CompletionTokens int64     `gorm:"not null;default:0" json:"completion_tokens"`                           // 输出token数（含思考过程）
+	EstimatedTokens  int64     `gorm:"not null;default:0" json:"estimated_tokens"`                            // 上游未返回用量时估算的token数，已计入输入和输出
+	UpdatedAt        time.Time `json:"updated_at"`
+	User             User      `gorm:"foreignKey:UserID" json:"-"`
+}
+
+// TotalTokens 总token数
+func (u AIUsage) TotalTokens() int64 {
+	return u.PromptTokens + u.CompletionTokens
+}
@@ -0,0 +1,37 @@
+package models
+
+import (
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// 会话轮次的角色
+const (
+	// TurnRoleUser 用户发送的内容
+	TurnRoleUser = "user"
+	// TurnRoleAssistant AI的回复
+	TurnRoleAssistant = "assistant"
+)
+
+// Conversation AI会话模型，同一会话中的对话会携带之前的轮次发送给AI
+type Conversation struct {
+	ID        uint           `gorm:"primaryKey" json:"id"`
+	UserID    uint           `gorm:"index;not null" json:"user_id"`
+	Title     string         `gorm:"size:100" json:"title"` // 会话标题，取自第一条用户消息
+	CreatedAt time.Time      `json:"created_at"`
+	UpdatedAt time.Time      `json:"updated_at"`
+	DeletedAt gorm.DeletedAt `gorm:"index" json:"-"`
+	User      User           `gorm:"foreignKey:UserID" json:"-"`
+}
+
+// ConversationTurn 会话轮次模型，记录用户发送的内容或AI的回复
+type ConversationTurn struct {
+	ID             uint         `gorm:"primaryKey" json:"id"`
+	ConversationID uint         `gorm:"index;not null" json:"conversation_id"`
+	Role           string       `gorm:"size:20;not null" json:"role"`          // user 或 assistant
+	Content        string       `gorm:"type:text;not null" json:"content"`     // 文本内容
+	ImageCount     int          `gorm:"not null;default:0" json:"image_count"` // 用户发送的图片数量，图片本身不保存
+	CreatedAt      time.Time    `json:"created_at"`
+	Conversation   Conversation `gorm:"foreignKey:ConversationID" json:"-"`
+}
@@ -0,0 +1,97 @@
+package models
+
+import (
+	"encoding/json"
+)
+
+// WebSocket协议版本
+const (
+	// ProtocolVersionLegacy 旧版协议：客户端发送{type, content}，服务端直接发送消息JSON
+	ProtocolVersionLegacy = 1
+	// ProtocolVersion 当前协议：双方均使用Envelope封装
+	ProtocolVersion = 2
+	// ProtocolSubprotocol 协商当前协议使用的WebSocket子协议名称
+	ProtocolSubprotocol = "phone.v2"
+)
+
+// 服务端帧类型
+const (
+	// FrameHello 连接建立后服务端发送的握手帧
+	FrameHello = "hello"
+	// FrameMessage 广播消息
+	FrameMessage = "message"
+	// FrameMessageSent 转发消息已保存
+	FrameMessageSent = "message_sent"
+	// FrameQueued AI生成排队中，排队位置变化时发送
+	FrameQueued = "queued"
+	// FrameStreamStart AI流式响应开始
+	FrameStreamStart = "stream_start"
+	// FrameChunk AI流式响应片段
+	FrameChunk = "chunk"
+	// FrameReasoning AI思考过程片段
+	FrameReasoning = "reasoning"
+	// FrameStreamEnd AI流式响应结束
+	FrameStreamEnd = "stream_end"
+	// FrameError 错误
+	FrameError = "error"
+)
+
+// 错误帧错误码
+const (
+	// ErrorCodeBadRequest 请求格式错误
+	ErrorCodeBadRequest = "bad_request"
+	// ErrorCodeUnknownType 未知的消息类型
+	ErrorCodeUnknownType = "unknown_type"
+	// ErrorCodeAIUnavailable AI服务不可用
+	ErrorCodeAIUnavailable = "ai_unavailable"
+	// ErrorCodeInternal 服务器内部错误
+	ErrorCodeInternal = "internal"
+	// ErrorCodeTooManyGenerations 连接上进行中的AI生成数量已达上限
+	ErrorCodeTooManyGenerations = "too_many_generations"
+	// ErrorCodeQuotaExceeded 用户的AI用量已超出配额
+	ErrorCodeQuotaExceeded = "quota_exceeded"
+	// ErrorCodeQueueFull 排队等待的AI生成数量已达上限
+	ErrorCodeQueueFull = "queue_full"
+	// ErrorCodeUnsupportedModel 请求的模型不在模型目录中，或不支持消息中的图片或思考模式
+	ErrorCodeUnsupportedModel = "unsupported_model"
+)
+
+// AI流式响应的结束原因
+const (
+	// FinishReasonStop 生成正常结束
+	FinishReasonStop = "stop"
+	// FinishReasonCancelled 生成被客户端取消
+	FinishReasonCancelled = "cancelled"
+)
+
+// Envelope WebSocket协议封装帧
+type Envelope struct {
+	V       int             `json:"v"`                  // 协议版本
+	ID      string          `json:"id"`                 // 帧ID
+	Type    string          `json:"type"`               // 帧类型
+	ReplyTo string          `json:"reply_to,omitempty"` // 响应的请求帧ID
+	Seq     int             `json:"seq,omitempty"`      // 流式响应中的片段序号，从1开始
+	Payload json.RawMessage `json:"payload,omitempty"`  // 帧内容
+}
+
+// HelloPayload 握手帧内容
+type HelloPayload struct {
+	ProtocolVersion int    `json:"protocol_version"` // 协商后的协议版本
+	DeviceID        uint   `json:"device_id"`        // 当前连接的设备ID
+	DeviceType      string `json:"device_type"`      // 当前连接的设备类型
+}
+
+// StreamPayload 流式响应帧内容
+type StreamPayload struct {
+	StreamID       string `json:"stream_id"`                 // 流ID
+	ConversationID uint   `json:"conversation_id,omitempty"` // 会话ID，仅stream_start帧，继续会话时携带
+	Content        string `json:"content,omitempty"`         // 响应片段或思考过程片段，仅chunk和reasoning帧
+	FinishReason   string `json:"finish_reason,omitempty"`   // 结束原因，仅stream_end帧
+	QueuePosition  int    `json:"queue_position,omitempty"`  // 排队位置，从1开始，仅queued帧
+}
+
+// ErrorPayload 错误帧内容
+type ErrorPayload struct {
+	Code    string `json:"code"`    // 错误码
+	Message string `json:"message"` // 错误描述
+}
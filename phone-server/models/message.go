@@ -22,42 +22,79 @@ type SenderType string
 const (
 	// SenderTypePC PC端发送
 	SenderTypePC SenderType = "pc"
+	// SenderTypePhone 手机端发送
+	SenderTypePhone SenderType = "phone"
 	// SenderTypeServer 服务器发送
 	SenderTypeServer SenderType = "server"
 )
 
+// 消息投递目标
+const (
+	// MessageTargetAll 投递给用户的所有设备
+	MessageTargetAll = "all"
+	// MessageTargetOthers 投递给除发送设备外的所有设备
+	MessageTargetOthers = "others"
+	// MessageTargetPC 仅投递给PC端设备
+	MessageTargetPC = "pc"
+	// MessageTargetPhone 仅投递给手机端设备
+	MessageTargetPhone = "phone"
+	// MessageTargetDevice 仅投递给指定设备
+	MessageTargetDevice = "device"
+	// MessageTargetNone 不投递，仅保存（如向AI提问的消息）
+	MessageTargetNone = "none"
+)
+
+// IsValidMessageTarget 判断投递目标是否有效
+func IsValidMessageTarget(target string) bool {
+	switch target {
+	case MessageTargetAll, MessageTargetOthers, MessageTargetPC, MessageTargetPhone, MessageTargetDevice:
+		return true
+	}
+	return false
+}
+
 // Message 消息模型
 type Message struct {
-	ID         uint           `gorm:"primaryKey" json:"id"`
-	UserID     uint           `gorm:"index;not null" json:"user_id"`
-	Type       MessageType    `gorm:"size:10;not null" json:"type"` // text 或 image
-	Content    string         `gorm:"type:text;not null" json:"content"`
-	Sender     SenderType     `gorm:"size:10;not null" json:"sender"` // pc 或 server
-	IsSelected bool           `gorm:"not null;default:false" json:"is_selected"`
-	CreatedAt  time.Time      `json:"created_at"`
-	DeletedAt  gorm.DeletedAt `gorm:"index" json:"-"`
-	User       User           `gorm:"foreignKey:UserID" json:"-"`
+	ID             uint           `gorm:"primaryKey" json:"id"`
+	UserID         uint           `gorm:"index;not null" json:"user_id"`
+	Type           MessageType    `gorm:"size:10;not null" json:"type"` // text 或 image
+	Content        string         `gorm:"type:text;not null" json:"content"`
+	Sender         SenderType     `gorm:"size:10;not null" json:"sender"`               // pc、phone 或 server
+	SenderDeviceID uint           `gorm:"not null;default:0" json:"sender_device_id"`   // 发送设备ID，0表示未知
+	Target         string         `gorm:"size:10;not null;default:'all'" json:"target"` // 投递目标：all/others/pc/phone/device
+	TargetDeviceID uint           `gorm:"not null;default:0" json:"target_device_id"`   // Target为device时的目标设备ID
+	IsSelected     bool           `gorm:"not null;default:false" json:"is_selected"`
+	CreatedAt      time.Time      `json:"created_at"`
+	DeletedAt      gorm.DeletedAt `gorm:"index" json:"-"`
+	User           User           `gorm:"foreignKey:UserID" json:"-"`
 }
 
-
-
-// NewTextMessage 创建文本消息
+// NewTextMessage 创建文本消息，默认投递给用户的所有设备
 func NewTextMessage(userID uint, content string, sender SenderType) *Message {
 	return &Message{
 		UserID:  userID,
 		Type:    MessageTypeText,
 		Content: content,
 		Sender:  sender,
+		Target:  MessageTargetAll,
 	}
 }
 
-// NewImageMessage 创建图片消息
+// NewImageMessage 创建图片消息，默认投递给用户的所有设备
 func NewImageMessage(userID uint, content string, sender SenderType) *Message {
 	return &Message{
 		UserID:  userID,
 		Type:    MessageTypeImage,
 		Content: content,
 		Sender:  sender,
+		Target:  MessageTargetAll,
 	}
 }
 
+// RouteTo 设置消息的发送设备和投递目标
+func (m *Message) RouteTo(senderDeviceID uint, target string, targetDeviceID uint) *Message {
+	m.SenderDeviceID = senderDeviceID
+	m.Target = target
+	m.TargetDeviceID = targetDeviceID
+	return m
+}
@@ -0,0 +1,22 @@
+package models
+
+import (
+	"time"
+)
+
+// PairingCode 设备配对码模型
+// 申请方（通常是PC端）申请配对码并展示（可渲染为二维码），已登录的手机端认领后，申请方凭轮询凭据取回设备凭证
+// 设备凭证在申请方取回时才生成，数据库中只保存其哈希
+type PairingCode struct {
+	ID         uint       `gorm:"primaryKey" json:"id"`
+	Code       string     `gorm:"uniqueIndex;size:16;not null" json:"code"` // 配对码
+	SecretHash string     `gorm:"size:64;not null" json:"-"`                // 申请方轮询凭据的SHA-256哈希
+	DeviceType string     `gorm:"size:10;not null" json:"device_type"`      // 申请配对的设备类型
+	ClientID   string     `gorm:"size:64" json:"client_id"`                 // 申请配对的客户端设备标识
+	Name       string     `gorm:"size:50" json:"name"`                      // 申请配对的设备名称
+	UserID     uint       `gorm:"index;not null;default:0" json:"user_id"`  // 认领的用户ID，0表示尚未认领
+	DeviceID   uint       `gorm:"not null;default:0" json:"device_id"`      // 认领后创建的设备ID
+	ExpiresAt  time.Time  `gorm:"index;not null" json:"expires_at"`         // 过期时间
+	ClaimedAt  *time.Time `json:"claimed_at"`                               // 认领时间
+	CreatedAt  time.Time  `json:"created_at"`
+}
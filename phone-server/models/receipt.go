@@ -0,0 +1,28 @@
+package models
+
+import (
+	"time"
+)
+
+// 消息回执状态
+const (
+	// ReceiptStatusDelivered 已送达
+	ReceiptStatusDelivered = "delivered"
+	// ReceiptStatusRead 已读
+	ReceiptStatusRead = "read"
+)
+
+// MessageReceipt 消息回执模型，记录每条消息在每个设备上的送达和已读状态
+type MessageReceipt struct {
+	ID          uint       `gorm:"primaryKey" json:"id"`
+	MessageID   uint       `gorm:"uniqueIndex:idx_receipt_message_device;not null" json:"message_id"`
+	DeviceID    uint       `gorm:"uniqueIndex:idx_receipt_message_device;not null" json:"device_id"`
+	UserID      uint       `gorm:"index;not null" json:"user_id"`
+	Status      string     `gorm:"size:10;not null" json:"status"` // delivered 或 read
+	DeliveredAt *time.Time `json:"delivered_at"`
+	ReadAt      *time.Time `json:"read_at"`
+	CreatedAt   time.Time  `json:"created_at"`
+	UpdatedAt   time.Time  `json:"updated_at"`
+	Message     Message    `gorm:"foreignKey:MessageID" json:"-"`
+	Device      Device     `gorm:"foreignKey:DeviceID" json:"-"`
+}
@@ -17,15 +17,48 @@ type User struct {
 	DeletedAt    gorm.DeletedAt `gorm:"index" json:"-"`
 }
 
+// 设备类型
+const (
+	// DeviceTypePC PC端设备
+	DeviceTypePC = "pc"
+	// DeviceTypePhone 手机端设备
+	DeviceTypePhone = "phone"
+)
+
+// 设备在线状态
+const (
+	// DeviceStatusOnline 在线
+	DeviceStatusOnline = "online"
+	// DeviceStatusOffline 离线
+	DeviceStatusOffline = "offline"
+)
+
 // Device 设备模型
 type Device struct {
 	ID           uint           `gorm:"primaryKey" json:"id"`
 	UserID       uint           `gorm:"index;not null" json:"user_id"`
-	DeviceType   string         `gorm:"size:10;not null" json:"device_type"` // pc 或 phone
-	DeviceToken  string         `gorm:"size:255;not null" json:"device_token"`
+	DeviceType   string         `gorm:"size:10;not null" json:"device_type"`              // pc 或 phone
+	ClientID     string         `gorm:"size:64;index" json:"client_id"`                   // 客户端上报的设备标识
+	Name         string         `gorm:"size:50" json:"name"`                              // 设备名称，可由用户修改
+	DeviceToken  string         `gorm:"size:255;not null;index" json:"-"`                 // 设备凭证的SHA-256哈希，配对设备使用该凭证连接
+	RevokedAt    *time.Time     `json:"revoked_at,omitempty"`                             // 撤销时间，已撤销的设备无法再连接
 	Status       string         `gorm:"size:10;not null;default:'offline'" json:"status"` // online 或 offline
-	LastActiveAt time.Time      `json:"last_active_at"`
+	LastActiveAt time.Time      `json:"last_active_at"`                                   // 最后活跃时间，在线时随心跳刷新
+	ConnectedAt  *time.Time     `json:"connected_at"`                                     // 最近一次上线时间
+	LastIP       string         `gorm:"size:64" json:"last_ip"`                           // 最近一次连接的客户端IP
 	CreatedAt    time.Time      `json:"created_at"`
 	DeletedAt    gorm.DeletedAt `gorm:"index" json:"-"`
 	User         User           `gorm:"foreignKey:UserID" json:"-"`
 }
+
+// DevicePresence 设备在线记录，每个节点上的每个在线设备一条，由所在节点定期刷新过期时间
+// 设备在任一节点上有未过期的记录即视为在线；节点崩溃后其记录过期，由其他节点清理
+type DevicePresence struct {
+	ID          uint      `gorm:"primaryKey" json:"id"`
+	NodeID      string    `gorm:"size:128;uniqueIndex:idx_presence_node_device;not null" json:"node_id"` // 连接所在的节点ID
+	DeviceID    uint      `gorm:"uniqueIndex:idx_presence_node_device;index;not null" json:"device_id"`
+	UserID      uint      `gorm:"index;not null" json:"user_id"`
+	Connections int       `gorm:"not null" json:"connections"`      // 设备在该节点上的连接数
+	ExpiresAt   time.Time `gorm:"index;not null" json:"expires_at"` // 过期时间，节点停止刷新后记录失效
+	UpdatedAt   time.Time `json:"updated_at"`
+}
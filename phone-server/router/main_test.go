@@ -0,0 +1,22 @@
+package router
+
+import (
+	"log"
+	"os"
+	"testing"
+
+	"phone-server/utils"
+)
+
+// TestMain 将日志写入临时目录，避免测试在包目录下留下logs目录
+func TestMain(m *testing.M) {
+	dir, err := os.MkdirTemp("", "phone-server-logs-")
+	if err != nil {
+		log.Fatalf("创建日志临时目录失败: %v", err)
+	}
+	utils.InitLoggerWithConfig("info", dir, 100, 1, false, true)
+	code := m.Run()
+	utils.CloseLogger()
+	os.RemoveAll(dir)
+	os.Exit(code)
+}
@@ -3,6 +3,7 @@ package router
 import (
 	"phone-server/handlers"
 	"phone-server/middleware"
+	"phone-server/services"
 
 	"github.com/gin-contrib/cors"
 	"github.com/gin-gonic/gin"
@@ -13,7 +14,7 @@ import (
 )
 
 // SetupRouter 初始化并配置Gin路由
-func SetupRouter(httpHandler *handlers.HTTPHandler, wsHandler *handlers.WebSocketHandler, authHandler *handlers.AuthHandler, jwtSecret string) *gin.Engine {
+func SetupRouter(httpHandler *handlers.HTTPHandler, wsHandler *handlers.WebSocketHandler, authHandler *handlers.AuthHandler, deviceHandler *handlers.DeviceHandler, eventsHandler *handlers.EventsHandler, resultHandler *handlers.AIResultHandler, usageHandler *handlers.AIUsageHandler, modelHandler *handlers.AIModelHandler, deviceService *services.DeviceService, jwtSecret string) *gin.Engine {
 	// 创建Gin引擎
 	// 生产环境中使用gin.ReleaseMode
 	// gin.SetMode(gin.ReleaseMode)
@@ -32,7 +33,8 @@ func SetupRouter(httpHandler *handlers.HTTPHandler, wsHandler *handlers.WebSocke
 	config := cors.DefaultConfig()
 	config.AllowAllOrigins = true
 	config.AllowMethods = []string{"GET", "POST", "PUT", "PATCH", "DELETE", "OPTIONS"}
-	config.AllowHeaders = []string{"Origin", "Content-Type", "Authorization", "X-Request-ID"}
+	config.AllowHeaders = []string{"Origin", "Content-Type", "Authorization", "X-Request-ID", "Last-Event-ID"}
+	config.ExposeHeaders = []string{"X-Conversation-ID"}
 	config.AllowCredentials = true
 	router.Use(cors.New(config))
 
@@ -63,15 +65,42 @@ func SetupRouter(httpHandler *handlers.HTTPHandler, wsHandler *handlers.WebSocke
 
 		// 消息路由组（需要认证中间件）
 		messageGroup := apiGroup.Group("/")
-		messageGroup.Use(middleware.AuthMiddleware(jwtSecret))
+		messageGroup.Use(middleware.AuthMiddleware(jwtSecret, deviceService))
 		{
 			// 发送文本消息
 			messageGroup.POST("/message", httpHandler.SendTextMessage)
 			// 发送图片消息
 			messageGroup.POST("/image", httpHandler.SendImageMessage)
+			// 查询消息回执
+			messageGroup.GET("/message/:id/receipts", httpHandler.GetMessageReceipts)
 			// AI聊天
 			messageGroup.POST("/ai/chat", httpHandler.ChatWithAI)
+			// 查询AI回答历史
+			messageGroup.GET("/ai/results", resultHandler.ListResults)
+			// 查询AI回答
+			messageGroup.GET("/ai/results/:message_id", resultHandler.GetResult)
+			// 转发AI回答
+			messageGroup.POST("/ai/results/:message_id/resend", resultHandler.ResendResult)
+			// 查询AI用量
+			messageGroup.GET("/ai/usage", usageHandler.GetUsage)
+			// 查询AI模型目录
+			messageGroup.GET("/ai/models", modelHandler.ListModels)
 		}
+
+		// SSE事件流（自行校验Token，EventSource无法设置Authorization头）
+		apiGroup.GET("/events", eventsHandler.HandleEvents)
+
+		// 配对路由组（PC端尚未获得凭证，无需认证）
+		pairingGroup := apiGroup.Group("/pairing")
+		{
+			// 申请配对码
+			pairingGroup.POST("", deviceHandler.CreatePairing)
+			// 查询配对结果
+			pairingGroup.GET("/:code", deviceHandler.GetPairingResult)
+		}
+
+		// 设备路由组（需要认证中间件）
+		registerDeviceRoutes(apiGroup, middleware.AuthMiddleware(jwtSecret, deviceService), deviceHandler)
 	}
 
 	// WebSocket路由
@@ -93,6 +122,9 @@ func SetupRouter(httpHandler *handlers.HTTPHandler, wsHandler *handlers.WebSocke
 				"login":     "/api/auth/login (POST)",
 				"sendText":  "/api/message (POST)",
 				"sendImage": "/api/image (POST)",
+				"devices":   "/api/devices/status (GET)",
+				"pairing":   "/api/pairing (POST)",
+				"events":    "/api/events (GET, SSE)",
 				"websocket": "/ws (GET) 或 / (GET with Upgrade: websocket)",
 				"swagger":   "/swagger/index.html",
 			},
@@ -104,3 +136,24 @@ func SetupRouter(httpHandler *handlers.HTTPHandler, wsHandler *handlers.WebSocke
 
 	return router
 }
+
+// registerDeviceRoutes 注册设备路由组，auth为认证中间件
+// 查询类接口允许设备凭证访问，认领配对码、修改名称和撤销设备只允许用户JWT
+func registerDeviceRoutes(apiGroup *gin.RouterGroup, auth gin.HandlerFunc, deviceHandler *handlers.DeviceHandler) {
+	deviceGroup := apiGroup.Group("/devices")
+	deviceGroup.Use(auth)
+	{
+		// 获取设备在线状态
+		deviceGroup.GET("/status", deviceHandler.GetDeviceStatus)
+		// 获取在线设备
+		deviceGroup.GET("/online", deviceHandler.GetOnlineDevices)
+		// 获取设备列表
+		deviceGroup.GET("", deviceHandler.ListDevices)
+		// 认领配对码
+		deviceGroup.POST("/pair", middleware.RequireUserToken(), deviceHandler.ClaimPairing)
+		// 修改设备名称
+		deviceGroup.PATCH("/:id", middleware.RequireUserToken(), deviceHandler.RenameDevice)
+		// 撤销设备
+		deviceGroup.DELETE("/:id", middleware.RequireUserToken(), deviceHandler.RevokeDevice)
+	}
+}
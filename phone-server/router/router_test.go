@@ -0,0 +1,58 @@
+package router
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"phone-server/services"
+
+	"github.com/gin-gonic/gin"
+)
+
+// fakeAuth 代替AuthMiddleware：设备凭证在上下文中写入deviceID，其他Token视为用户JWT
+func fakeAuth(c *gin.Context) {
+	c.Set("userID", uint(1))
+	if services.IsDeviceToken(c.GetHeader("Authorization")) {
+		c.Set("deviceID", uint(1))
+	}
+	c.Next()
+}
+
+func TestDeviceManagementRequiresUserToken(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	engine := gin.New()
+	// 处理器为nil，请求一旦到达处理器就会panic，由Recovery转为500
+	engine.Use(gin.Recovery())
+	registerDeviceRoutes(engine.Group("/api"), fakeAuth, nil)
+
+	routes := []struct {
+		method string
+		path   string
+	}{
+		{http.MethodPost, "/api/devices/pair"},
+		{http.MethodPatch, "/api/devices/2"},
+		{http.MethodDelete, "/api/devices/2"},
+	}
+	for _, route := range routes {
+		t.Run(route.method+" "+route.path, func(t *testing.T) {
+			// 设备凭证被拒绝
+			recorder := httptest.NewRecorder()
+			request := httptest.NewRequest(route.method, route.path, nil)
+			request.Header.Set("Authorization", "dt_test")
+			engine.ServeHTTP(recorder, request)
+			if recorder.Code != http.StatusForbidden {
+				t.Fatalf("设备凭证请求的状态码 = %d，期望 403", recorder.Code)
+			}
+
+			// 用户JWT通过校验到达处理器
+			recorder = httptest.NewRecorder()
+			request = httptest.NewRequest(route.method, route.path, nil)
+			request.Header.Set("Authorization", "Bearer jwt")
+			engine.ServeHTTP(recorder, request)
+			if recorder.Code == http.StatusForbidden {
+				t.Fatal("用户JWT不应被拒绝")
+			}
+		})
+	}
+}
@@ -1,374 +1,408 @@
 package services
 
 import (
-	"bufio"
-	"bytes"
 	"context"
-	"encoding/json"
+	"errors"
 	"fmt"
-	"io"
-	"net/http"
+	"net"
 	"strings"
 	"time"
 
+	"phone-server/sse"
 	"phone-server/utils"
 )
 
-// AIService AI服务
-type AIService struct {
-	client   *http.Client
-	apiKey   string
-	baseURL  string
-	model    string
-	thinking string
+// DefaultImageMimeType 未指定图片类型时使用的MIME类型
+const DefaultImageMimeType = "image/jpeg"
+
+// ErrChatCancelled 对话被客户端主动取消，作为取消对话上下文的原因
+var ErrChatCancelled = errors.New("AI生成已被客户端取消")
+
+// ChatRole 对话消息的角色
+type ChatRole string
+
+const (
+	// ChatRoleSystem 系统提示
+	ChatRoleSystem ChatRole = "system"
+	// ChatRoleUser 用户消息
+	ChatRoleUser ChatRole = "user"
+	// ChatRoleAssistant AI回复
+	ChatRoleAssistant ChatRole = "assistant"
+)
+
+// ChatPartType 对话消息内容片段的类型
+type ChatPartType string
+
+const (
+	// ChatPartText 文本片段
+	ChatPartText ChatPartType = "text"
+	// ChatPartImage 图片片段
+	ChatPartImage ChatPartType = "image"
+)
+
+// ChatPart 对话消息的内容片段
+type ChatPart struct {
+	Type     ChatPartType // 片段类型
+	Text     string       // 文本内容，仅Type为text时有效
+	ImageURL string       // 图片地址或data URL，仅Type为image时有效
 }
 
-// NewAIService 创建AI服务实例
-func NewAIService(apiKey string, baseURL string, model string, thinking string) *AIService {
-	client := &http.Client{}
-	return &AIService{
-		client:   client,
-		apiKey:   apiKey,
-		baseURL:  baseURL,
-		model:    model,
-		thinking: thinking,
-	}
+// ChatMessage 对话消息，由一个或多个内容片段组成
+type ChatMessage struct {
+	Role  ChatRole   // 消息角色
+	Parts []ChatPart // 内容片段
 }
 
-// StreamResponseFunc 流式响应回调函数类型
-type StreamResponseFunc func(chunk string) error
+// 思考模式
+const (
+	// ThinkingEnabled 开启思考
+	ThinkingEnabled = "enabled"
+	// ThinkingDisabled 关闭思考
+	ThinkingDisabled = "disabled"
+	// ThinkingAuto 由模型自行决定是否思考
+	ThinkingAuto = "auto"
+)
 
-// SSEMessage 表示SSE消息结构（仅保留实际使用的Data字段）
-type SSEMessage struct {
-	Data string `json:"data,omitempty"`
+// IsValidThinkingMode 检查思考模式是否有效
+func IsValidThinkingMode(mode string) bool {
+	return mode == ThinkingEnabled || mode == ThinkingDisabled || mode == ThinkingAuto
 }
 
-// ChatWithText 与AI进行文本对话（流式）
-func (s *AIService) ChatWithText(ctx context.Context, content string, streamCallback StreamResponseFunc) error {
-	// 记录请求开始时间
-	startTime := time.Now()
+// ChatRequest 一次对话请求
+type ChatRequest struct {
+	Model    string        // 使用的模型，为空时使用默认模型
+	Thinking string        // 思考模式，为空时使用提供方配置的思考模式
+	Messages []ChatMessage // 对话消息，按时间顺序排列
+}
 
-	utils.Infofc(ctx, "[AI_REQUEST] 开始发送文本到AI，内容: %s", content)
+// ChunkType 流式响应片段的类型
+type ChunkType string
 
-	// 构建请求URL
-	url := fmt.Sprintf("%s/chat/completions", s.baseURL)
-	if !strings.HasPrefix(url, "http") {
-		url = "https://" + url
-	}
+const (
+	// ChunkContent 回答内容
+	ChunkContent ChunkType = "content"
+	// ChunkReasoning 思考过程
+	ChunkReasoning ChunkType = "reasoning"
+)
 
-	// 构建请求体
-	reqBody := map[string]interface{}{
-		"model": s.model,
-		"messages": []map[string]string{
-			{
-				"role":    "user",
-				"content": content,
-			},
-		},
-		"thinking": map[string]string{
-			"type": s.thinking,
-		},
-		"stream": true,
-	}
+// StreamChunk 流式响应片段
+type StreamChunk struct {
+	Type ChunkType // 片段类型
+	Text string    // 片段内容
+}
 
-	// 转换为JSON
-	jsonData, err := json.Marshal(reqBody)
-	if err != nil {
-		utils.Errorf("JSON编码失败: %v", err)
-		return err
+// TextPart 创建文本片段
+func TextPart(text string) ChatPart {
+	return ChatPart{Type: ChatPartText, Text: text}
+}
+
+// ImagePart 创建图片片段，mime为空时按image/jpeg处理
+func ImagePart(mime string, imageBase64 string) ChatPart {
+	if mime == "" {
+		mime = DefaultImageMimeType
 	}
+	return ChatPart{Type: ChatPartImage, ImageURL: fmt.Sprintf("data:%s;base64,%s", mime, imageBase64)}
+}
 
-	// 记录请求详细信息
-	utils.Debugfc(ctx, "[AI_REQUEST] 请求URL: %s, 请求体: %s", url, string(jsonData))
+// ImageURLPart 使用图片地址或data URL创建图片片段
+func ImageURLPart(url string) ChatPart {
+	return ChatPart{Type: ChatPartImage, ImageURL: url}
+}
 
-	// 创建HTTP请求
-	req, err := http.NewRequestWithContext(ctx, "POST", url, bytes.NewBuffer(jsonData))
-	if err != nil {
-		utils.Errorf("创建请求失败: %v", err)
-		return err
-	}
+// NewChatMessage 创建对话消息
+func NewChatMessage(role ChatRole, parts ...ChatPart) ChatMessage {
+	return ChatMessage{Role: role, Parts: parts}
+}
 
-	// 设置请求头
-	req.Header.Set("Content-Type", "application/json")
-	req.Header.Set("Authorization", fmt.Sprintf("Bearer %s", s.apiKey))
-	req.Header.Set("Accept", "text/event-stream")
-	req.Header.Set("Cache-Control", "no-cache")
-	req.Header.Set("Connection", "keep-alive")
+// Text 拼接消息中的所有文本片段
+func (m ChatMessage) Text() string {
+	var text strings.Builder
+	for _, part := range m.Parts {
+		if part.Type == ChatPartText {
+			text.WriteString(part.Text)
+		}
+	}
+	return text.String()
+}
 
-	// 发送请求
-	resp, err := s.client.Do(req)
-	if err != nil {
-		utils.Errorfc(ctx, "[AI_REQUEST] 发送请求失败: %v, 耗时: %v", err, time.Since(startTime))
-		return err
+// ImageCount 消息中的图片数量
+func (m ChatMessage) ImageCount() int {
+	count := 0
+	for _, part := range m.Parts {
+		if part.Type == ChatPartImage {
+			count++
+		}
 	}
-	defer resp.Body.Close()
+	return count
+}
 
-	// 检查响应状态
-	if resp.StatusCode != http.StatusOK {
-		utils.Errorfc(ctx, "[AI_REQUEST] 请求失败，状态码: %d, 耗时: %v", resp.StatusCode, time.Since(startTime))
-		return fmt.Errorf("请求失败，状态码: %d", resp.StatusCode)
+// FirstImageURL 消息中第一张图片的地址，没有图片时返回空字符串
+func (m ChatMessage) FirstImageURL() string {
+	for _, part := range m.Parts {
+		if part.Type == ChatPartImage {
+			return part.ImageURL
+		}
 	}
+	return ""
+}
 
-	// 记录响应状态
-	utils.Infofc(ctx, "[AI_REQUEST] 请求成功，状态码: %d, 耗时: %v", resp.StatusCode, time.Since(startTime))
+// maxRetryBackoff 重试等待时间的上限
+const maxRetryBackoff = 10 * time.Second
 
-	// 处理SSE响应
-	utils.Infofc(ctx, "[AI_RESPONSE] 开始接收AI流式响应")
+// ErrAIUnavailable 所有上游均处于熔断中，没有可用的上游
+var ErrAIUnavailable = errors.New("AI服务暂时不可用")
 
-	// 创建SSE解析器
-	reader := bufio.NewReader(resp.Body)
-	var buffer string
+// AIService AI服务，按模型选择对话服务提供方
+// 请求的模型不可用时依次切换到备用模型，限流、服务端错误和响应超时在输出第一个片段前按指数退避重试
+type AIService struct {
+	providers         map[string]ChatProvider // 按名称索引的对话服务提供方
+	defaultProvider   string                  // 未单独指定提供方的模型使用的提供方
+	modelProviders    map[string]string       // 按模型指定的提供方
+	catalog           *ModelCatalog           // 模型目录，包含默认模型
+	fallbackModels    []string                // 按顺序尝试的备用模型
+	maxRetries        int                     // 同一上游的最大重试次数
+	retryBackoff      time.Duration           // 首次重试前的等待时间，之后每次翻倍
+	breaker           *CircuitBreaker         // 上游熔断器
+	firstTokenTimeout time.Duration           // 发出请求后等待首个片段的超时时间
+	idleTimeout       time.Duration           // 两个片段之间的最大间隔
+}
 
-	for {
-		line, err := reader.ReadString('\n')
-		if err != nil {
-			if err == io.EOF {
-				// 流式响应结束
-				utils.Infofc(ctx, "[AI_RESPONSE] AI流式响应结束，总耗时: %v", time.Since(startTime))
-				break
-			}
-			utils.Errorfc(ctx, "[AI_RESPONSE] 读取响应失败: %v", err)
-			return err
-		}
+// ChatResult 对话结果
+type ChatResult struct {
+	Provider string // 最后使用的提供方
+	Model    string // 最后使用的模型
+	Usage    Usage  // token用量，上游未返回时按内容长度估算；未输出任何片段的失败请求为零值
+}
 
-		// 添加到缓冲区
-		buffer += line
-
-		// 检查完整SSE事件（以两个换行符结束）
-		if strings.HasSuffix(buffer, "\n\n") {
-			// 解析SSE事件
-			lines := strings.Split(buffer, "\n")
-
-			var sseMessage SSEMessage
-			for _, l := range lines {
-				if l == "" {
-					continue
-				}
-
-				parts := strings.SplitN(l, ": ", 2)
-				if len(parts) != 2 {
-					continue
-				}
-
-				key := parts[0]
-				value := parts[1]
-
-				// 只处理data字段，其他字段暂时不需要
-				if key == "data" {
-					sseMessage.Data = value
-				}
-			}
-
-			// 处理SSE数据
-			if sseMessage.Data != "" {
-				if sseMessage.Data == "[DONE]" {
-					// 流式结束标记
-					break
-				}
-
-				// 解析AI响应数据
-				var aiResponse struct {
-					Choices []struct {
-						Delta struct {
-							Content string `json:"content"`
-						} `json:"delta"`
-					} `json:"choices"`
-				}
-
-				if err := json.Unmarshal([]byte(sseMessage.Data), &aiResponse); err != nil {
-					utils.Errorfc(ctx, "[AI_RESPONSE] 解析AI响应失败: %v", err)
-					continue
-				}
-
-				// 提取内容并调用回调
-				if len(aiResponse.Choices) > 0 {
-					chunk := aiResponse.Choices[0].Delta.Content
-					if chunk != "" {
-						if err := streamCallback(chunk); err != nil {
-							utils.Errorfc(ctx, "[AI_RESPONSE] 流式响应回调处理失败: %v", err)
-							return err
-						}
-					}
-				}
-			}
-
-			// 重置缓冲区
-			buffer = ""
-		}
-	}
+// chatUpstream 对话上游，即提供方和模型的组合
+type chatUpstream struct {
+	provider ChatProvider
+	model    string
+}
 
-	return nil
+// key 上游标识，用于熔断器记录健康状态
+func (u chatUpstream) key() string {
+	return u.provider.Name() + "/" + u.model
 }
 
-// ChatWithImage 与AI进行图片对话（流式）
-func (s *AIService) ChatWithImage(ctx context.Context, imageBase64 string, content string, streamCallback StreamResponseFunc) error {
-	// 记录请求开始时间
-	startTime := time.Now()
+// NewAIService 创建AI服务实例
+func NewAIService(providers map[string]ChatProvider, defaultProvider string, modelProviders map[string]string, catalog *ModelCatalog,
+	fallbackModels []string, maxRetries int, retryBackoff time.Duration, breaker *CircuitBreaker,
+	firstTokenTimeout time.Duration, idleTimeout time.Duration) *AIService {
+	return &AIService{
+		providers:         providers,
+		defaultProvider:   defaultProvider,
+		modelProviders:    modelProviders,
+		catalog:           catalog,
+		fallbackModels:    fallbackModels,
+		maxRetries:        maxRetries,
+		retryBackoff:      retryBackoff,
+		breaker:           breaker,
+		firstTokenTimeout: firstTokenTimeout,
+		idleTimeout:       idleTimeout,
+	}
+}
 
-	utils.Infofc(ctx, "[AI_REQUEST] 开始发送图片和文本到AI")
+// Model 获取默认模型名称
+func (s *AIService) Model() string {
+	return s.catalog.Default()
+}
 
-	// 构建请求URL
-	url := fmt.Sprintf("%s/chat/completions", s.baseURL)
-	if !strings.HasPrefix(url, "http") {
-		url = "https://" + url
+// Provider 获取模型对应的对话服务提供方
+func (s *AIService) Provider(model string) (ChatProvider, error) {
+	name, ok := s.modelProviders[model]
+	if !ok {
+		name = s.defaultProvider
 	}
-
-	// 构建请求体
-	reqBody := map[string]interface{}{
-		"model": s.model,
-		"messages": []map[string]interface{}{
-			{
-				"role": "user",
-				"multi_content": []map[string]interface{}{
-					{
-						"type": "text",
-						"text": content,
-					},
-					{
-						"type": "image_url",
-						"image_url": map[string]string{
-							"url": fmt.Sprintf("data:image/jpeg;base64,%s", imageBase64),
-						},
-					},
-				},
-			},
-		},
-		"stream": true,
+	provider, ok := s.providers[name]
+	if !ok {
+		return nil, fmt.Errorf("未配置AI服务提供方: %s", name)
 	}
+	return provider, nil
+}
 
-	// 添加thinking参数
-	if s.thinking != "" {
-		reqBody["thinking"] = s.thinking
-		utils.Infofc(ctx, "[AI_REQUEST] 设置AI思考模式: %s", s.thinking)
-	}
+// StreamResponseFunc 流式响应回调函数类型，回答内容和思考过程以片段类型区分
+type StreamResponseFunc func(chunk StreamChunk) error
 
-	// 转换为JSON
-	jsonData, err := json.Marshal(reqBody)
-	if err != nil {
-		utils.Errorf("JSON编码失败: %v", err)
-		return err
-	}
+// ChatWithText 与AI进行文本对话（流式）
+func (s *AIService) ChatWithText(ctx context.Context, content string, streamCallback StreamResponseFunc) error {
+	_, err := s.Chat(ctx, ChatRequest{
+		Messages: []ChatMessage{NewChatMessage(ChatRoleUser, TextPart(content))},
+	}, streamCallback)
+	return err
+}
 
-	// 记录请求详细信息
-	utils.Debugfc(ctx, "[AI_REQUEST] 请求URL: %s, 请求体: %s", url, string(jsonData))
+// ChatWithImage 与AI进行图片对话（流式）
+func (s *AIService) ChatWithImage(ctx context.Context, imageBase64 string, content string, streamCallback StreamResponseFunc) error {
+	_, err := s.Chat(ctx, ChatRequest{
+		Messages: []ChatMessage{NewChatMessage(ChatRoleUser, TextPart(content), ImagePart("", imageBase64))},
+	}, streamCallback)
+	return err
+}
 
-	// 创建HTTP请求
-	req, err := http.NewRequestWithContext(ctx, "POST", url, bytes.NewBuffer(jsonData))
+// Chat 与AI进行对话（流式），所有对话请求的统一入口
+// 依次尝试请求的模型和备用模型，熔断中的上游会被跳过；只有可重试的错误在重试用尽后切换上游，已输出片段后出错或其他错误直接返回
+// 请求的模型不在模型目录中或不支持请求内容时返回包装了ErrUnsupportedModel的错误
+// 上游未在流中返回token用量时按请求和已输出的内容估算
+func (s *AIService) Chat(ctx context.Context, request ChatRequest, streamCallback StreamResponseFunc) (ChatResult, error) {
+	model := request.Model
+	if model == "" {
+		model = s.catalog.Default()
+	}
+	result := ChatResult{Model: model}
+	if len(request.Messages) == 0 {
+		return result, errors.New("对话消息不能为空")
+	}
+	if err := s.catalog.Check(model, request); err != nil {
+		return result, err
+	}
+	upstreams, err := s.upstreams(ctx, model, request)
 	if err != nil {
-		utils.Errorfc(ctx, "[AI_REQUEST] 创建请求失败: %v", err)
-		return err
+		return result, err
 	}
 
-	// 设置请求头
-	req.Header.Set("Content-Type", "application/json")
-	req.Header.Set("Authorization", fmt.Sprintf("Bearer %s", s.apiKey))
-	req.Header.Set("Accept", "text/event-stream")
-	req.Header.Set("Cache-Control", "no-cache")
-	req.Header.Set("Connection", "keep-alive")
+	// 记录请求开始时间
+	startTime := time.Now()
 
-	// 发送请求
-	resp, err := s.client.Do(req)
-	if err != nil {
-		utils.Errorfc(ctx, "[AI_REQUEST] 发送请求失败: %v, 耗时: %v", err, time.Since(startTime))
-		return err
-	}
-	defer resp.Body.Close()
+	last := request.Messages[len(request.Messages)-1]
+	utils.Infofc(ctx, "[AI_REQUEST] 开始发送对话到AI，模型: %s, 思考模式: %s, 消息数: %d, 图片数: %d, 内容: %s",
+		model, request.Thinking, len(request.Messages), last.ImageCount(), last.Text())
 
-	// 检查响应状态
-	if resp.StatusCode != http.StatusOK {
-		utils.Errorfc(ctx, "[AI_REQUEST] 请求失败，状态码: %d, 耗时: %v", resp.StatusCode, time.Since(startTime))
-		return fmt.Errorf("请求失败，状态码: %d", resp.StatusCode)
+	// 收集已输出的内容，用于估算用量
+	var completion strings.Builder
+	collectCallback := func(chunk StreamChunk) error {
+		completion.WriteString(chunk.Text)
+		return streamCallback(chunk)
 	}
 
-	// 记录响应状态
-	utils.Infofc(ctx, "[AI_REQUEST] 请求成功，状态码: %d, 耗时: %v", resp.StatusCode, time.Since(startTime))
+	lastErr := ErrAIUnavailable
+	for i, upstream := range upstreams {
+		if !s.breaker.Allow(upstream.key()) {
+			utils.Warnfc(ctx, "[AI_FAILOVER] 上游 %s 处于熔断中，跳过", upstream.key())
+			continue
+		}
+		result = ChatResult{Provider: upstream.provider.Name(), Model: upstream.model}
+
+		started, usage, err := s.chatWithRetry(ctx, upstream, request, collectCallback)
+		if started && usage.IsZero() {
+			usage = estimateUsage(request, completion.String())
+		}
+		result.Usage = usage
+		if err == nil {
+			utils.Infofc(ctx, "[AI_RESPONSE] AI流式响应结束，上游: %s, 输入: %d tokens, 输出: %d tokens, 估算: %t, 总耗时: %v",
+				upstream.key(), usage.PromptTokens, usage.CompletionTokens, usage.Estimated, time.Since(startTime))
+			return result, nil
+		}
+		if started || ctx.Err() != nil || !isRetryable(err) {
+			utils.Errorfc(ctx, "[AI_RESPONSE] AI对话失败: %v, 上游: %s, 耗时: %v", err, upstream.key(), time.Since(startTime))
+			return result, err
+		}
+		if i+1 < len(upstreams) {
+			utils.Warnfc(ctx, "[AI_FAILOVER] 上游 %s 请求失败: %v, 切换到上游 %s", upstream.key(), err, upstreams[i+1].key())
+		}
+		lastErr = err
+	}
 
-	// 处理SSE响应
-	utils.Infofc(ctx, "[AI_RESPONSE] 开始接收AI流式响应")
+	utils.Errorfc(ctx, "[AI_RESPONSE] 所有上游均不可用: %v, 耗时: %v", lastErr, time.Since(startTime))
+	return result, lastErr
+}
 
-	// 创建SSE解析器
-	reader := bufio.NewReader(resp.Body)
-	var buffer string
+// chatWithRetry 向单个上游发送对话请求
+// 限流、服务端错误、网络错误和响应超时按指数退避重试，直到达到最大重试次数、上游被熔断或已输出片段
+// 返回是否已经输出过片段（包括思考过程）和上游返回的token用量
+func (s *AIService) chatWithRetry(ctx context.Context, upstream chatUpstream, request ChatRequest, streamCallback StreamResponseFunc) (bool, Usage, error) {
+	started := false
+	trackCallback := func(chunk StreamChunk) error {
+		started = true
+		return streamCallback(chunk)
+	}
 
-	for {
-		line, err := reader.ReadString('\n')
-		if err != nil {
-			if err == io.EOF {
-				// 流式响应结束
-				utils.Infofc(ctx, "[AI_RESPONSE] AI流式响应结束，总耗时: %v", time.Since(startTime))
-				break
-			}
-			utils.Errorfc(ctx, "[AI_RESPONSE] 读取响应失败: %v", err)
-			return err
+	for attempt := 0; ; attempt++ {
+		attemptCtx, watchdog := newStreamWatchdog(ctx, s.firstTokenTimeout, s.idleTimeout)
+		usage, err := upstream.provider.Chat(attemptCtx, upstream.model, request, watchdog.wrap(trackCallback))
+		if timeoutErr := watchdog.stop(attemptCtx); timeoutErr != nil && err != nil {
+			err = timeoutErr
+		}
+		if err == nil {
+			s.breaker.Success(upstream.key())
+			return started, usage, nil
+		}
+		// 调用方取消或非上游原因的错误不计入熔断
+		if ctx.Err() != nil || !isRetryable(err) {
+			s.breaker.Release(upstream.key())
+			return started, usage, err
+		}
+		if s.breaker.Failure(upstream.key()) {
+			utils.Warnfc(ctx, "[AI_FAILOVER] 上游 %s 连续失败，熔断冷却中", upstream.key())
+			return started, usage, err
+		}
+		if started || attempt >= s.maxRetries {
+			return started, usage, err
 		}
 
-		// 添加到缓冲区
-		buffer += line
-
-		// 检查完整SSE事件（以两个换行符结束）
-		if strings.HasSuffix(buffer, "\n\n") {
-			// 解析SSE事件
-			lines := strings.Split(buffer, "\n")
-
-			var sseMessage SSEMessage
-			for _, l := range lines {
-				if l == "" {
-					continue
-				}
-
-				parts := strings.SplitN(l, ": ", 2)
-				if len(parts) != 2 {
-					continue
-				}
-
-				key := parts[0]
-				value := parts[1]
-
-				// 只处理data字段，其他字段暂时不需要
-				if key == "data" {
-					sseMessage.Data = value
-				}
-			}
-
-			// 处理SSE数据
-			if sseMessage.Data != "" {
-				if sseMessage.Data == "[DONE]" {
-					// 流式结束标记
-					break
-				}
-
-				// 解析AI响应数据
-				var aiResponse struct {
-					Choices []struct {
-						Delta struct {
-							Content string `json:"content"`
-						} `json:"delta"`
-					} `json:"choices"`
-				}
-
-				if err := json.Unmarshal([]byte(sseMessage.Data), &aiResponse); err != nil {
-					utils.Errorfc(ctx, "[AI_RESPONSE] 解析AI响应失败: %v", err)
-					continue
-				}
-
-				// 提取内容并调用回调
-				if len(aiResponse.Choices) > 0 {
-					chunk := aiResponse.Choices[0].Delta.Content
-					if chunk != "" {
-						if err := streamCallback(chunk); err != nil {
-							utils.Errorfc(ctx, "[AI_RESPONSE] 流式响应回调处理失败: %v", err)
-							return err
-						}
-					}
-				}
-			}
-
-			// 重置缓冲区
-			buffer = ""
+		backoff := min(s.retryBackoff<<attempt, maxRetryBackoff)
+		utils.Warnfc(ctx, "[AI_RETRY] 上游 %s 请求失败: %v, %v后进行第%d次重试", upstream.key(), err, backoff, attempt+1)
+		select {
+		case <-ctx.Done():
+			return started, usage, ctx.Err()
+		case <-time.After(backoff):
 		}
 	}
+}
+
+// CheckRequest 检查请求的模型是否在模型目录中且支持请求内容，未指定模型时检查默认模型
+// 不符合时返回包装了ErrUnsupportedModel的错误
+func (s *AIService) CheckRequest(request ChatRequest) error {
+	model := request.Model
+	if model == "" {
+		model = s.catalog.Default()
+	}
+	return s.catalog.Check(model, request)
+}
 
-	return nil
+// Catalog 获取模型目录
+func (s *AIService) Catalog() *ModelCatalog {
+	return s.catalog
 }
 
+// upstreams 获取依次尝试的上游：请求的模型在前，之后是未重复且支持请求内容的备用模型
+func (s *AIService) upstreams(ctx context.Context, model string, request ChatRequest) ([]chatUpstream, error) {
+	provider, err := s.Provider(model)
+	if err != nil {
+		return nil, err
+	}
+	upstreams := []chatUpstream{{provider: provider, model: model}}
+	for _, fallback := range s.fallbackModels {
+		if fallback == model {
+			continue
+		}
+		// 不向不支持图片的模型发送图片
+		if err := s.catalog.Check(fallback, request); err != nil {
+			utils.Debugfc(ctx, "[AI_FAILOVER] 跳过备用模型: %v", err)
+			continue
+		}
+		provider, err := s.Provider(fallback)
+		if err != nil {
+			return nil, err
+		}
+		upstreams = append(upstreams, chatUpstream{provider: provider, model: fallback})
+	}
+	return upstreams, nil
+}
 
+// isRetryable 判断错误是否可以重试：上游限流或服务端错误（包括流中返回的错误事件）、响应超时，以及网络错误
+func isRetryable(err error) bool {
+	if errors.Is(err, ErrStreamTimeout) {
+		return true
+	}
+	var upstreamErr *UpstreamError
+	if errors.As(err, &upstreamErr) {
+		return upstreamErr.Retryable()
+	}
+	var errEvent *sse.ErrorEvent
+	if errors.As(err, &errEvent) {
+		return errEvent.Retryable()
+	}
+	var netErr net.Error
+	return errors.As(err, &netErr)
+}
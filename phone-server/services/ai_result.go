@@ -0,0 +1,79 @@
+package services
+
+import (
+	"errors"
+
+	"phone-server/models"
+
+	"gorm.io/gorm"
+)
+
+// ErrAIResultNotFound AI结果不存在或不属于当前用户
+var ErrAIResultNotFound = errors.New("AI结果不存在")
+
+// AIResultService AI结果服务，保存每次生成的回答，并提供历史查询和转发
+type AIResultService struct {
+	db     *gorm.DB // 数据库连接
+	broker Broker   // 消息广播服务
+}
+
+// NewAIResultService 创建AI结果服务实例
+func NewAIResultService(db *gorm.DB, broker Broker) *AIResultService {
+	return &AIResultService{
+		db:     db,
+		broker: broker,
+	}
+}
+
+// Save 保存一次生成的结果
+func (s *AIResultService) Save(result *models.AIResult) error {
+	return s.db.Create(result).Error
+}
+
+// List 按时间倒序查询用户的AI结果
+// conversationID不为0时仅查询该会话，beforeID不为0时仅查询ID小于beforeID的结果，用于翻页
+func (s *AIResultService) List(userID uint, conversationID uint, beforeID uint, limit int) ([]models.AIResult, error) {
+	query := s.db.Where("user_id = ?", userID)
+	if conversationID != 0 {
+		query = query.Where("conversation_id = ?", conversationID)
+	}
+	if beforeID != 0 {
+		query = query.Where("id < ?", beforeID)
+	}
+
+	var results []models.AIResult
+	if err := query.Order("id DESC").Limit(limit).Find(&results).Error; err != nil {
+		return nil, err
+	}
+	return results, nil
+}
+
+// Get 按提问消息ID查询AI结果及其提问消息
+func (s *AIResultService) Get(userID uint, messageID uint) (*models.AIResult, error) {
+	var result models.AIResult
+	err := s.db.Preload("Message").Where("message_id = ? AND user_id = ?", messageID, userID).First(&result).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, ErrAIResultNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &result, nil
+}
+
+// Resend 将AI结果的回答作为新消息转发给指定设备
+func (s *AIResultService) Resend(userID uint, messageID uint, senderDeviceID uint, target string, targetDeviceID uint) (*models.Message, error) {
+	result, err := s.Get(userID, messageID)
+	if err != nil {
+		return nil, err
+	}
+
+	message := models.NewTextMessage(userID, result.Content, models.SenderTypeServer).
+		RouteTo(senderDeviceID, target, targetDeviceID)
+	if err := s.db.Create(message).Error; err != nil {
+		return nil, err
+	}
+
+	s.broker.BroadcastMessage(message, userID)
+	return message, nil
+}
@@ -0,0 +1,73 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"slices"
+	"testing"
+	"time"
+)
+
+// stubProvider 按模型返回预设错误的对话服务提供方，记录被请求的模型
+type stubProvider struct {
+	errs  map[string]error // 每个模型返回的错误，未配置的模型输出一个片段后成功
+	calls []string         // 依次被请求的模型
+}
+
+// Name 提供方名称
+func (p *stubProvider) Name() string {
+	return "stub"
+}
+
+// Chat 返回模型预设的错误
+func (p *stubProvider) Chat(ctx context.Context, model string, request ChatRequest, streamCallback StreamResponseFunc) (Usage, error) {
+	p.calls = append(p.calls, model)
+	if err := p.errs[model]; err != nil {
+		return Usage{}, err
+	}
+	return Usage{}, streamCallback(StreamChunk{Text: "ok"})
+}
+
+// newStubAIService 创建以primary为默认模型、backup为备用模型的AI服务，不重试
+func newStubAIService(provider *stubProvider) *AIService {
+	catalog := NewModelCatalog([]ModelInfo{{Name: "primary", Provider: "stub"}, {Name: "backup", Provider: "stub"}}, "primary")
+	return NewAIService(map[string]ChatProvider{"stub": provider}, "stub",
+		map[string]string{"primary": "stub", "backup": "stub"}, catalog,
+		[]string{"backup"}, 0, time.Millisecond, NewCircuitBreaker(5, time.Minute), time.Second, time.Second)
+}
+
+func TestChatFailover(t *testing.T) {
+	tests := []struct {
+		name  string
+		err   error
+		calls []string
+		fails bool
+	}{
+		{name: "可重试的错误切换到备用模型", err: &UpstreamError{StatusCode: 503}, calls: []string{"primary", "backup"}},
+		{name: "限流切换到备用模型", err: &UpstreamError{StatusCode: 429}, calls: []string{"primary", "backup"}},
+		{name: "认证错误直接返回", err: &UpstreamError{StatusCode: 401}, calls: []string{"primary"}, fails: true},
+		{name: "请求错误直接返回", err: &UpstreamError{StatusCode: 400}, calls: []string{"primary"}, fails: true},
+		{name: "其他错误直接返回", err: errors.New("解析响应失败"), calls: []string{"primary"}, fails: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			provider := &stubProvider{errs: map[string]error{"primary": tt.err}}
+			result, err := newStubAIService(provider).Chat(context.Background(), ChatRequest{
+				Messages: []ChatMessage{NewChatMessage(ChatRoleUser, TextPart("hi"))},
+			}, func(StreamChunk) error { return nil })
+
+			if !slices.Equal(provider.calls, tt.calls) {
+				t.Fatalf("请求的模型 = %v，期望 %v", provider.calls, tt.calls)
+			}
+			if tt.fails {
+				if !errors.Is(err, tt.err) {
+					t.Fatalf("err = %v，期望 %v", err, tt.err)
+				}
+				return
+			}
+			if err != nil || result.Model != "backup" {
+				t.Fatalf("Chat = %+v, %v，期望由备用模型回答", result, err)
+			}
+		})
+	}
+}
@@ -1,139 +1,145 @@
 package services
 
 import (
-	"encoding/json"
-	"sync"
+	"sync/atomic"
+	"time"
 
 	"phone-server/models"
-	"phone-server/utils"
 
 	"github.com/gorilla/websocket"
 )
 
-// Broker 消息广播服务
-type Broker struct {
-	clients    map[uint]map[*websocket.Conn]bool // 客户端连接集合，按用户ID分组
-	clientsMux sync.Mutex                        // 保护clients的互斥锁
-	register   chan struct {
-		client *websocket.Conn
-		userID uint
-	}                                            // 注册客户端的通道
-	unregister chan struct {
-		client *websocket.Conn
-		userID uint
-	}                                            // 注销客户端的通道
-	broadcast  chan struct {
-		message *models.Message
-		userID  uint
-	}                                            // 广播消息的通道
+// Broker 消息广播服务，将消息和事件投递给用户在线的客户端
+// MemoryBroker仅投递给本进程内的连接；MeshBroker在此基础上将广播转发给其他节点，用于多实例部署
+type Broker interface {
+	// Start 启动消息广播服务，阻塞运行
+	Start()
+	// RegisterClient 注册设备的WebSocket客户端，并启动该连接的写协程
+	RegisterClient(conn *websocket.Conn, device *models.Device, protocol int, replay bool) *Client
+	// Subscribe 注册不经由WebSocket传输的订阅者（如SSE）
+	Subscribe(device *models.Device, remoteAddr string, protocol int, replay bool) *Client
+	// UnregisterClient 注销客户端
+	UnregisterClient(client *Client)
+	// BroadcastMessage 按消息的投递目标广播给特定用户的客户端
+	BroadcastMessage(message *models.Message, userID uint)
+	// BroadcastEvent 广播事件给特定用户的目标客户端
+	BroadcastEvent(event Event, userID uint, target BroadcastTarget)
+	// DisconnectDevice 断开设备的所有连接，用于撤销设备
+	DisconnectDevice(userID uint, deviceID uint)
+
+	// GetClientCount 获取本节点当前客户端连接数
+	GetClientCount() int
+	// GetClientCountByUserID 获取本节点上特定用户的客户端连接数
+	GetClientCountByUserID(userID uint) int
+	// GetClientCountByDeviceType 获取本节点上特定用户某类设备的客户端连接数
+	GetClientCountByDeviceType(userID uint, deviceType string) int
+	// GetClientStatsByUserID 获取本节点上特定用户各连接的发送队列统计信息
+	GetClientStatsByUserID(userID uint) []ClientStats
+	// GetQueuedMessageCount 获取本节点所有连接发送队列中待发送的消息总数
+	GetQueuedMessageCount() int
+	// GetDroppedMessageCount 获取因发送队列积压而丢弃的消息总数
+	GetDroppedMessageCount() uint64
+	// GetSlowConsumerDisconnectCount 获取因发送队列积压而断开的连接总数
+	GetSlowConsumerDisconnectCount() uint64
 }
 
-// NewBroker 创建消息广播服务实例
-func NewBroker() *Broker {
-	return &Broker{
-		clients:    make(map[uint]map[*websocket.Conn]bool),
-		register:   make(chan struct{ client *websocket.Conn; userID uint }),
-		unregister: make(chan struct{ client *websocket.Conn; userID uint }),
-		broadcast:  make(chan struct{ message *models.Message; userID uint }),
-	}
+// BrokerConfig 消息广播服务配置
+type BrokerConfig struct {
+	SendQueueSize      int                // 每个连接的发送队列长度
+	WriteTimeout       time.Duration      // 单次写入超时时间
+	SlowConsumerPolicy SlowConsumerPolicy // 慢消费者处理策略
+	PingInterval       time.Duration      // 心跳Ping发送间隔
 }
 
-// Start 启动消息广播服务
-func (b *Broker) Start() {
-	for {
-		select {
-		// 注册新客户端
-		case reg := <-b.register:
-			b.clientsMux.Lock()
-			// 如果用户ID对应的客户端映射不存在，则创建
-			if _, ok := b.clients[reg.userID]; !ok {
-				b.clients[reg.userID] = make(map[*websocket.Conn]bool)
-			}
-			// 将客户端添加到用户ID对应的映射中
-			b.clients[reg.userID][reg.client] = true
-			b.clientsMux.Unlock()
-			utils.Infof("用户 %d 的ws客户端:%s已连接", reg.userID, reg.client.RemoteAddr().String())
-
-		// 注销客户端
-		case unreg := <-b.unregister:
-			b.clientsMux.Lock()
-			// 检查用户ID对应的客户端映射是否存在
-			if clientMap, ok := b.clients[unreg.userID]; ok {
-				// 检查客户端是否存在于映射中
-				if _, ok := clientMap[unreg.client]; ok {
-					// 移除客户端并关闭连接
-					delete(clientMap, unreg.client)
-					unreg.client.Close()
-					utils.Infof("用户 %d 的ws客户端:%s已断开连接", unreg.userID, unreg.client.RemoteAddr().String())
-					// 如果用户ID对应的客户端映射为空，则删除该映射
-					if len(clientMap) == 0 {
-						delete(b.clients, unreg.userID)
-					}
-				}
-			}
-			b.clientsMux.Unlock()
-
-		// 广播消息给特定用户的所有客户端
-		case msg := <-b.broadcast:
-			b.clientsMux.Lock()
-
-			// 将消息序列化为JSON
-			msgBytes, err := json.Marshal(msg.message)
-			if err != nil {
-				utils.Errorf("消息序列化失败: %v", err)
-				b.clientsMux.Unlock()
-				continue
-			}
-
-			// 发送消息给特定用户的所有客户端
-			if clientMap, ok := b.clients[msg.userID]; ok {
-				for client := range clientMap {
-					if err := client.WriteMessage(websocket.TextMessage, msgBytes); err != nil {
-						utils.Errorf("发送消息失败: %v", err)
-						// 发送失败，关闭连接并从集合中移除
-						client.Close()
-						delete(clientMap, client)
-					}
-				}
-				utils.Infof("已向用户 %d 广播消息，类型: %s，客户端数: %d", msg.userID, msg.message.Type, len(clientMap))
-			}
-			b.clientsMux.Unlock()
-		}
-	}
+// brokerStats 消息广播服务统计信息
+type brokerStats struct {
+	droppedMessages         atomic.Uint64 // 因队列积压丢弃的消息数
+	slowConsumerDisconnects atomic.Uint64 // 因队列积压断开的连接数
+}
+
+// BroadcastTarget 广播投递目标，语义与models.Message的Target字段一致
+type BroadcastTarget struct {
+	Target         string `json:"target"`           // 投递目标：all/others/pc/phone/device
+	DeviceID       uint   `json:"device_id"`        // Target为device时的目标设备ID
+	SenderDeviceID uint   `json:"sender_device_id"` // 发送设备ID，Target为others时排除该设备
 }
 
-// RegisterClient 注册WebSocket客户端
-func (b *Broker) RegisterClient(client *websocket.Conn, userID uint) {
-	b.register <- struct{ client *websocket.Conn; userID uint }{client: client, userID: userID}
+// TargetAll 投递给用户的所有设备
+func TargetAll() BroadcastTarget {
+	return BroadcastTarget{Target: models.MessageTargetAll}
 }
 
-// UnregisterClient 注销WebSocket客户端
-func (b *Broker) UnregisterClient(client *websocket.Conn, userID uint) {
-	b.unregister <- struct{ client *websocket.Conn; userID uint }{client: client, userID: userID}
+// TargetOthers 投递给除发送设备外的所有设备
+func TargetOthers(senderDeviceID uint) BroadcastTarget {
+	return BroadcastTarget{Target: models.MessageTargetOthers, SenderDeviceID: senderDeviceID}
 }
 
-// BroadcastMessage 广播消息给特定用户的所有客户端
-func (b *Broker) BroadcastMessage(message *models.Message, userID uint) {
-	b.broadcast <- struct{ message *models.Message; userID uint }{message: message, userID: userID}
+// TargetDeviceType 仅投递给指定类型的设备
+func TargetDeviceType(deviceType string) BroadcastTarget {
+	return BroadcastTarget{Target: deviceType}
 }
 
-// GetClientCount 获取当前客户端连接数
-func (b *Broker) GetClientCount() int {
-	b.clientsMux.Lock()
-	defer b.clientsMux.Unlock()
-	total := 0
-	for _, clientMap := range b.clients {
-		total += len(clientMap)
+// TargetDevice 仅投递给指定设备
+func TargetDevice(deviceID uint) BroadcastTarget {
+	return BroadcastTarget{Target: models.MessageTargetDevice, DeviceID: deviceID}
+}
+
+// targetOf 根据消息的路由字段生成投递目标
+func targetOf(message *models.Message) BroadcastTarget {
+	return BroadcastTarget{
+		Target:         message.Target,
+		DeviceID:       message.TargetDeviceID,
+		SenderDeviceID: message.SenderDeviceID,
 	}
-	return total
 }
 
-// GetClientCountByUserID 获取特定用户的客户端连接数
-func (b *Broker) GetClientCountByUserID(userID uint) int {
-	b.clientsMux.Lock()
-	defer b.clientsMux.Unlock()
-	if clientMap, ok := b.clients[userID]; ok {
-		return len(clientMap)
+// Matches 判断客户端是否属于投递目标
+func (t BroadcastTarget) Matches(deviceID uint, deviceType string) bool {
+	switch t.Target {
+	case models.MessageTargetOthers:
+		return t.SenderDeviceID == 0 || deviceID != t.SenderDeviceID
+	case models.MessageTargetPC, models.MessageTargetPhone:
+		return deviceType == t.Target
+	case models.MessageTargetDevice:
+		return deviceID == t.DeviceID
+	case models.MessageTargetNone:
+		return false
+	default:
+		// all 以及历史数据中的空值
+		return true
+	}
+}
+
+// Event 可通过消息广播服务推送的事件
+type Event interface {
+	// EventType 事件类型，当前协议下作为帧类型
+	EventType() string
+}
+
+// broadcastRequest 广播请求
+type broadcastRequest struct {
+	message *models.Message // 待广播的消息，为nil时广播event
+	event   Event           // 待广播的事件
+	userID  uint            // 目标用户ID
+	target  BroadcastTarget // 投递目标
+}
+
+// encoder 按协议版本编码广播内容，每个版本只编码一次
+type encoder struct {
+	frameType string         // 帧类型
+	payload   interface{}    // 帧内容
+	encoded   map[int][]byte // 各协议版本的编码结果
+}
+
+// encode 获取指定协议版本的编码结果
+func (e *encoder) encode(protocol int) ([]byte, error) {
+	if data, ok := e.encoded[protocol]; ok {
+		return data, nil
+	}
+	data, err := encodeFrame(protocol, e.frameType, "", 0, e.payload, e.payload)
+	if err != nil {
+		return nil, err
 	}
-	return 0
+	e.encoded[protocol] = data
+	return data, nil
 }
@@ -0,0 +1,85 @@
+package services
+
+import (
+	"sync"
+	"time"
+)
+
+// CircuitBreaker 上游熔断器
+// 同一上游连续失败达到阈值后熔断，冷却期内不再向其发送请求；
+// 冷却期结束后放行一个试探请求，成功则恢复，失败则重新熔断
+type CircuitBreaker struct {
+	mu        sync.Mutex
+	threshold int                        // 触发熔断的连续失败次数
+	cooldown  time.Duration              // 熔断后的冷却时间
+	upstreams map[string]*upstreamHealth // 按上游标识记录的健康状态
+}
+
+// upstreamHealth 单个上游的健康状态
+type upstreamHealth struct {
+	failures  int       // 连续失败次数
+	openUntil time.Time // 熔断结束时间，零值表示未熔断
+	probing   bool      // 冷却期结束后是否已放行试探请求
+}
+
+// NewCircuitBreaker 创建上游熔断器
+func NewCircuitBreaker(threshold int, cooldown time.Duration) *CircuitBreaker {
+	return &CircuitBreaker{
+		threshold: threshold,
+		cooldown:  cooldown,
+		upstreams: make(map[string]*upstreamHealth),
+	}
+}
+
+// Allow 判断是否可以向上游发送请求
+// 熔断中的上游返回false；冷却期结束后只放行一个试探请求
+func (b *CircuitBreaker) Allow(upstream string) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	health, ok := b.upstreams[upstream]
+	if !ok || health.openUntil.IsZero() {
+		return true
+	}
+	if time.Now().Before(health.openUntil) || health.probing {
+		return false
+	}
+	health.probing = true
+	return true
+}
+
+// Success 记录上游请求成功，恢复该上游
+func (b *CircuitBreaker) Success(upstream string) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	delete(b.upstreams, upstream)
+}
+
+// Failure 记录上游请求失败，返回该上游是否因此进入熔断
+func (b *CircuitBreaker) Failure(upstream string) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	health, ok := b.upstreams[upstream]
+	if !ok {
+		health = &upstreamHealth{}
+		b.upstreams[upstream] = health
+	}
+	health.failures++
+	// 试探请求失败或连续失败达到阈值时熔断
+	if health.probing || health.failures >= b.threshold {
+		health.openUntil = time.Now().Add(b.cooldown)
+		health.probing = false
+		return true
+	}
+	return false
+}
+
+// Release 放弃试探请求（如请求被调用方取消），允许下一个请求继续试探
+func (b *CircuitBreaker) Release(upstream string) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if health, ok := b.upstreams[upstream]; ok {
+		health.probing = false
+	}
+}
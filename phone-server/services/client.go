@@ -0,0 +1,449 @@
+package services
+
+import (
+	"encoding/json"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"phone-server/models"
+	"phone-server/utils"
+
+	"github.com/gorilla/websocket"
+)
+
+// SlowConsumerPolicy 慢消费者处理策略
+type SlowConsumerPolicy string
+
+const (
+	// SlowConsumerDropOldest 发送队列已满时丢弃最旧的实时广播，最旧的帧不可丢弃时断开连接
+	SlowConsumerDropOldest SlowConsumerPolicy = "drop_oldest"
+	// SlowConsumerDisconnect 发送队列已满时断开连接
+	SlowConsumerDisconnect SlowConsumerPolicy = "disconnect"
+)
+
+// CloseSlowConsumer 因发送队列积压而断开连接时使用的关闭码
+const CloseSlowConsumer = websocket.CloseTryAgainLater
+
+// CloseDeviceRevoked 因设备被撤销而断开连接时使用的关闭码
+const CloseDeviceRevoked = websocket.ClosePolicyViolation
+
+// ClientStats 单个WebSocket连接的统计信息
+type ClientStats struct {
+	UserID      uint      `json:"user_id"`      // 用户ID
+	DeviceID    uint      `json:"device_id"`    // 设备ID
+	DeviceType  string    `json:"device_type"`  // 设备类型
+	RemoteAddr  string    `json:"remote_addr"`  // 客户端地址
+	ConnectedAt time.Time `json:"connected_at"` // 连接建立时间
+	QueueLen    int       `json:"queue_len"`    // 当前发送队列长度
+	QueueCap    int       `json:"queue_cap"`    // 发送队列容量
+	Sent        uint64    `json:"sent"`         // 已发送消息数
+	Dropped     uint64    `json:"dropped"`      // 已丢弃消息数
+}
+
+// OutboundFrame 发送队列中的一帧
+type OutboundFrame struct {
+	MessageID uint   // 广播消息的ID，非消息帧为0
+	Data      []byte // 序列化后的帧
+	Droppable bool   // 是否可按drop_oldest策略丢弃，只有实时广播可以丢弃，AI流式响应和重放的消息不可丢弃
+}
+
+// Client 订阅消息广播的客户端连接，每个连接拥有独立的发送队列
+// WebSocket连接由写协程消费发送队列；SSE等其他传输方式通过Frames自行消费
+type Client struct {
+	conn         *websocket.Conn    // WebSocket连接，非WebSocket订阅者为nil
+	userID       uint               // 用户ID
+	deviceID     uint               // 设备ID
+	deviceType   string             // 设备类型：pc 或 phone
+	protocol     int                // 协商后的协议版本
+	remoteAddr   string             // 客户端地址
+	connectedAt  time.Time          // 连接建立时间
+	send         chan OutboundFrame // 待发送消息队列
+	sendMux      sync.Mutex         // 保证入队与丢弃旧消息的原子性
+	done         chan struct{}      // 连接关闭信号
+	closeOnce    sync.Once          // 保证只关闭一次
+	closeCode    int                // 关闭连接时发送的关闭码
+	closeText    string             // 关闭连接时发送的关闭原因
+	writeTimeout time.Duration      // 单次写入超时时间
+	pingInterval time.Duration      // 心跳Ping发送间隔
+	policy       SlowConsumerPolicy // 慢消费者处理策略
+	sent         atomic.Uint64      // 已发送消息数
+	dropped      atomic.Uint64      // 已丢弃消息数
+	stats        *brokerStats       // 所属广播服务的统计信息
+
+	replayMux     sync.Mutex       // 保护断线重放相关状态的互斥锁
+	replaying     bool             // 是否正在重放离线消息，重放期间实时广播暂存到pending
+	pending       []pendingMessage // 重放期间暂存的实时广播消息
+	pendingGap    uint             // 暂存队列溢出时丢弃的最大消息ID，大于已重放的消息ID时需要继续重放
+	lastMessageID uint             // 已投递给该连接的最大消息ID，用于去重
+}
+
+// pendingMessage 重放期间暂存的实时广播消息
+type pendingMessage struct {
+	id   uint   // 消息ID
+	data []byte // 序列化后的消息
+}
+
+// newClient 创建客户端连接，replay为true时连接在调用FinishReplay前处于重放状态
+func newClient(conn *websocket.Conn, device *models.Device, remoteAddr string, protocol int, replay bool, config BrokerConfig, stats *brokerStats) *Client {
+	return &Client{
+		replaying:    replay,
+		protocol:     protocol,
+		conn:         conn,
+		userID:       device.UserID,
+		deviceID:     device.ID,
+		deviceType:   device.DeviceType,
+		remoteAddr:   remoteAddr,
+		connectedAt:  time.Now(),
+		send:         make(chan OutboundFrame, config.SendQueueSize),
+		done:         make(chan struct{}),
+		closeCode:    websocket.CloseNormalClosure,
+		writeTimeout: config.WriteTimeout,
+		pingInterval: config.PingInterval,
+		policy:       config.SlowConsumerPolicy,
+		stats:        stats,
+	}
+}
+
+// UserID 获取连接所属的用户ID
+func (c *Client) UserID() uint {
+	return c.userID
+}
+
+// DeviceID 获取连接所属的设备ID
+func (c *Client) DeviceID() uint {
+	return c.deviceID
+}
+
+// DeviceType 获取连接所属的设备类型
+func (c *Client) DeviceType() string {
+	return c.deviceType
+}
+
+// ProtocolVersion 获取连接协商后的协议版本
+func (c *Client) ProtocolVersion() int {
+	return c.protocol
+}
+
+// RemoteAddr 获取客户端地址
+func (c *Client) RemoteAddr() string {
+	return c.remoteAddr
+}
+
+// Done 返回连接关闭信号通道
+func (c *Client) Done() <-chan struct{} {
+	return c.done
+}
+
+// Frames 返回发送队列，供非WebSocket订阅者消费
+func (c *Client) Frames() <-chan OutboundFrame {
+	return c.send
+}
+
+// Send 将消息放入发送队列，队列已满时按慢消费者策略处理
+// 返回false表示消息未能入队（连接已关闭或因积压被断开）
+func (c *Client) Send(data []byte) bool {
+	return c.enqueue(OutboundFrame{Data: data})
+}
+
+// enqueue 将帧放入发送队列，队列已满时按慢消费者策略处理
+func (c *Client) enqueue(frame OutboundFrame) bool {
+	c.sendMux.Lock()
+	defer c.sendMux.Unlock()
+
+	select {
+	case <-c.done:
+		return false
+	default:
+	}
+
+	select {
+	case c.send <- frame:
+		return true
+	default:
+	}
+
+	// 发送队列已满，最旧的帧可以丢弃时丢弃后入队
+	// 丢弃AI流式响应或重放消息中的帧会让客户端收到不完整的内容且无从察觉，此时改为断开连接，客户端重连后重放离线消息
+	if c.policy == SlowConsumerDropOldest {
+		select {
+		case oldest := <-c.send:
+			if oldest.Droppable {
+				// 发送队列的写入方持有sendMux，刚腾出的位置不会被占用
+				c.dropped.Add(1)
+				c.stats.droppedMessages.Add(1)
+				c.send <- frame
+				utils.Warnf("[WS] 用户 %d 的ws客户端:%s发送队列已满，已丢弃最旧消息", c.userID, c.remoteAddr)
+				return true
+			}
+			// 通道无法查看队首，取出的帧不可丢弃时按原顺序放回队首后断开连接
+			c.requeueFront(oldest)
+		default:
+			// 写协程已取走队列中的帧
+			c.send <- frame
+			return true
+		}
+	}
+
+	utils.Warnf("[WS] 用户 %d 的ws客户端:%s发送队列已满（%d条），断开慢消费者连接", c.userID, c.remoteAddr, cap(c.send))
+	c.dropped.Add(1)
+	c.stats.droppedMessages.Add(1)
+	c.stats.slowConsumerDisconnects.Add(1)
+	c.closeWithCode(CloseSlowConsumer, "slow consumer")
+	return false
+}
+
+// requeueFront 将刚从队首取出的帧按原顺序放回队首，调用方需持有sendMux
+// 写协程只会取走帧，放回后的帧数不会超过队列容量
+func (c *Client) requeueFront(frame OutboundFrame) {
+	rest := make([]OutboundFrame, 0, len(c.send))
+	for len(c.send) > 0 {
+		select {
+		case queued := <-c.send:
+			rest = append(rest, queued)
+		default:
+		}
+	}
+	c.send <- frame
+	for _, queued := range rest {
+		c.send <- queued
+	}
+}
+
+// enqueueWait 将帧放入发送队列，队列已满时等待写协程发送而不按慢消费者策略处理，连接关闭时返回false
+// 用于重放离线消息，避免一次重放大量消息时因队列积压被断开或丢弃
+func (c *Client) enqueueWait(frame OutboundFrame) bool {
+	c.sendMux.Lock()
+	defer c.sendMux.Unlock()
+
+	select {
+	case <-c.done:
+		return false
+	default:
+	}
+
+	select {
+	case c.send <- frame:
+		return true
+	case <-c.done:
+		return false
+	}
+}
+
+// deliver 投递一条已持久化的广播消息，重放期间暂存，重放结束后按消息ID去重
+func (c *Client) deliver(id uint, data []byte) bool {
+	c.replayMux.Lock()
+	if c.replaying {
+		// 暂存队列与发送队列容量一致，超出时丢弃最旧的暂存消息
+		// 丢弃的消息已持久化，FinishReplay发现其未被重放时会要求继续分批重放
+		if len(c.pending) >= cap(c.send) {
+			c.pendingGap = max(c.pendingGap, c.pending[0].id)
+			c.pending = c.pending[1:]
+		}
+		c.pending = append(c.pending, pendingMessage{id: id, data: data})
+		c.replayMux.Unlock()
+		return true
+	}
+	if id != 0 && id <= c.lastMessageID {
+		// 已经投递过的消息，跳过
+		c.replayMux.Unlock()
+		return true
+	}
+	if id > c.lastMessageID {
+		c.lastMessageID = id
+	}
+	c.replayMux.Unlock()
+
+	return c.enqueue(OutboundFrame{MessageID: id, Data: data, Droppable: true})
+}
+
+// ReplayMessages 按顺序发送一批离线期间错过的消息，发送队列已满时等待，只能在FinishReplay之前调用
+// messages需按ID升序排列，可以多次调用以分批重放，ID不大于已投递消息的会被跳过
+func (c *Client) ReplayMessages(messages []*models.Message) error {
+	lastMessageID := c.LastMessageID()
+	for _, message := range messages {
+		if message.ID <= lastMessageID {
+			// FinishReplay可能已投递过暂存的实时消息，继续重放时跳过
+			continue
+		}
+		data, err := encodeFrame(c.protocol, models.FrameMessage, "", 0, message, message)
+		if err != nil {
+			return err
+		}
+		if !c.enqueueWait(OutboundFrame{MessageID: message.ID, Data: data}) {
+			return websocket.ErrCloseSent
+		}
+		c.markDelivered(message.ID)
+	}
+	return nil
+}
+
+// FinishReplay 投递重放期间暂存的实时消息并切换为实时投递，暂存消息中ID不大于已重放消息的会被跳过，保证边界处不重复
+// 暂存队列溢出时丢弃了尚未重放的消息则返回false，调用方需从LastMessageID继续调用ReplayMessages后再次调用
+func (c *Client) FinishReplay() (bool, error) {
+	for {
+		c.replayMux.Lock()
+		if c.pendingGap > c.lastMessageID {
+			c.pendingGap = 0
+			c.replayMux.Unlock()
+			return false, nil
+		}
+		pending := c.pending
+		c.pending = nil
+		if len(pending) == 0 {
+			c.replaying = false
+			c.replayMux.Unlock()
+			return true, nil
+		}
+		lastMessageID := c.lastMessageID
+		c.replayMux.Unlock()
+
+		// 发送暂存消息时不持有replayMux，避免广播协程在等待发送队列期间被阻塞，期间的实时广播继续暂存
+		for _, msg := range pending {
+			if msg.id != 0 && msg.id <= lastMessageID {
+				continue
+			}
+			if !c.enqueueWait(OutboundFrame{MessageID: msg.id, Data: msg.data}) {
+				return false, websocket.ErrCloseSent
+			}
+			c.markDelivered(msg.id)
+			lastMessageID = max(lastMessageID, msg.id)
+		}
+	}
+}
+
+// LastMessageID 返回已投递给该连接的最大消息ID，FinishReplay返回false后应从该位置继续重放
+func (c *Client) LastMessageID() uint {
+	c.replayMux.Lock()
+	defer c.replayMux.Unlock()
+	return c.lastMessageID
+}
+
+// markDelivered 记录已投递给该连接的最大消息ID
+func (c *Client) markDelivered(id uint) {
+	c.replayMux.Lock()
+	defer c.replayMux.Unlock()
+	if id > c.lastMessageID {
+		c.lastMessageID = id
+	}
+}
+
+// SendJSON 将对象序列化为JSON后放入发送队列
+func (c *Client) SendJSON(v interface{}) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	if !c.Send(data) {
+		return websocket.ErrCloseSent
+	}
+	return nil
+}
+
+// SendFrame 按连接的协议版本发送帧
+// 当前协议下发送Envelope封装的payload；旧版协议下直接发送legacy对象，legacy为nil时旧版连接不发送
+func (c *Client) SendFrame(frameType string, replyTo string, seq int, payload interface{}, legacy interface{}) error {
+	if c.protocol < models.ProtocolVersion && legacy == nil {
+		return nil
+	}
+	data, err := encodeFrame(c.protocol, frameType, replyTo, seq, payload, legacy)
+	if err != nil {
+		return err
+	}
+	if !c.Send(data) {
+		return websocket.ErrCloseSent
+	}
+	return nil
+}
+
+// encodeFrame 按协议版本编码帧，旧版协议直接编码legacy对象
+func encodeFrame(protocol int, frameType string, replyTo string, seq int, payload interface{}, legacy interface{}) ([]byte, error) {
+	if protocol < models.ProtocolVersion {
+		return json.Marshal(legacy)
+	}
+
+	payloadBytes, err := json.Marshal(payload)
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(models.Envelope{
+		V:       models.ProtocolVersion,
+		ID:      utils.NewFrameID(),
+		Type:    frameType,
+		ReplyTo: replyTo,
+		Seq:     seq,
+		Payload: payloadBytes,
+	})
+}
+
+// Close 关闭连接
+func (c *Client) Close() {
+	c.closeWithCode(websocket.CloseNormalClosure, "")
+}
+
+// closeWithCode 使用指定关闭码关闭连接，写协程会发送关闭帧后关闭底层连接
+func (c *Client) closeWithCode(code int, text string) {
+	c.closeOnce.Do(func() {
+		c.closeCode = code
+		c.closeText = text
+		close(c.done)
+	})
+}
+
+// MarkSent 记录一条已由订阅者自行写出的帧，供非WebSocket订阅者统计使用
+func (c *Client) MarkSent() {
+	c.sent.Add(1)
+}
+
+// Stats 获取连接统计信息
+func (c *Client) Stats() ClientStats {
+	return ClientStats{
+		UserID:      c.userID,
+		DeviceID:    c.deviceID,
+		DeviceType:  c.deviceType,
+		RemoteAddr:  c.remoteAddr,
+		ConnectedAt: c.connectedAt,
+		QueueLen:    len(c.send),
+		QueueCap:    cap(c.send),
+		Sent:        c.sent.Load(),
+		Dropped:     c.dropped.Load(),
+	}
+}
+
+// writePump 写协程，串行地将发送队列中的消息写入连接，并定期发送心跳Ping
+func (c *Client) writePump() {
+	ticker := time.NewTicker(c.pingInterval)
+	defer func() {
+		ticker.Stop()
+		c.conn.Close()
+	}()
+
+	for {
+		select {
+		case frame := <-c.send:
+			c.conn.SetWriteDeadline(time.Now().Add(c.writeTimeout))
+			if err := c.conn.WriteMessage(websocket.TextMessage, frame.Data); err != nil {
+				utils.Errorf("[WS] 发送消息失败: %v, 用户ID: %d, 客户端: %s", err, c.userID, c.remoteAddr)
+				c.closeWithCode(websocket.CloseAbnormalClosure, "")
+				return
+			}
+			c.sent.Add(1)
+
+		case <-ticker.C:
+			deadline := time.Now().Add(c.writeTimeout)
+			if err := c.conn.WriteControl(websocket.PingMessage, nil, deadline); err != nil {
+				utils.Warnf("[WS] 发送心跳失败: %v, 用户ID: %d, 客户端: %s", err, c.userID, c.remoteAddr)
+				c.closeWithCode(websocket.CloseAbnormalClosure, "")
+				return
+			}
+
+		case <-c.done:
+			// 发送关闭帧，通知客户端关闭原因
+			if c.closeCode != websocket.CloseAbnormalClosure {
+				deadline := time.Now().Add(c.writeTimeout)
+				c.conn.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(c.closeCode, c.closeText), deadline)
+			}
+			return
+		}
+	}
+}
@@ -0,0 +1,202 @@
+package services
+
+import (
+	"testing"
+	"time"
+
+	"phone-server/models"
+)
+
+// newTestClient 创建不带WebSocket连接的测试客户端，由测试自行消费发送队列
+func newTestClient(queueSize int, policy SlowConsumerPolicy, replay bool) *Client {
+	device := &models.Device{ID: 1, UserID: 1, DeviceType: models.DeviceTypePhone}
+	config := BrokerConfig{SendQueueSize: queueSize, WriteTimeout: time.Second, SlowConsumerPolicy: policy, PingInterval: time.Second}
+	return newClient(nil, device, "test", models.ProtocolVersion, replay, config, &brokerStats{})
+}
+
+// drain 在后台消费发送队列，返回收到的消息ID
+func drain(client *Client) <-chan []uint {
+	result := make(chan []uint, 1)
+	go func() {
+		var ids []uint
+		for {
+			select {
+			case frame := <-client.Frames():
+				ids = append(ids, frame.MessageID)
+			case <-client.Done():
+				result <- ids
+				return
+			}
+		}
+	}()
+	return result
+}
+
+// testMessages 创建ID连续的消息
+func testMessages(from uint, count int) []*models.Message {
+	messages := make([]*models.Message, count)
+	for i := range messages {
+		messages[i] = &models.Message{ID: from + uint(i), Type: models.MessageTypeText, Content: "test"}
+	}
+	return messages
+}
+
+func TestReplayWaitsForQueue(t *testing.T) {
+	client := newTestClient(4, SlowConsumerDisconnect, true)
+	received := drain(client)
+
+	// 重放的消息远多于发送队列容量，期间的实时广播暂存，边界处的重复消息被跳过
+	if err := client.ReplayMessages(testMessages(1, 50)); err != nil {
+		t.Fatalf("ReplayMessages: %v", err)
+	}
+	client.deliver(50, []byte("dup"))
+	client.deliver(51, []byte("live"))
+	finished, err := client.FinishReplay()
+	if err != nil || !finished {
+		t.Fatalf("FinishReplay = %v, %v", finished, err)
+	}
+	client.deliver(52, []byte("live"))
+
+	time.Sleep(50 * time.Millisecond)
+	client.Close()
+	ids := <-received
+	if len(ids) != 52 {
+		t.Fatalf("收到 %d 条消息，期望 52 条", len(ids))
+	}
+	for i, id := range ids {
+		if id != uint(i+1) {
+			t.Fatalf("第 %d 条消息ID为 %d，期望 %d", i, id, i+1)
+		}
+	}
+	if client.Stats().Dropped != 0 {
+		t.Fatalf("重放期间丢弃了 %d 条消息", client.Stats().Dropped)
+	}
+}
+
+func TestFinishReplayReportsPendingGap(t *testing.T) {
+	client := newTestClient(2, SlowConsumerDisconnect, true)
+	received := drain(client)
+
+	// 暂存队列溢出，丢弃了尚未重放的消息3
+	for id := uint(3); id <= 5; id++ {
+		client.deliver(id, []byte("live"))
+	}
+	if err := client.ReplayMessages(testMessages(1, 2)); err != nil {
+		t.Fatalf("ReplayMessages: %v", err)
+	}
+	if finished, err := client.FinishReplay(); err != nil || finished {
+		t.Fatalf("FinishReplay = %v, %v，期望需要继续重放", finished, err)
+	}
+
+	// 从已重放的位置继续重放后完成
+	if err := client.ReplayMessages(testMessages(3, 3)); err != nil {
+		t.Fatalf("ReplayMessages: %v", err)
+	}
+	if finished, err := client.FinishReplay(); err != nil || !finished {
+		t.Fatalf("FinishReplay = %v, %v", finished, err)
+	}
+
+	time.Sleep(50 * time.Millisecond)
+	client.Close()
+	ids := <-received
+	if len(ids) != 5 {
+		t.Fatalf("收到消息 %v，期望 1~5", ids)
+	}
+}
+
+func TestReplayAfterPendingOverflowSkipsDelivered(t *testing.T) {
+	client := newTestClient(2, SlowConsumerDisconnect, true)
+
+	// 重放消息1后暂存实时消息2、3，FinishReplay投递2后因发送队列已满等待
+	if err := client.ReplayMessages(testMessages(1, 1)); err != nil {
+		t.Fatalf("ReplayMessages: %v", err)
+	}
+	client.deliver(2, []byte("live"))
+	client.deliver(3, []byte("live"))
+	type result struct {
+		finished bool
+		err      error
+	}
+	done := make(chan result, 1)
+	go func() {
+		finished, err := client.FinishReplay()
+		done <- result{finished, err}
+	}()
+	deadline := time.Now().Add(time.Second)
+	for len(client.Frames()) < 2 {
+		if time.Now().After(deadline) {
+			t.Fatal("FinishReplay未投递暂存消息")
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	// 投递暂存消息期间暂存队列溢出，丢弃了消息4
+	for id := uint(4); id <= 6; id++ {
+		client.deliver(id, []byte("live"))
+	}
+	received := drain(client)
+	if r := <-done; r.err != nil || r.finished {
+		t.Fatalf("FinishReplay = %v, %v，期望需要继续重放", r.finished, r.err)
+	}
+
+	// 调用方从上一页的末尾（消息1之后）重新查询，已投递的2、3应被跳过
+	if err := client.ReplayMessages(testMessages(2, 5)); err != nil {
+		t.Fatalf("ReplayMessages: %v", err)
+	}
+	if finished, err := client.FinishReplay(); err != nil || !finished {
+		t.Fatalf("FinishReplay = %v, %v", finished, err)
+	}
+
+	time.Sleep(50 * time.Millisecond)
+	client.Close()
+	ids := <-received
+	if len(ids) != 6 {
+		t.Fatalf("收到消息 %v，期望 1~6 且不重复", ids)
+	}
+	for i, id := range ids {
+		if id != uint(i+1) {
+			t.Fatalf("收到消息 %v，期望 1~6 且不重复", ids)
+		}
+	}
+}
+
+func TestDropOldestKeepsStreamFrames(t *testing.T) {
+	client := newTestClient(2, SlowConsumerDropOldest, false)
+
+	// 最旧的是实时广播时丢弃后入队
+	client.deliver(1, []byte("live"))
+	client.deliver(2, []byte("live"))
+	if !client.deliver(3, []byte("live")) {
+		t.Fatal("丢弃最旧的实时广播后应入队成功")
+	}
+	if client.Stats().Dropped != 1 {
+		t.Fatalf("Dropped = %d，期望 1", client.Stats().Dropped)
+	}
+
+	// 最旧的是AI流式响应帧时断开连接
+	client = newTestClient(2, SlowConsumerDropOldest, false)
+	client.Send([]byte("stream_start"))
+	client.Send([]byte("chunk"))
+	if client.Send([]byte("chunk")) {
+		t.Fatal("最旧的帧不可丢弃时应断开连接")
+	}
+	select {
+	case <-client.Done():
+	default:
+		t.Fatal("连接未被断开")
+	}
+	// 不可丢弃的最旧帧按原顺序保留在队列中
+	for _, expected := range []string{"stream_start", "chunk"} {
+		select {
+		case frame := <-client.Frames():
+			if string(frame.Data) != expected {
+				t.Fatalf("队列中的帧 = %q，期望 %q", frame.Data, expected)
+			}
+		default:
+			t.Fatalf("队列中缺少帧 %q", expected)
+		}
+	}
+	if client.Stats().Dropped != 1 {
+		t.Fatalf("Dropped = %d，期望只计入未入队的帧", client.Stats().Dropped)
+	}
+}
@@ -0,0 +1,297 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"phone-server/models"
+	"phone-server/utils"
+
+	"gorm.io/gorm"
+)
+
+// maxConversationTitle 会话标题的最大字符数
+const maxConversationTitle = 50
+
+// ErrConversationNotFound 会话不存在或不属于当前用户
+var ErrConversationNotFound = errors.New("会话不存在")
+
+// ErrTooManyImages 单次请求携带的图片数量超过限制
+var ErrTooManyImages = errors.New("图片数量超过限制")
+
+// ConversationService AI会话服务
+// 保存每个会话中用户和AI的轮次，继续会话时将之前的轮次一并发送给AI
+type ConversationService struct {
+	db             *gorm.DB           // 数据库连接
+	aiService      *AIService         // AI服务
+	resultService  *AIResultService   // AI结果服务
+	usageService   *UsageService      // AI用量服务
+	limiter        *GenerationLimiter // AI生成并发限制器
+	historyTurns   int                // 继续会话时最多回放的历史轮次数
+	historyChars   int                // 继续会话时回放的历史轮次的总字符数上限
+	storeReasoning bool               // 是否在AI结果中保存思考过程
+	imagePrompt    string             // 图片请求未携带提示词时使用的默认提示词
+	maxImages      int                // 单次请求最多携带的图片数量
+}
+
+// ChatOptions 单次对话的选项
+type ChatOptions struct {
+	Model    string             // 模型名称，为空时使用默认模型
+	Thinking string             // 思考模式，为空时使用配置的思考模式
+	Priority Priority           // 等待生成名额时的排队优先级
+	OnQueued func(position int) // 排队位置变化时的回调，可以为nil
+}
+
+// NewConversationService 创建AI会话服务实例
+func NewConversationService(db *gorm.DB, aiService *AIService, resultService *AIResultService, usageService *UsageService, limiter *GenerationLimiter, historyTurns int, historyChars int, storeReasoning bool, imagePrompt string, maxImages int) *ConversationService {
+	return &ConversationService{
+		db:             db,
+		aiService:      aiService,
+		resultService:  resultService,
+		usageService:   usageService,
+		limiter:        limiter,
+		historyTurns:   historyTurns,
+		historyChars:   historyChars,
+		storeReasoning: storeReasoning,
+		imagePrompt:    imagePrompt,
+		maxImages:      maxImages,
+	}
+}
+
+// ImageMessage 创建携带一张或多张图片的提问消息，prompt为空时使用配置的默认提示词
+// 图片数量超过限制时返回包装了ErrTooManyImages的错误
+func (s *ConversationService) ImageMessage(prompt string, images []ChatPart) (ChatMessage, error) {
+	if len(images) > s.maxImages {
+		return ChatMessage{}, fmt.Errorf("%w：最多%d张，实际%d张", ErrTooManyImages, s.maxImages, len(images))
+	}
+	if strings.TrimSpace(prompt) == "" {
+		prompt = s.imagePrompt
+	}
+	parts := append([]ChatPart{TextPart(prompt)}, images...)
+	return NewChatMessage(ChatRoleUser, parts...), nil
+}
+
+// Open 打开会话，conversationID为0时以消息内容为标题创建新会话
+// 打开会话前检查options中的模型是否支持本次消息，不支持时返回包装了ErrUnsupportedModel的错误
+// 之后检查用户的AI用量配额，超出配额时返回包装了ErrQuotaExceeded的错误，不会发送请求给AI
+func (s *ConversationService) Open(userID uint, conversationID uint, message ChatMessage, options ChatOptions) (*models.Conversation, error) {
+	request := ChatRequest{Model: options.Model, Thinking: options.Thinking, Messages: []ChatMessage{message}}
+	if err := s.aiService.CheckRequest(request); err != nil {
+		return nil, err
+	}
+	if err := s.usageService.CheckQuota(userID); err != nil {
+		return nil, err
+	}
+
+	if conversationID == 0 {
+		conversation := &models.Conversation{
+			UserID: userID,
+			Title:  conversationTitle(message),
+		}
+		if err := s.db.Create(conversation).Error; err != nil {
+			return nil, err
+		}
+		return conversation, nil
+	}
+
+	var conversation models.Conversation
+	err := s.db.Where("id = ? AND user_id = ?", conversationID, userID).First(&conversation).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, ErrConversationNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &conversation, nil
+}
+
+// Chat 在会话中与AI对话（流式）
+// 开始前按options中的优先级等待全局和用户的生成名额，排队人数已满时返回ErrQueueFull
+// 提问保存为不投递的消息，之前的轮次按时间顺序放在本次消息之前发送给AI
+// 无论生成是否完整结束，回答都会保存为AI结果；只有完整结束的生成才会作为轮次保存到会话中，思考过程不保存到会话中
+func (s *ConversationService) Chat(ctx context.Context, conversation *models.Conversation, message ChatMessage, options ChatOptions, sender models.SenderType, senderDeviceID uint, streamCallback StreamResponseFunc) error {
+	// 等待生成名额，排队期间取消时不保存提问
+	queuedAt := time.Now()
+	release, err := s.limiter.Acquire(ctx, conversation.UserID, options.Priority, options.OnQueued)
+	if err != nil {
+		return err
+	}
+	defer release()
+	if waited := time.Since(queuedAt); waited >= time.Second {
+		utils.Infofc(ctx, "[CONVERSATION] 会话 %d 排队等待 %v 后开始生成", conversation.ID, waited)
+	}
+
+	prompt := promptMessage(conversation.UserID, message, sender, senderDeviceID)
+	if err := s.db.Create(prompt).Error; err != nil {
+		return fmt.Errorf("保存提问消息失败: %w", err)
+	}
+
+	history, err := s.History(conversation.ID)
+	if err != nil {
+		return fmt.Errorf("加载会话历史失败: %w", err)
+	}
+	utils.Infofc(ctx, "[CONVERSATION] 会话 %d 回放 %d 条历史轮次", conversation.ID, len(history))
+
+	startTime := time.Now()
+	var reply, reasoning strings.Builder
+	collectCallback := func(chunk StreamChunk) error {
+		switch chunk.Type {
+		case ChunkContent:
+			reply.WriteString(chunk.Text)
+		case ChunkReasoning:
+			reasoning.WriteString(chunk.Text)
+		}
+		return streamCallback(chunk)
+	}
+	request := ChatRequest{Model: options.Model, Thinking: options.Thinking, Messages: append(history, message)}
+	chatResult, err := s.aiService.Chat(ctx, request, collectCallback)
+
+	// 记录用量，失败只影响用量统计
+	if !chatResult.Usage.IsZero() {
+		if err := s.usageService.Record(conversation.UserID, chatResult.Model, chatResult.Usage); err != nil {
+			utils.Errorfc(ctx, "[CONVERSATION] 记录AI用量失败: %v, 用户ID: %d", err, conversation.UserID)
+		}
+	}
+
+	result := &models.AIResult{
+		UserID:           conversation.UserID,
+		MessageID:        prompt.ID,
+		ConversationID:   conversation.ID,
+		Model:            chatResult.Model,
+		LatencyMs:        time.Since(startTime).Milliseconds(),
+		FinishReason:     finishReason(ctx, err),
+		Content:          reply.String(),
+		PromptTokens:     chatResult.Usage.PromptTokens,
+		CompletionTokens: chatResult.Usage.CompletionTokens,
+	}
+	if s.storeReasoning {
+		result.Reasoning = reasoning.String()
+	}
+	if err := s.resultService.Save(result); err != nil {
+		utils.Errorfc(ctx, "[CONVERSATION] 保存AI结果失败: %v, 提问消息ID: %d", err, prompt.ID)
+	}
+	if err != nil {
+		return err
+	}
+
+	if err := s.record(conversation, message, reply.String()); err != nil {
+		// 回复已发送给客户端，保存失败只影响后续对话的上下文
+		utils.Errorfc(ctx, "[CONVERSATION] 保存会话 %d 的轮次失败: %v", conversation.ID, err)
+	}
+	return nil
+}
+
+// History 加载会话中最近的轮次
+// 最多historyTurns轮，且总字符数不超过historyChars，超出时丢弃最早的轮次；回放的历史总是从用户轮次开始
+func (s *ConversationService) History(conversationID uint) ([]ChatMessage, error) {
+	if s.historyTurns <= 0 {
+		return nil, nil
+	}
+
+	var turns []models.ConversationTurn
+	if err := s.db.Where("conversation_id = ?", conversationID).
+		Order("id DESC").
+		Limit(s.historyTurns).
+		Find(&turns).Error; err != nil {
+		return nil, err
+	}
+
+	// 从最新的轮次开始累计字符数
+	chars := 0
+	keep := 0
+	for _, turn := range turns {
+		chars += utf8.RuneCountInString(turn.Content)
+		if chars > s.historyChars {
+			break
+		}
+		keep++
+	}
+	turns = turns[:keep]
+
+	// 丢弃最早的AI回复，避免历史以assistant开头
+	for len(turns) > 0 && turns[len(turns)-1].Role != models.TurnRoleUser {
+		turns = turns[:len(turns)-1]
+	}
+
+	history := make([]ChatMessage, 0, len(turns))
+	for i := len(turns) - 1; i >= 0; i-- {
+		history = append(history, turnMessage(turns[i]))
+	}
+	return history, nil
+}
+
+// record 保存本轮的用户消息和AI回复
+func (s *ConversationService) record(conversation *models.Conversation, message ChatMessage, reply string) error {
+	return s.db.Transaction(func(tx *gorm.DB) error {
+		turns := []models.ConversationTurn{
+			{
+				ConversationID: conversation.ID,
+				Role:           models.TurnRoleUser,
+				Content:        message.Text(),
+				ImageCount:     message.ImageCount(),
+			},
+			{
+				ConversationID: conversation.ID,
+				Role:           models.TurnRoleAssistant,
+				Content:        reply,
+			},
+		}
+		if err := tx.Create(&turns).Error; err != nil {
+			return err
+		}
+		// 更新会话的最后活跃时间
+		return tx.Model(conversation).Update("updated_at", time.Now()).Error
+	})
+}
+
+// promptMessage 将提问转换为不投递的消息，包含图片时保存第一张图片
+func promptMessage(userID uint, message ChatMessage, sender models.SenderType, senderDeviceID uint) *models.Message {
+	var prompt *models.Message
+	if imageURL := message.FirstImageURL(); imageURL != "" {
+		prompt = models.NewImageMessage(userID, imageURL, sender)
+	} else {
+		prompt = models.NewTextMessage(userID, message.Text(), sender)
+	}
+	return prompt.RouteTo(senderDeviceID, models.MessageTargetNone, 0)
+}
+
+// finishReason 根据对话结果判断结束原因
+func finishReason(ctx context.Context, err error) string {
+	switch {
+	case err == nil:
+		return models.FinishReasonStop
+	case errors.Is(context.Cause(ctx), ErrChatCancelled):
+		return models.FinishReasonCancelled
+	case ctx.Err() != nil:
+		return models.FinishReasonAborted
+	case errors.Is(err, ErrStreamTimeout):
+		return models.FinishReasonTimeout
+	default:
+		return models.FinishReasonError
+	}
+}
+
+// turnMessage 将保存的轮次转换为对话消息，图片不会回放，以文字说明代替
+func turnMessage(turn models.ConversationTurn) ChatMessage {
+	content := turn.Content
+	if turn.ImageCount > 0 {
+		content = fmt.Sprintf("[用户发送了%d张图片] %s", turn.ImageCount, content)
+	}
+	return NewChatMessage(ChatRole(turn.Role), TextPart(content))
+}
+
+// conversationTitle 以消息的文本内容作为会话标题
+func conversationTitle(message ChatMessage) string {
+	title := strings.TrimSpace(message.Text())
+	if title == "" && message.ImageCount() > 0 {
+		return "图片对话"
+	}
+	if utf8.RuneCountInString(title) > maxConversationTitle {
+		title = string([]rune(title)[:maxConversationTitle])
+	}
+	return title
+}
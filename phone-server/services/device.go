@@ -0,0 +1,486 @@
+package services
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"phone-server/models"
+	"phone-server/utils"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// deviceTouchInterval 两次写入设备最后活跃时间的最小间隔，避免每次心跳都写库
+const deviceTouchInterval = 30 * time.Second
+
+const (
+	// presenceHeartbeatInterval 节点刷新自身在线记录过期时间的间隔
+	presenceHeartbeatInterval = 30 * time.Second
+	// presenceTTL 在线记录的有效期，节点崩溃后其记录在有效期过后失效
+	presenceTTL = 3 * presenceHeartbeatInterval
+)
+
+// deviceTokenPrefix 设备凭证的前缀，便于与JWT区分
+const deviceTokenPrefix = "dt_"
+
+var (
+	// ErrDeviceNotFound 设备不存在
+	ErrDeviceNotFound = errors.New("设备不存在")
+	// ErrDeviceRevoked 设备已被撤销
+	ErrDeviceRevoked = errors.New("设备已被撤销")
+	// ErrInvalidDeviceToken 设备凭证无效
+	ErrInvalidDeviceToken = errors.New("设备凭证无效")
+	// ErrDeviceNotPaired 新设备需通过配对获取设备凭证
+	ErrDeviceNotPaired = errors.New("新设备需通过配对获取设备凭证")
+)
+
+// 设备在线状态事件类型
+const (
+	// EventPresenceJoined 设备上线
+	EventPresenceJoined = "presence.joined"
+	// EventPresenceLeft 设备离线
+	EventPresenceLeft = "presence.left"
+)
+
+// PresenceEvent 设备上线/离线事件，推送给用户的其他设备
+type PresenceEvent struct {
+	Type       string    `json:"type"`        // presence.joined 或 presence.left
+	DeviceID   uint      `json:"device_id"`   // 设备ID
+	DeviceType string    `json:"device_type"` // 设备类型
+	ClientID   string    `json:"client_id"`   // 客户端上报的设备标识
+	IP         string    `json:"ip"`          // 客户端IP
+	At         time.Time `json:"at"`          // 上线/离线时间
+}
+
+// EventType 事件类型
+func (e PresenceEvent) EventType() string {
+	return e.Type
+}
+
+// DeviceService 设备在线状态服务，根据WebSocket/SSE连接状态维护每个节点的在线记录和Device表
+// 设备在任一节点上有未过期的在线记录即视为在线，Device表的status字段随之同步
+type DeviceService struct {
+	db          *gorm.DB                // 数据库连接
+	broker      Broker                  // 消息广播服务，用于推送上线/离线事件
+	nodeID      string                  // 本节点ID，在线记录按节点区分
+	mux         sync.Mutex              // 保护connections和lastTouched的互斥锁
+	connections map[uint]int            // 每个设备在本节点上的连接数
+	lastTouched map[uint]time.Time      // 每个设备最后一次写入活跃时间的时刻
+	devices     map[uint]*models.Device // 本节点在线设备的信息，用于推送离线事件
+}
+
+// NewDeviceService 创建设备在线状态服务实例
+func NewDeviceService(db *gorm.DB, broker Broker, nodeID string) *DeviceService {
+	return &DeviceService{
+		db:          db,
+		broker:      broker,
+		nodeID:      nodeID,
+		devices:     make(map[uint]*models.Device),
+		connections: make(map[uint]int),
+		lastTouched: make(map[uint]time.Time),
+	}
+}
+
+// ClearNodePresence 删除本节点上次运行遗留的在线记录，并将不再在线的设备标记为离线，用于服务启动时清理崩溃遗留的在线状态
+func (s *DeviceService) ClearNodePresence() error {
+	if err := s.db.Where("node_id = ?", s.nodeID).Delete(&models.DevicePresence{}).Error; err != nil {
+		return err
+	}
+	s.sweep(time.Now())
+	return nil
+}
+
+// Start 定期刷新本节点在线记录的过期时间，并清理其他节点崩溃后遗留的过期记录
+func (s *DeviceService) Start() {
+	ticker := time.NewTicker(presenceHeartbeatInterval)
+	defer ticker.Stop()
+	for range ticker.C {
+		now := time.Now()
+		if err := s.db.Model(&models.DevicePresence{}).Where("node_id = ?", s.nodeID).
+			Update("expires_at", now.Add(presenceTTL)).Error; err != nil {
+			utils.Errorf("[DEVICE] 刷新节点 %s 的在线记录失败: %v", s.nodeID, err)
+		}
+		s.sweep(now)
+	}
+}
+
+// sweep 删除已过期的在线记录，并将在所有节点上都没有有效在线记录的设备标记为离线
+func (s *DeviceService) sweep(now time.Time) {
+	if err := s.db.Where("expires_at <= ?", now).Delete(&models.DevicePresence{}).Error; err != nil {
+		utils.Errorf("[DEVICE] 清理过期在线记录失败: %v", err)
+		return
+	}
+
+	var devices []models.Device
+	if err := s.db.Where("status = ? AND NOT EXISTS (?)", models.DeviceStatusOnline, s.livePresence(now)).
+		Find(&devices).Error; err != nil {
+		utils.Errorf("[DEVICE] 查询失效的在线设备失败: %v", err)
+		return
+	}
+	for i := range devices {
+		s.markOffline(&devices[i], now)
+	}
+}
+
+// livePresence 设备在任一节点上存在未过期在线记录的子查询，用于以devices为主表的查询
+func (s *DeviceService) livePresence(now time.Time) *gorm.DB {
+	return s.db.Model(&models.DevicePresence{}).Select("1").
+		Where("device_presences.device_id = devices.id AND device_presences.expires_at > ?", now)
+}
+
+// savePresence 写入本节点上设备的在线记录并刷新过期时间
+func (s *DeviceService) savePresence(device *models.Device, connections int, now time.Time) error {
+	presence := models.DevicePresence{
+		NodeID:      s.nodeID,
+		DeviceID:    device.ID,
+		UserID:      device.UserID,
+		Connections: connections,
+		ExpiresAt:   now.Add(presenceTTL),
+	}
+	return s.db.Clauses(clause.OnConflict{
+		Columns:   []clause.Column{{Name: "node_id"}, {Name: "device_id"}},
+		DoUpdates: clause.AssignmentColumns([]string{"connections", "expires_at", "updated_at"}),
+	}).Create(&presence).Error
+}
+
+// deletePresence 删除本节点上设备的在线记录
+func (s *DeviceService) deletePresence(deviceID uint) {
+	if err := s.db.Where("node_id = ? AND device_id = ?", s.nodeID, deviceID).
+		Delete(&models.DevicePresence{}).Error; err != nil {
+		utils.Errorf("[DEVICE] 删除设备 %d 的在线记录失败: %v", deviceID, err)
+	}
+}
+
+// markOffline 设备在所有节点上都没有有效在线记录时标记为离线，并向用户的其他设备推送离线事件
+// 多个节点可能同时发现同一设备离线，只有成功更新状态的节点推送事件
+func (s *DeviceService) markOffline(device *models.Device, now time.Time) {
+	result := s.db.Model(&models.Device{}).
+		Where("id = ? AND status = ? AND NOT EXISTS (?)", device.ID, models.DeviceStatusOnline, s.livePresence(now)).
+		Update("status", models.DeviceStatusOffline)
+	if result.Error != nil {
+		utils.Errorf("[DEVICE] 更新设备 %d 离线状态失败: %v", device.ID, result.Error)
+		return
+	}
+	if result.RowsAffected == 0 {
+		return
+	}
+
+	s.broker.BroadcastEvent(PresenceEvent{
+		Type:       EventPresenceLeft,
+		DeviceID:   device.ID,
+		DeviceType: device.DeviceType,
+		ClientID:   device.ClientID,
+		IP:         device.LastIP,
+		At:         now,
+	}, device.UserID, TargetOthers(device.ID))
+	utils.Infof("[DEVICE] 设备 %d 已离线", device.ID)
+}
+
+// ResolveDevice 根据用户登录凭证连接时上报的信息查找设备记录，已撤销的设备返回ErrDeviceRevoked
+// 每种设备类型只有用户的第一台设备可以通过登录凭证注册，之后的新设备返回ErrDeviceNotPaired，需通过配对获取设备凭证，
+// 避免设备被撤销后以新的设备标识重新接入；按类型计数使升级前已在使用的手机和PC都能以登录凭证完成注册
+func (s *DeviceService) ResolveDevice(userID uint, deviceType string, clientID string) (*models.Device, error) {
+	var device models.Device
+	err := s.db.Where("user_id = ? AND device_type = ? AND client_id = ?", userID, deviceType, clientID).First(&device).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		err = s.db.Transaction(func(tx *gorm.DB) error {
+			// 锁定用户记录，同一用户的并发连接串行地检查和注册设备
+			if err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).Select("id").First(&models.User{}, userID).Error; err != nil {
+				return err
+			}
+			err := tx.Where("user_id = ? AND device_type = ? AND client_id = ?", userID, deviceType, clientID).First(&device).Error
+			if !errors.Is(err, gorm.ErrRecordNotFound) {
+				// 并发的连接已注册该设备
+				return err
+			}
+
+			var count int64
+			if err := tx.Model(&models.Device{}).Where("user_id = ? AND device_type = ?", userID, deviceType).Count(&count).Error; err != nil {
+				return err
+			}
+			if count > 0 {
+				return ErrDeviceNotPaired
+			}
+
+			device = models.Device{UserID: userID, DeviceType: deviceType, ClientID: clientID, Status: models.DeviceStatusOffline}
+			if err := tx.Create(&device).Error; err != nil {
+				return err
+			}
+			utils.Infof("[DEVICE] 用户 %d 已注册第一台%s设备 %d", userID, deviceType, device.ID)
+			return nil
+		})
+	}
+	if err != nil {
+		return nil, err
+	}
+	if device.RevokedAt != nil {
+		return nil, ErrDeviceRevoked
+	}
+	return &device, nil
+}
+
+// AuthenticateToken 校验设备凭证，返回凭证所属的设备
+func (s *DeviceService) AuthenticateToken(token string) (*models.Device, error) {
+	if token == "" {
+		return nil, ErrInvalidDeviceToken
+	}
+	var device models.Device
+	err := s.db.Where("device_token = ?", hashToken(token)).First(&device).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, ErrInvalidDeviceToken
+	}
+	if err != nil {
+		return nil, err
+	}
+	if device.RevokedAt != nil {
+		return nil, ErrDeviceRevoked
+	}
+	return &device, nil
+}
+
+// Connect 设备建立连接，写入本节点的在线记录并将设备标记为在线
+// 设备在本节点的第一个连接建立、且其他节点上没有该设备的有效在线记录时，向用户的其他设备推送上线事件
+func (s *DeviceService) Connect(device *models.Device, ip string) error {
+	now := time.Now()
+
+	s.mux.Lock()
+	s.connections[device.ID]++
+	connections := s.connections[device.ID]
+	s.lastTouched[device.ID] = now
+	s.mux.Unlock()
+
+	joined := false
+	if connections == 1 {
+		var others int64
+		if err := s.db.Model(&models.DevicePresence{}).
+			Where("device_id = ? AND node_id <> ? AND expires_at > ?", device.ID, s.nodeID, now).
+			Count(&others).Error; err != nil {
+			s.release(device.ID)
+			return err
+		}
+		joined = others == 0
+	}
+	if err := s.savePresence(device, connections, now); err != nil {
+		s.release(device.ID)
+		return err
+	}
+
+	// 已有连接的设备保留首次上线时间
+	updates := map[string]interface{}{
+		"status":         models.DeviceStatusOnline,
+		"last_active_at": now,
+		"last_ip":        ip,
+	}
+	if joined || device.ConnectedAt == nil {
+		updates["connected_at"] = now
+		device.ConnectedAt = &now
+	}
+	device.Status = models.DeviceStatusOnline
+	device.LastActiveAt = now
+	device.LastIP = ip
+	if err := s.db.Model(device).Updates(updates).Error; err != nil {
+		if s.release(device.ID) <= 0 {
+			s.deletePresence(device.ID)
+		}
+		return err
+	}
+
+	if connections == 1 {
+		s.mux.Lock()
+		s.devices[device.ID] = device
+		s.mux.Unlock()
+	}
+	if joined {
+		s.broker.BroadcastEvent(PresenceEvent{
+			Type:       EventPresenceJoined,
+			DeviceID:   device.ID,
+			DeviceType: device.DeviceType,
+			ClientID:   device.ClientID,
+			IP:         ip,
+			At:         now,
+		}, device.UserID, TargetOthers(device.ID))
+	}
+
+	utils.Infof("[DEVICE] 设备 %d 已上线，用户ID: %d, 设备类型: %s, IP: %s, 节点: %s", device.ID, device.UserID, device.DeviceType, ip, s.nodeID)
+	return nil
+}
+
+// release 减少设备的连接数，返回剩余连接数
+func (s *DeviceService) release(deviceID uint) int {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	s.connections[deviceID]--
+	remaining := s.connections[deviceID]
+	if remaining <= 0 {
+		delete(s.connections, deviceID)
+		delete(s.lastTouched, deviceID)
+	}
+	return remaining
+}
+
+// Touch 刷新设备最后活跃时间，在间隔内的重复调用会被忽略
+func (s *DeviceService) Touch(deviceID uint) {
+	now := time.Now()
+
+	s.mux.Lock()
+	if now.Sub(s.lastTouched[deviceID]) < deviceTouchInterval {
+		s.mux.Unlock()
+		return
+	}
+	s.lastTouched[deviceID] = now
+	s.mux.Unlock()
+
+	if err := s.db.Model(&models.Device{}).Where("id = ?", deviceID).
+		Update("last_active_at", now).Error; err != nil {
+		utils.Errorf("[DEVICE] 更新设备 %d 活跃时间失败: %v", deviceID, err)
+	}
+}
+
+// Disconnect 设备断开连接，当该设备在本节点上没有其他连接时删除本节点的在线记录
+// 其他节点上也没有该设备的有效在线记录时标记为离线，并向用户的其他设备推送离线事件
+func (s *DeviceService) Disconnect(deviceID uint) {
+	now := time.Now()
+	if remaining := s.release(deviceID); remaining > 0 {
+		if err := s.db.Model(&models.DevicePresence{}).Where("node_id = ? AND device_id = ?", s.nodeID, deviceID).
+			Update("connections", remaining).Error; err != nil {
+			utils.Errorf("[DEVICE] 更新设备 %d 的连接数失败: %v", deviceID, err)
+		}
+		return
+	}
+
+	s.mux.Lock()
+	device := s.devices[deviceID]
+	delete(s.devices, deviceID)
+	s.mux.Unlock()
+
+	s.deletePresence(deviceID)
+	if err := s.db.Model(&models.Device{}).Where("id = ?", deviceID).
+		Update("last_active_at", now).Error; err != nil {
+		utils.Errorf("[DEVICE] 更新设备 %d 活跃时间失败: %v", deviceID, err)
+	}
+	if device == nil {
+		device = &models.Device{ID: deviceID}
+		if err := s.db.First(device).Error; err != nil {
+			utils.Errorf("[DEVICE] 查询设备 %d 失败: %v", deviceID, err)
+			return
+		}
+	}
+	s.markOffline(device, now)
+}
+
+// ListOnlineDevices 获取用户当前在线（在任一节点上有有效在线记录）的设备列表，按上线时间排序
+func (s *DeviceService) ListOnlineDevices(userID uint) ([]models.Device, error) {
+	var devices []models.Device
+	if err := s.db.Where("user_id = ? AND revoked_at IS NULL AND EXISTS (?)", userID, s.livePresence(time.Now())).
+		Order("connected_at").Find(&devices).Error; err != nil {
+		return nil, err
+	}
+	for i := range devices {
+		devices[i].Status = models.DeviceStatusOnline
+	}
+	return devices, nil
+}
+
+// ListDevices 获取用户未撤销的设备列表，deviceType为空时返回所有类型，在线状态以在线记录为准
+func (s *DeviceService) ListDevices(userID uint, deviceType string) ([]models.Device, error) {
+	var devices []models.Device
+	query := s.db.Where("user_id = ? AND revoked_at IS NULL", userID)
+	if deviceType != "" {
+		query = query.Where("device_type = ?", deviceType)
+	}
+	if err := query.Order("last_active_at DESC").Find(&devices).Error; err != nil {
+		return nil, err
+	}
+	if len(devices) == 0 {
+		return devices, nil
+	}
+
+	ids := make([]uint, 0, len(devices))
+	for _, device := range devices {
+		ids = append(ids, device.ID)
+	}
+	var online []uint
+	if err := s.db.Model(&models.DevicePresence{}).Distinct().
+		Where("device_id IN ? AND expires_at > ?", ids, time.Now()).
+		Pluck("device_id", &online).Error; err != nil {
+		return nil, err
+	}
+	for i := range devices {
+		devices[i].Status = models.DeviceStatusOffline
+		if slices.Contains(online, devices[i].ID) {
+			devices[i].Status = models.DeviceStatusOnline
+		}
+	}
+	return devices, nil
+}
+
+// GetDevice 获取用户的设备，不存在或已撤销时返回ErrDeviceNotFound
+func (s *DeviceService) GetDevice(userID uint, deviceID uint) (*models.Device, error) {
+	var device models.Device
+	err := s.db.Where("id = ? AND user_id = ? AND revoked_at IS NULL", deviceID, userID).First(&device).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, ErrDeviceNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &device, nil
+}
+
+// RenameDevice 修改设备名称
+func (s *DeviceService) RenameDevice(userID uint, deviceID uint, name string) (*models.Device, error) {
+	device, err := s.GetDevice(userID, deviceID)
+	if err != nil {
+		return nil, err
+	}
+	if err := s.db.Model(device).Update("name", name).Error; err != nil {
+		return nil, err
+	}
+	device.Name = name
+	return device, nil
+}
+
+// RevokeDevice 撤销设备：作废设备凭证、禁止该设备再次连接，并立即断开其所有连接
+func (s *DeviceService) RevokeDevice(userID uint, deviceID uint) error {
+	device, err := s.GetDevice(userID, deviceID)
+	if err != nil {
+		return err
+	}
+
+	now := time.Now()
+	if err := s.db.Model(device).Updates(map[string]interface{}{
+		"revoked_at":   now,
+		"device_token": "",
+	}).Error; err != nil {
+		return err
+	}
+
+	s.broker.DisconnectDevice(userID, deviceID)
+	utils.Infof("[DEVICE] 设备 %d 已被撤销，用户ID: %d", deviceID, userID)
+	return nil
+}
+
+// IsDeviceToken 判断凭证是否为设备凭证（而非用户登录的JWT）
+func IsDeviceToken(token string) bool {
+	return strings.HasPrefix(token, deviceTokenPrefix)
+}
+
+// newToken 生成带前缀的随机凭证
+func newToken(prefix string) string {
+	b := make([]byte, 32)
+	rand.Read(b)
+	return prefix + hex.EncodeToString(b)
+}
+
+// hashToken 计算凭证的SHA-256哈希
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
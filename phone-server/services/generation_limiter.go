@@ -0,0 +1,172 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"sync"
+)
+
+// Priority AI生成的排队优先级，数值越大越先获得名额，同一优先级按先后顺序
+type Priority int
+
+// AI生成的排队优先级
+const (
+	// PriorityLow 非流式请求，调用方等待完整回答后一次性返回
+	PriorityLow Priority = -1
+	// PriorityNormal 流式请求（WebSocket和SSE），用户在界面上等待逐字输出
+	PriorityNormal Priority = 0
+)
+
+// ErrQueueFull 排队等待的AI生成数量已达上限
+var ErrQueueFull = errors.New("AI服务繁忙，排队人数已满，请稍后重试")
+
+// GenerationLimiter AI生成并发限制器
+// 限制全局和每个用户同时执行的生成数量，超出时按优先级排队；
+// 排在前面的生成因所属用户达到上限而无法执行时，后面其他用户的生成可以先执行
+type GenerationLimiter struct {
+	mu          sync.Mutex
+	maxRunning  int                 // 全局同时执行的生成数量上限，0表示不限制
+	maxPerUser  int                 // 每个用户同时执行的生成数量上限，0表示不限制
+	maxQueue    int                 // 排队等待的生成数量上限，0表示不限制
+	running     int                 // 正在执行的生成数量
+	userRunning map[uint]int        // 按用户统计的正在执行的生成数量
+	queue       []*queuedGeneration // 排队中的生成，按优先级从高到低、同一优先级按先后排序
+}
+
+// queuedGeneration 排队中的生成
+type queuedGeneration struct {
+	userID   uint
+	priority Priority
+	ready    chan struct{} // 获得名额时关闭
+	position chan int      // 排队位置（从1开始），只保留最新的值
+	notified int           // 上次通知的排队位置
+}
+
+// NewGenerationLimiter 创建AI生成并发限制器
+func NewGenerationLimiter(maxRunning int, maxPerUser int, maxQueue int) *GenerationLimiter {
+	return &GenerationLimiter{
+		maxRunning:  maxRunning,
+		maxPerUser:  maxPerUser,
+		maxQueue:    maxQueue,
+		userRunning: make(map[uint]int),
+	}
+}
+
+// Acquire 等待生成名额，返回释放名额的函数
+// 需要排队时，排队位置每次变化都会调用onQueued（可以为nil）；
+// 排队人数已满时返回ErrQueueFull，排队期间上下文取消时退出排队并返回上下文的错误
+func (l *GenerationLimiter) Acquire(ctx context.Context, userID uint, priority Priority, onQueued func(position int)) (func(), error) {
+	g := &queuedGeneration{
+		userID:   userID,
+		priority: priority,
+		ready:    make(chan struct{}),
+		position: make(chan int, 1),
+	}
+
+	l.mu.Lock()
+	l.enqueue(g)
+	l.dispatch()
+	if l.maxQueue > 0 && len(l.queue) > l.maxQueue && l.remove(g) {
+		l.dispatch()
+		l.mu.Unlock()
+		return nil, ErrQueueFull
+	}
+	l.mu.Unlock()
+
+	release := func() {
+		l.mu.Lock()
+		defer l.mu.Unlock()
+		l.running--
+		if l.userRunning[userID]--; l.userRunning[userID] <= 0 {
+			delete(l.userRunning, userID)
+		}
+		l.dispatch()
+	}
+
+	for {
+		select {
+		case <-g.ready:
+			return sync.OnceFunc(release), nil
+		case position := <-g.position:
+			// 位置更新和获得名额同时发生时不再通知排队位置
+			select {
+			case <-g.ready:
+				return sync.OnceFunc(release), nil
+			default:
+			}
+			if onQueued != nil {
+				onQueued(position)
+			}
+		case <-ctx.Done():
+			l.mu.Lock()
+			removed := l.remove(g)
+			if removed {
+				l.dispatch()
+			}
+			l.mu.Unlock()
+			// 取消的同时获得了名额，直接释放
+			if !removed {
+				release()
+			}
+			return nil, ctx.Err()
+		}
+	}
+}
+
+// enqueue 按优先级将生成插入队列，调用方需持有锁
+func (l *GenerationLimiter) enqueue(g *queuedGeneration) {
+	i := len(l.queue)
+	for i > 0 && l.queue[i-1].priority < g.priority {
+		i--
+	}
+	l.queue = append(l.queue, nil)
+	copy(l.queue[i+1:], l.queue[i:])
+	l.queue[i] = g
+}
+
+// remove 将生成移出队列，生成已获得名额时返回false，调用方需持有锁
+func (l *GenerationLimiter) remove(g *queuedGeneration) bool {
+	for i, queued := range l.queue {
+		if queued == g {
+			l.queue = append(l.queue[:i], l.queue[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+// dispatch 按顺序为可以执行的生成分配名额，并通知其余生成新的排队位置，调用方需持有锁
+func (l *GenerationLimiter) dispatch() {
+	waiting := l.queue[:0]
+	for _, g := range l.queue {
+		if l.available(g.userID) {
+			l.running++
+			l.userRunning[g.userID]++
+			close(g.ready)
+			continue
+		}
+		waiting = append(waiting, g)
+	}
+	clear(l.queue[len(waiting):])
+	l.queue = waiting
+
+	for i, g := range l.queue {
+		if position := i + 1; position != g.notified {
+			g.notified = position
+			// 丢弃尚未读取的旧位置，只保留最新的位置
+			select {
+			case <-g.position:
+			default:
+			}
+			g.position <- position
+		}
+	}
+}
+
+// available 用户是否可以再执行一个生成，调用方需持有锁
+func (l *GenerationLimiter) available(userID uint) bool {
+	if l.maxRunning > 0 && l.running >= l.maxRunning {
+		return false
+	}
+	return l.maxPerUser <= 0 || l.userRunning[userID] < l.maxPerUser
+}
@@ -0,0 +1,230 @@
+package services
+
+import (
+	"sync"
+
+	"phone-server/models"
+	"phone-server/utils"
+
+	"github.com/gorilla/websocket"
+)
+
+// MemoryBroker 进程内消息广播服务，投递给本进程内的连接
+type MemoryBroker struct {
+	config     BrokerConfig              // 广播服务配置
+	stats      brokerStats               // 统计信息
+	clients    map[uint]map[*Client]bool // 客户端连接集合，按用户ID分组
+	clientsMux sync.Mutex                // 保护clients的互斥锁
+	register   chan *Client              // 注册客户端的通道
+	unregister chan *Client              // 注销客户端的通道
+	broadcast  chan broadcastRequest     // 广播消息的通道
+}
+
+// NewMemoryBroker 创建进程内消息广播服务实例
+func NewMemoryBroker(config BrokerConfig) *MemoryBroker {
+	return &MemoryBroker{
+		config:     config,
+		clients:    make(map[uint]map[*Client]bool),
+		register:   make(chan *Client),
+		unregister: make(chan *Client),
+		broadcast:  make(chan broadcastRequest),
+	}
+}
+
+// Start 启动消息广播服务
+func (b *MemoryBroker) Start() {
+	for {
+		select {
+		// 注册新客户端
+		case client := <-b.register:
+			b.clientsMux.Lock()
+			// 如果用户ID对应的客户端映射不存在，则创建
+			if _, ok := b.clients[client.userID]; !ok {
+				b.clients[client.userID] = make(map[*Client]bool)
+			}
+			// 将客户端添加到用户ID对应的映射中
+			b.clients[client.userID][client] = true
+			b.clientsMux.Unlock()
+			utils.Infof("用户 %d 的ws客户端:%s已连接", client.userID, client.remoteAddr)
+
+		// 注销客户端
+		case client := <-b.unregister:
+			b.clientsMux.Lock()
+			// 检查用户ID对应的客户端映射是否存在
+			if clientMap, ok := b.clients[client.userID]; ok {
+				// 检查客户端是否存在于映射中
+				if _, ok := clientMap[client]; ok {
+					// 移除客户端
+					delete(clientMap, client)
+					utils.Infof("用户 %d 的ws客户端:%s已断开连接", client.userID, client.remoteAddr)
+					// 如果用户ID对应的客户端映射为空，则删除该映射
+					if len(clientMap) == 0 {
+						delete(b.clients, client.userID)
+					}
+				}
+			}
+			b.clientsMux.Unlock()
+			// 关闭连接，写协程退出时会关闭底层连接
+			client.Close()
+
+		// 广播消息给特定用户的所有客户端
+		case msg := <-b.broadcast:
+			// 按各连接的协议版本编码消息
+			enc := &encoder{encoded: make(map[int][]byte)}
+			messageID, msgType := uint(0), ""
+			if msg.message != nil {
+				enc.frameType, enc.payload = models.FrameMessage, msg.message
+				messageID, msgType = msg.message.ID, string(msg.message.Type)
+			} else {
+				enc.frameType, enc.payload = msg.event.EventType(), msg.event
+				msgType = msg.event.EventType()
+			}
+
+			b.clientsMux.Lock()
+			// 将消息放入特定用户目标客户端的发送队列，不会因单个慢客户端而阻塞
+			if clientMap, ok := b.clients[msg.userID]; ok {
+				delivered := 0
+				for client := range clientMap {
+					if !msg.target.Matches(client.deviceID, client.deviceType) {
+						continue
+					}
+					msgBytes, err := enc.encode(client.protocol)
+					if err != nil {
+						utils.Errorf("消息序列化失败: %v", err)
+						break
+					}
+					delivered++
+					if !client.deliver(messageID, msgBytes) {
+						select {
+						case <-client.Done():
+							// 连接已关闭，从集合中移除
+							delete(clientMap, client)
+						default:
+						}
+					}
+				}
+				utils.Infof("已向用户 %d 广播消息，类型: %s，目标: %s，客户端数: %d", msg.userID, msgType, msg.target.Target, delivered)
+				if len(clientMap) == 0 {
+					delete(b.clients, msg.userID)
+				}
+			}
+			b.clientsMux.Unlock()
+		}
+	}
+}
+
+// RegisterClient 注册设备的WebSocket客户端，并启动该连接的写协程
+// replay为true时，实时广播会暂存到客户端，直到调用Client.FinishReplay完成离线消息重放
+func (b *MemoryBroker) RegisterClient(conn *websocket.Conn, device *models.Device, protocol int, replay bool) *Client {
+	client := newClient(conn, device, conn.RemoteAddr().String(), protocol, replay, b.config, &b.stats)
+	go client.writePump()
+	b.register <- client
+	return client
+}
+
+// Subscribe 注册不经由WebSocket传输的订阅者（如SSE），调用方通过Client.Frames消费发送队列
+// 订阅者与WebSocket客户端共用同一套广播和断线重放逻辑，结束时需调用UnregisterClient
+func (b *MemoryBroker) Subscribe(device *models.Device, remoteAddr string, protocol int, replay bool) *Client {
+	client := newClient(nil, device, remoteAddr, protocol, replay, b.config, &b.stats)
+	b.register <- client
+	return client
+}
+
+// UnregisterClient 注销WebSocket客户端
+func (b *MemoryBroker) UnregisterClient(client *Client) {
+	b.unregister <- client
+}
+
+// BroadcastMessage 按消息的投递目标广播给特定用户的客户端
+func (b *MemoryBroker) BroadcastMessage(message *models.Message, userID uint) {
+	b.broadcast <- broadcastRequest{message: message, userID: userID, target: targetOf(message)}
+}
+
+// BroadcastEvent 广播事件给特定用户的目标客户端，事件不会持久化也不参与断线重放
+func (b *MemoryBroker) BroadcastEvent(event Event, userID uint, target BroadcastTarget) {
+	b.broadcast <- broadcastRequest{event: event, userID: userID, target: target}
+}
+
+// DisconnectDevice 断开本节点上设备的所有连接
+func (b *MemoryBroker) DisconnectDevice(userID uint, deviceID uint) {
+	b.clientsMux.Lock()
+	defer b.clientsMux.Unlock()
+	count := 0
+	for client := range b.clients[userID] {
+		if client.deviceID == deviceID {
+			client.closeWithCode(CloseDeviceRevoked, "device revoked")
+			count++
+		}
+	}
+	if count > 0 {
+		utils.Infof("已断开用户 %d 的设备 %d 的 %d 个连接", userID, deviceID, count)
+	}
+}
+
+// GetClientCount 获取当前客户端连接数
+func (b *MemoryBroker) GetClientCount() int {
+	b.clientsMux.Lock()
+	defer b.clientsMux.Unlock()
+	total := 0
+	for _, clientMap := range b.clients {
+		total += len(clientMap)
+	}
+	return total
+}
+
+// GetClientCountByUserID 获取特定用户的客户端连接数
+func (b *MemoryBroker) GetClientCountByUserID(userID uint) int {
+	b.clientsMux.Lock()
+	defer b.clientsMux.Unlock()
+	if clientMap, ok := b.clients[userID]; ok {
+		return len(clientMap)
+	}
+	return 0
+}
+
+// GetClientCountByDeviceType 获取特定用户某类设备的客户端连接数
+func (b *MemoryBroker) GetClientCountByDeviceType(userID uint, deviceType string) int {
+	b.clientsMux.Lock()
+	defer b.clientsMux.Unlock()
+	count := 0
+	for client := range b.clients[userID] {
+		if client.deviceType == deviceType {
+			count++
+		}
+	}
+	return count
+}
+
+// GetClientStatsByUserID 获取特定用户各连接的发送队列统计信息
+func (b *MemoryBroker) GetClientStatsByUserID(userID uint) []ClientStats {
+	b.clientsMux.Lock()
+	defer b.clientsMux.Unlock()
+	stats := make([]ClientStats, 0, len(b.clients[userID]))
+	for client := range b.clients[userID] {
+		stats = append(stats, client.Stats())
+	}
+	return stats
+}
+
+// GetQueuedMessageCount 获取所有连接发送队列中待发送的消息总数
+func (b *MemoryBroker) GetQueuedMessageCount() int {
+	b.clientsMux.Lock()
+	defer b.clientsMux.Unlock()
+	total := 0
+	for _, clientMap := range b.clients {
+		for client := range clientMap {
+			total += len(client.send)
+		}
+	}
+	return total
+}
+
+// GetDroppedMessageCount 获取因发送队列积压而丢弃的消息总数
+func (b *MemoryBroker) GetDroppedMessageCount() uint64 {
+	return b.stats.droppedMessages.Load()
+}
+
+// GetSlowConsumerDisconnectCount 获取因发送队列积压而断开的连接总数
+func (b *MemoryBroker) GetSlowConsumerDisconnectCount() uint64 {
+	return b.stats.slowConsumerDisconnects.Load()
+}
@@ -0,0 +1,307 @@
+package services
+
+import (
+	"bufio"
+	"crypto/subtle"
+	"encoding/json"
+	"net"
+	"sync/atomic"
+	"time"
+
+	"phone-server/models"
+	"phone-server/utils"
+)
+
+const (
+	// maxMeshFrameSize 节点间单帧的最大字节数，需容纳base64编码的图片消息
+	maxMeshFrameSize = 32 * 1024 * 1024
+	// meshQueueSize 每个对端节点的待转发队列长度
+	meshQueueSize = 1024
+	// meshDialTimeout 连接对端节点的超时时间
+	meshDialTimeout = 5 * time.Second
+	// meshHandshakeTimeout 等待对端握手的超时时间
+	meshHandshakeTimeout = 10 * time.Second
+	// meshWriteTimeout 向对端节点单次写入的超时时间
+	meshWriteTimeout = 10 * time.Second
+	// meshMaxBackoff 重连对端节点的最大间隔
+	meshMaxBackoff = 30 * time.Second
+)
+
+// MeshConfig 节点互联配置
+type MeshConfig struct {
+	NodeID     string   // 本节点ID，用于识别并忽略自身转发的广播
+	ListenAddr string   // 接收其他节点转发的监听地址
+	Peers      []string // 其他节点的监听地址
+	Secret     string   // 节点间认证密钥
+}
+
+// meshHello 节点间连接的握手帧
+type meshHello struct {
+	Node   string `json:"node"`   // 发起连接的节点ID
+	Secret string `json:"secret"` // 认证密钥
+}
+
+// meshFrame 节点间转发的广播
+type meshFrame struct {
+	Node      string          `json:"node"`                 // 发起广播的节点ID
+	UserID    uint            `json:"user_id"`              // 目标用户ID
+	Target    BroadcastTarget `json:"target"`               // 投递目标
+	Message   *models.Message `json:"message,omitempty"`    // 广播的消息
+	EventType string          `json:"event_type,omitempty"` // 广播的事件类型
+	Event     json.RawMessage `json:"event,omitempty"`      // 广播的事件内容
+
+	DisconnectDeviceID uint `json:"disconnect_device_id,omitempty"` // 需要断开所有连接的设备ID
+}
+
+// remoteEvent 其他节点转发来的事件，原样投递给本节点的客户端
+type remoteEvent struct {
+	eventType string          // 事件类型
+	payload   json.RawMessage // 事件内容
+}
+
+// EventType 事件类型
+func (e remoteEvent) EventType() string {
+	return e.eventType
+}
+
+// MarshalJSON 原样输出事件内容
+func (e remoteEvent) MarshalJSON() ([]byte, error) {
+	return e.payload, nil
+}
+
+// meshPeer 对端节点的出站连接
+type meshPeer struct {
+	addr    string        // 对端节点地址
+	queue   chan []byte   // 待转发的广播
+	retry   []byte        // 连接断开时未能写出的广播，重连后首先发送，仅由dial协程访问
+	dropped atomic.Uint64 // 因队列积压丢弃的广播数
+}
+
+// newMeshPeer 创建对端节点
+func newMeshPeer(addr string) *meshPeer {
+	return &meshPeer{
+		addr:  addr,
+		queue: make(chan []byte, meshQueueSize),
+	}
+}
+
+// MeshBroker 多节点消息广播服务
+// 本节点的广播先投递给本地连接，再通过TCP转发给所有对端节点，由对端投递给其本地连接
+// 节点之间两两互联（每个节点都需要在peers中列出其他所有节点），转发的广播不会再次转发
+type MeshBroker struct {
+	*MemoryBroker
+	config   MeshConfig   // 节点互联配置
+	listener net.Listener // 接收对端转发的监听器
+	peers    []*meshPeer  // 对端节点
+}
+
+// NewMeshBroker 创建多节点消息广播服务实例，并开始监听对端节点的连接
+func NewMeshBroker(config BrokerConfig, mesh MeshConfig) (*MeshBroker, error) {
+	listener, err := net.Listen("tcp", mesh.ListenAddr)
+	if err != nil {
+		return nil, err
+	}
+
+	peers := make([]*meshPeer, 0, len(mesh.Peers))
+	for _, addr := range mesh.Peers {
+		peers = append(peers, newMeshPeer(addr))
+	}
+
+	return &MeshBroker{
+		MemoryBroker: NewMemoryBroker(config),
+		config:       mesh,
+		listener:     listener,
+		peers:        peers,
+	}, nil
+}
+
+// Start 启动消息广播服务，同时接收对端节点的转发并维护到对端节点的连接
+func (b *MeshBroker) Start() {
+	go b.accept()
+	for _, peer := range b.peers {
+		go b.dial(peer)
+	}
+	utils.Infof("[MESH] 节点 %s 已启动，监听地址: %s，对端节点: %v", b.config.NodeID, b.config.ListenAddr, b.config.Peers)
+	b.MemoryBroker.Start()
+}
+
+// BroadcastMessage 投递给本节点的客户端，并转发给所有对端节点
+func (b *MeshBroker) BroadcastMessage(message *models.Message, userID uint) {
+	b.MemoryBroker.BroadcastMessage(message, userID)
+	b.publish(meshFrame{Node: b.config.NodeID, UserID: userID, Target: targetOf(message), Message: message})
+}
+
+// BroadcastEvent 投递给本节点的客户端，并转发给所有对端节点
+func (b *MeshBroker) BroadcastEvent(event Event, userID uint, target BroadcastTarget) {
+	b.MemoryBroker.BroadcastEvent(event, userID, target)
+
+	payload, err := json.Marshal(event)
+	if err != nil {
+		utils.Errorf("[MESH] 事件序列化失败: %v", err)
+		return
+	}
+	b.publish(meshFrame{Node: b.config.NodeID, UserID: userID, Target: target, EventType: event.EventType(), Event: payload})
+}
+
+// DisconnectDevice 断开本节点上设备的所有连接，并通知所有对端节点断开
+func (b *MeshBroker) DisconnectDevice(userID uint, deviceID uint) {
+	b.MemoryBroker.DisconnectDevice(userID, deviceID)
+	b.publish(meshFrame{Node: b.config.NodeID, UserID: userID, DisconnectDeviceID: deviceID})
+}
+
+// GetPeerDroppedCount 获取因对端队列积压而未能转发的广播总数
+func (b *MeshBroker) GetPeerDroppedCount() uint64 {
+	var total uint64
+	for _, peer := range b.peers {
+		total += peer.dropped.Load()
+	}
+	return total
+}
+
+// publish 将广播放入所有对端节点的转发队列，队列已满时丢弃最旧的广播
+func (b *MeshBroker) publish(frame meshFrame) {
+	if len(b.peers) == 0 {
+		return
+	}
+	data, err := json.Marshal(frame)
+	if err != nil {
+		utils.Errorf("[MESH] 广播序列化失败: %v", err)
+		return
+	}
+
+	for _, peer := range b.peers {
+		select {
+		case peer.queue <- data:
+			continue
+		default:
+		}
+		select {
+		case <-peer.queue:
+			peer.dropped.Add(1)
+		default:
+		}
+		select {
+		case peer.queue <- data:
+		default:
+			peer.dropped.Add(1)
+		}
+		utils.Warnf("[MESH] 对端节点 %s 转发队列已满，已丢弃最旧的广播", peer.addr)
+	}
+}
+
+// dial 维护到对端节点的出站连接，断开后按指数退避重连
+func (b *MeshBroker) dial(peer *meshPeer) {
+	backoff := time.Second
+	for {
+		conn, err := net.DialTimeout("tcp", peer.addr, meshDialTimeout)
+		if err != nil {
+			utils.Warnf("[MESH] 连接对端节点 %s 失败: %v，%v后重试", peer.addr, err, backoff)
+			time.Sleep(backoff)
+			backoff = min(backoff*2, meshMaxBackoff)
+			continue
+		}
+		backoff = time.Second
+		utils.Infof("[MESH] 已连接对端节点 %s", peer.addr)
+
+		if err := b.forward(conn, peer); err != nil {
+			utils.Warnf("[MESH] 与对端节点 %s 的连接已断开: %v", peer.addr, err)
+		}
+		conn.Close()
+	}
+}
+
+// forward 发送握手帧后，将转发队列中的广播依次写入连接
+// 写入失败的广播保存在peer.retry中，重连后首先发送，不会因连接断开而丢失；写入中断时对端可能重复收到该广播
+func (b *MeshBroker) forward(conn net.Conn, peer *meshPeer) error {
+	writer := bufio.NewWriter(conn)
+	hello, err := json.Marshal(meshHello{Node: b.config.NodeID, Secret: b.config.Secret})
+	if err != nil {
+		return err
+	}
+
+	write := func(data []byte) error {
+		conn.SetWriteDeadline(time.Now().Add(meshWriteTimeout))
+		if _, err := writer.Write(data); err != nil {
+			return err
+		}
+		if err := writer.WriteByte('\n'); err != nil {
+			return err
+		}
+		return writer.Flush()
+	}
+
+	if err := write(hello); err != nil {
+		return err
+	}
+	if peer.retry != nil {
+		if err := write(peer.retry); err != nil {
+			return err
+		}
+		peer.retry = nil
+	}
+	for data := range peer.queue {
+		if err := write(data); err != nil {
+			peer.retry = data
+			return err
+		}
+	}
+	return nil
+}
+
+// accept 接收对端节点的入站连接
+func (b *MeshBroker) accept() {
+	for {
+		conn, err := b.listener.Accept()
+		if err != nil {
+			utils.Errorf("[MESH] 接收对端节点连接失败: %v", err)
+			time.Sleep(time.Second)
+			continue
+		}
+		go b.receive(conn)
+	}
+}
+
+// receive 校验对端握手后，将对端转发的广播投递给本节点的客户端
+func (b *MeshBroker) receive(conn net.Conn) {
+	defer conn.Close()
+	remoteAddr := conn.RemoteAddr().String()
+
+	scanner := bufio.NewScanner(conn)
+	scanner.Buffer(make([]byte, 64*1024), maxMeshFrameSize)
+
+	// 校验握手帧
+	conn.SetReadDeadline(time.Now().Add(meshHandshakeTimeout))
+	if !scanner.Scan() {
+		utils.Warnf("[MESH] 读取对端 %s 握手帧失败: %v", remoteAddr, scanner.Err())
+		return
+	}
+	var hello meshHello
+	if err := json.Unmarshal(scanner.Bytes(), &hello); err != nil ||
+		subtle.ConstantTimeCompare([]byte(hello.Secret), []byte(b.config.Secret)) != 1 {
+		utils.Warnf("[MESH] 对端 %s 认证失败，已断开", remoteAddr)
+		return
+	}
+	conn.SetReadDeadline(time.Time{})
+	utils.Infof("[MESH] 对端节点 %s（%s）已接入", hello.Node, remoteAddr)
+
+	for scanner.Scan() {
+		var frame meshFrame
+		if err := json.Unmarshal(scanner.Bytes(), &frame); err != nil {
+			utils.Errorf("[MESH] 解析对端 %s 转发的广播失败: %v", hello.Node, err)
+			continue
+		}
+		if frame.Node == b.config.NodeID {
+			// 自身发起的广播，已在本地投递
+			continue
+		}
+
+		if frame.DisconnectDeviceID != 0 {
+			b.MemoryBroker.DisconnectDevice(frame.UserID, frame.DisconnectDeviceID)
+		} else if frame.Message != nil {
+			b.MemoryBroker.BroadcastMessage(frame.Message, frame.UserID)
+		} else if frame.EventType != "" {
+			b.MemoryBroker.BroadcastEvent(remoteEvent{eventType: frame.EventType, payload: frame.Event}, frame.UserID, frame.Target)
+		}
+	}
+	utils.Warnf("[MESH] 对端节点 %s（%s）已断开: %v", hello.Node, remoteAddr, scanner.Err())
+}
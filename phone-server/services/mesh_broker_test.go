@@ -0,0 +1,175 @@
+package services
+
+import (
+	"bufio"
+	"encoding/json"
+	"net"
+	"testing"
+	"time"
+
+	"phone-server/models"
+)
+
+// meshTestTimeout 等待跨节点投递的超时时间
+const meshTestTimeout = 5 * time.Second
+
+// startTestMesh 在127.0.0.1的随机端口上启动count个两两互联的节点
+func startTestMesh(t *testing.T, count int, secret string) []*MeshBroker {
+	t.Helper()
+	config := BrokerConfig{SendQueueSize: 16, WriteTimeout: time.Second, SlowConsumerPolicy: SlowConsumerDisconnect, PingInterval: time.Second}
+	brokers := make([]*MeshBroker, count)
+	for i := range brokers {
+		broker, err := NewMeshBroker(config, MeshConfig{NodeID: string(rune('a' + i)), ListenAddr: "127.0.0.1:0", Secret: secret})
+		if err != nil {
+			t.Fatalf("NewMeshBroker: %v", err)
+		}
+		brokers[i] = broker
+	}
+	// 监听地址在创建后才确定，因此在启动前补充对端节点
+	for i, broker := range brokers {
+		for j, peer := range brokers {
+			if i != j {
+				broker.config.Peers = append(broker.config.Peers, peer.listener.Addr().String())
+				broker.peers = append(broker.peers, newMeshPeer(peer.listener.Addr().String()))
+			}
+		}
+	}
+	for _, broker := range brokers {
+		go broker.Start()
+	}
+	return brokers
+}
+
+// subscribeTestDevice 在节点上订阅用户1的设备
+func subscribeTestDevice(broker Broker, deviceID uint) *Client {
+	device := &models.Device{ID: deviceID, UserID: 1, DeviceType: models.DeviceTypePhone}
+	return broker.Subscribe(device, "test", models.ProtocolVersion, false)
+}
+
+// expectFrame 等待客户端收到一帧
+func expectFrame(t *testing.T, client *Client) OutboundFrame {
+	t.Helper()
+	select {
+	case frame := <-client.Frames():
+		return frame
+	case <-time.After(meshTestTimeout):
+		t.Fatal("等待跨节点投递超时")
+		return OutboundFrame{}
+	}
+}
+
+func TestMeshBroadcastFansOut(t *testing.T) {
+	brokers := startTestMesh(t, 3, "secret")
+	clients := make([]*Client, len(brokers))
+	for i, broker := range brokers {
+		clients[i] = subscribeTestDevice(broker, uint(i+1))
+	}
+
+	// 每个节点发起的广播都投递给所有节点上的连接，且每个连接只收到一次
+	for i, broker := range brokers {
+		id := uint(100 + i)
+		broker.BroadcastMessage(&models.Message{ID: id, UserID: 1, Type: models.MessageTypeText, Target: models.MessageTargetAll}, 1)
+		for j, client := range clients {
+			if frame := expectFrame(t, client); frame.MessageID != id {
+				t.Fatalf("节点 %d 的连接收到消息 %d，期望 %d", j, frame.MessageID, id)
+			}
+		}
+	}
+
+	// 事件同样跨节点投递
+	brokers[0].BroadcastEvent(PresenceEvent{Type: EventPresenceJoined, DeviceID: 1}, 1, BroadcastTarget{Target: models.MessageTargetAll})
+	for j, client := range clients {
+		frame := expectFrame(t, client)
+		var env models.Envelope
+		if err := json.Unmarshal(frame.Data, &env); err != nil || env.Type != EventPresenceJoined {
+			t.Fatalf("节点 %d 的连接收到 %s，期望presence事件", j, frame.Data)
+		}
+	}
+}
+
+func TestMeshDisconnectDevicePropagates(t *testing.T) {
+	brokers := startTestMesh(t, 3, "secret")
+	revoked := subscribeTestDevice(brokers[2], 7)
+	other := subscribeTestDevice(brokers[2], 8)
+
+	brokers[0].DisconnectDevice(1, 7)
+	select {
+	case <-revoked.Done():
+	case <-time.After(meshTestTimeout):
+		t.Fatal("其他节点上被撤销设备的连接未断开")
+	}
+	select {
+	case <-other.Done():
+		t.Fatal("其他设备的连接被断开")
+	default:
+	}
+}
+
+func TestMeshRejectsWrongSecret(t *testing.T) {
+	brokers := startTestMesh(t, 2, "secret")
+	client := subscribeTestDevice(brokers[1], 1)
+
+	// 密钥错误的节点转发的广播被拒绝
+	intruder, err := NewMeshBroker(brokers[0].MemoryBroker.config, MeshConfig{
+		NodeID: "intruder", ListenAddr: "127.0.0.1:0", Secret: "wrong",
+		Peers: []string{brokers[1].listener.Addr().String()},
+	})
+	if err != nil {
+		t.Fatalf("NewMeshBroker: %v", err)
+	}
+	go intruder.Start()
+	intruder.BroadcastMessage(&models.Message{ID: 1, UserID: 1, Target: models.MessageTargetAll}, 1)
+
+	// 密钥正确的节点转发的广播正常投递，且在此之前没有收到入侵节点的广播
+	brokers[0].BroadcastMessage(&models.Message{ID: 2, UserID: 1, Target: models.MessageTargetAll}, 1)
+	if frame := expectFrame(t, client); frame.MessageID != 2 {
+		t.Fatalf("收到消息 %d，期望只收到密钥正确的节点转发的消息2", frame.MessageID)
+	}
+	select {
+	case frame := <-client.Frames():
+		t.Fatalf("收到密钥错误的节点转发的消息 %d", frame.MessageID)
+	case <-time.After(200 * time.Millisecond):
+	}
+}
+
+func TestMeshForwardKeepsFailedFrame(t *testing.T) {
+	broker := &MeshBroker{config: MeshConfig{NodeID: "a", Secret: "secret"}}
+	peer := newMeshPeer("pipe")
+	peer.queue <- []byte(`{"node":"a","user_id":1}`)
+
+	// 对端读取握手帧后断开，正在写入的广播保存到retry
+	local, remote := net.Pipe()
+	go func() {
+		bufio.NewReader(remote).ReadBytes('\n')
+		remote.Close()
+	}()
+	if err := broker.forward(local, peer); err == nil {
+		t.Fatal("期望写入失败")
+	}
+	if string(peer.retry) != `{"node":"a","user_id":1}` {
+		t.Fatalf("retry = %q，期望保存写入失败的广播", peer.retry)
+	}
+
+	// 重连后首先发送retry中的广播；关闭队列使forward在发送完毕后返回
+	close(peer.queue)
+	local, remote = net.Pipe()
+	lines := make(chan string, 2)
+	go func() {
+		reader := bufio.NewReader(remote)
+		for range 2 {
+			line, _ := reader.ReadString('\n')
+			lines <- line
+		}
+		remote.Close()
+	}()
+	if err := broker.forward(local, peer); err != nil {
+		t.Fatalf("forward: %v", err)
+	}
+	<-lines
+	if line := <-lines; line != "{\"node\":\"a\",\"user_id\":1}\n" {
+		t.Fatalf("重连后发送 %q，期望首先发送retry中的广播", line)
+	}
+	if peer.retry != nil {
+		t.Fatal("retry发送后未清空")
+	}
+}
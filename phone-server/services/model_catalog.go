@@ -0,0 +1,96 @@
+package services
+
+import (
+	"errors"
+	"fmt"
+	"slices"
+)
+
+// ModelCapability 模型能力
+type ModelCapability string
+
+// 模型能力
+const (
+	// CapabilityVision 支持图片输入
+	CapabilityVision ModelCapability = "vision"
+	// CapabilityThinking 支持输出思考过程
+	CapabilityThinking ModelCapability = "thinking"
+	// CapabilityTools 支持工具调用
+	CapabilityTools ModelCapability = "tools"
+)
+
+// ErrUnsupportedModel 请求的模型不在模型目录中，或不支持请求中的图片或思考模式
+var ErrUnsupportedModel = errors.New("不支持的模型")
+
+// ModelInfo 模型目录中的一个模型
+type ModelInfo struct {
+	Name          string            `json:"name"`               // 模型名称，请求时在model字段中指定
+	DisplayName   string            `json:"display_name"`       // 显示名称
+	Provider      string            `json:"provider"`           // 对话服务提供方
+	Capabilities  []ModelCapability `json:"capabilities"`       // 模型能力
+	ContextWindow int               `json:"context_window"`     // 上下文窗口（token），0表示未配置
+	InputPrice    float64           `json:"input_price"`        // 每百万输入token的价格
+	OutputPrice   float64           `json:"output_price"`       // 每百万输出token的价格
+	Currency      string            `json:"currency,omitempty"` // 价格的币种
+	Default       bool              `json:"default"`            // 是否为未指定模型时使用的默认模型
+}
+
+// Supports 模型是否具备指定能力
+func (m ModelInfo) Supports(capability ModelCapability) bool {
+	return slices.Contains(m.Capabilities, capability)
+}
+
+// ModelCatalog 模型目录，请求只能使用目录中的模型，且请求内容需要与模型能力相符
+type ModelCatalog struct {
+	models       []ModelInfo // 按配置顺序排列的模型
+	defaultModel string      // 默认模型
+}
+
+// NewModelCatalog 创建模型目录，defaultModel必须在models中
+func NewModelCatalog(models []ModelInfo, defaultModel string) *ModelCatalog {
+	for i := range models {
+		if models[i].DisplayName == "" {
+			models[i].DisplayName = models[i].Name
+		}
+		models[i].Default = models[i].Name == defaultModel
+	}
+	return &ModelCatalog{models: models, defaultModel: defaultModel}
+}
+
+// Default 默认模型名称
+func (c *ModelCatalog) Default() string {
+	return c.defaultModel
+}
+
+// List 按配置顺序列出所有模型
+func (c *ModelCatalog) List() []ModelInfo {
+	return c.models
+}
+
+// Get 按名称获取模型
+func (c *ModelCatalog) Get(name string) (ModelInfo, bool) {
+	for _, model := range c.models {
+		if model.Name == name {
+			return model, true
+		}
+	}
+	return ModelInfo{}, false
+}
+
+// Check 检查模型是否在目录中，以及是否支持请求中的图片和思考模式，不符合时返回包装了ErrUnsupportedModel的错误
+// 思考模式为auto或disabled时不要求模型具备思考能力
+func (c *ModelCatalog) Check(name string, request ChatRequest) error {
+	model, ok := c.Get(name)
+	if !ok {
+		return fmt.Errorf("%w：%s", ErrUnsupportedModel, name)
+	}
+	for _, message := range request.Messages {
+		if message.ImageCount() > 0 && !model.Supports(CapabilityVision) {
+			return fmt.Errorf("%w：%s 不支持图片", ErrUnsupportedModel, name)
+		}
+	}
+	if request.Thinking == ThinkingEnabled && !model.Supports(CapabilityThinking) {
+		return fmt.Errorf("%w：%s 不支持思考模式", ErrUnsupportedModel, name)
+	}
+	return nil
+}
@@ -0,0 +1,218 @@
+package services
+
+import (
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"math/big"
+	"time"
+
+	"phone-server/models"
+	"phone-server/utils"
+
+	"gorm.io/gorm"
+)
+
+const (
+	// pairingCodeTTL 配对码的有效期
+	pairingCodeTTL = 2 * time.Minute
+	// pairingCodeLength 配对码长度
+	pairingCodeLength = 8
+	// pairingCodeAlphabet 配对码字符集，去掉了易混淆的0/O、1/I/L
+	pairingCodeAlphabet = "23456789ABCDEFGHJKMNPQRSTUVWXYZ"
+	// pairingSecretPrefix 配对轮询凭据的前缀
+	pairingSecretPrefix = "ps_"
+	// PairingQRScheme 配对二维码内容的格式，手机端扫码后解析出配对码
+	PairingQRScheme = "phoneapp://pair?code=%s"
+)
+
+var (
+	// ErrPairingNotFound 配对码不存在或已过期
+	ErrPairingNotFound = errors.New("配对码不存在或已过期")
+	// ErrPairingClaimed 配对码已被认领
+	ErrPairingClaimed = errors.New("配对码已被认领")
+)
+
+// PairingResult 申请方查询配对结果
+type PairingResult struct {
+	Claimed     bool   `json:"claimed"`                // 是否已被认领
+	UserID      uint   `json:"user_id,omitempty"`      // 认领的用户ID
+	DeviceID    uint   `json:"device_id,omitempty"`    // 签发凭证的设备ID
+	DeviceToken string `json:"device_token,omitempty"` // 设备凭证，仅在认领后的第一次查询中返回
+}
+
+// PairingService 设备配对服务
+// 申请方申请配对码，已登录的手机端认领后，服务端为申请方创建设备记录；申请方凭轮询凭据查询结果时签发设备凭证
+// 配对状态保存在数据库中，多实例部署时申请和认领可以落在不同节点
+type PairingService struct {
+	db *gorm.DB // 数据库连接
+}
+
+// NewPairingService 创建设备配对服务实例
+func NewPairingService(db *gorm.DB) *PairingService {
+	return &PairingService{
+		db: db,
+	}
+}
+
+// CreatePairing 申请配对码，返回配对记录和申请方轮询配对结果所需的凭据
+func (s *PairingService) CreatePairing(deviceType string, clientID string, name string) (*models.PairingCode, string, error) {
+	// 清理已过期的配对码
+	if err := s.db.Where("expires_at < ?", time.Now()).Delete(&models.PairingCode{}).Error; err != nil {
+		utils.Errorf("[PAIRING] 清理过期配对码失败: %v", err)
+	}
+
+	code, err := newPairingCode()
+	if err != nil {
+		return nil, "", err
+	}
+	secret := newToken(pairingSecretPrefix)
+	pairing := &models.PairingCode{
+		Code:       code,
+		SecretHash: hashToken(secret),
+		DeviceType: deviceType,
+		ClientID:   clientID,
+		Name:       name,
+		ExpiresAt:  time.Now().Add(pairingCodeTTL),
+	}
+	if err := s.db.Create(pairing).Error; err != nil {
+		return nil, "", err
+	}
+
+	utils.Infof("[PAIRING] 已创建配对码，过期时间: %s", pairing.ExpiresAt.Format(time.RFC3339))
+	return pairing, secret, nil
+}
+
+// GetPairingResult 申请方使用轮询凭据查询配对结果
+// 认领后的第一次查询删除配对记录，并为设备签发新的设备凭证，凭证只会返回一次
+func (s *PairingService) GetPairingResult(code string, secret string) (*PairingResult, error) {
+	var result *PairingResult
+	err := s.db.Transaction(func(tx *gorm.DB) error {
+		var pairing models.PairingCode
+		err := tx.Where("code = ? AND secret_hash = ? AND expires_at >= ?", code, hashToken(secret), time.Now()).
+			First(&pairing).Error
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return ErrPairingNotFound
+		}
+		if err != nil {
+			return err
+		}
+
+		if pairing.ClaimedAt == nil {
+			result = &PairingResult{Claimed: false}
+			return nil
+		}
+
+		// 删除配对记录，并发查询时只有成功删除的一方取得凭证
+		deleted := tx.Delete(&pairing)
+		if deleted.Error != nil {
+			return deleted.Error
+		}
+		if deleted.RowsAffected == 0 {
+			return ErrPairingNotFound
+		}
+
+		token := newToken(deviceTokenPrefix)
+		updated := tx.Model(&models.Device{}).
+			Where("id = ? AND revoked_at IS NULL", pairing.DeviceID).
+			Update("device_token", hashToken(token))
+		if updated.Error != nil {
+			return updated.Error
+		}
+		if updated.RowsAffected == 0 {
+			return ErrDeviceRevoked
+		}
+
+		result = &PairingResult{
+			Claimed:     true,
+			UserID:      pairing.UserID,
+			DeviceID:    pairing.DeviceID,
+			DeviceToken: token,
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+// ClaimPairing 已登录的用户认领配对码，为申请方创建设备记录，设备凭证在申请方查询配对结果时签发
+// 同一设备标识再次配对时复用原设备记录，作废其原有凭证，并恢复已撤销的设备
+func (s *PairingService) ClaimPairing(userID uint, code string, name string) (*models.Device, error) {
+	var device models.Device
+	err := s.db.Transaction(func(tx *gorm.DB) error {
+		var pairing models.PairingCode
+		if err := tx.Where("code = ? AND expires_at >= ?", code, time.Now()).First(&pairing).Error; err != nil {
+			if errors.Is(err, gorm.ErrRecordNotFound) {
+				return ErrPairingNotFound
+			}
+			return err
+		}
+		if pairing.ClaimedAt != nil {
+			return ErrPairingClaimed
+		}
+
+		if name == "" {
+			name = pairing.Name
+		}
+		clientID := pairing.ClientID
+		if clientID == "" {
+			clientID = newToken("")[:16]
+		}
+
+		// 查找或创建设备记录，并作废原有的设备凭证
+		if err := tx.Where("user_id = ? AND device_type = ? AND client_id = ?", userID, pairing.DeviceType, clientID).
+			Attrs(models.Device{Status: models.DeviceStatusOffline}).
+			FirstOrCreate(&device, models.Device{UserID: userID, DeviceType: pairing.DeviceType, ClientID: clientID}).Error; err != nil {
+			return err
+		}
+		device.Name = name
+		device.DeviceToken = ""
+		device.RevokedAt = nil
+		if err := tx.Model(&device).Updates(map[string]interface{}{
+			"name":         device.Name,
+			"device_token": device.DeviceToken,
+			"revoked_at":   nil,
+		}).Error; err != nil {
+			return err
+		}
+
+		// 仅当配对码仍未被认领时更新，避免并发认领
+		now := time.Now()
+		result := tx.Model(&models.PairingCode{}).
+			Where("id = ? AND claimed_at IS NULL", pairing.ID).
+			Updates(map[string]interface{}{
+				"user_id":    userID,
+				"device_id":  device.ID,
+				"claimed_at": now,
+			})
+		if result.Error != nil {
+			return result.Error
+		}
+		if result.RowsAffected == 0 {
+			return ErrPairingClaimed
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	utils.Infof("[PAIRING] 用户 %d 已认领配对码，设备ID: %d, 设备类型: %s", userID, device.ID, device.DeviceType)
+	return &device, nil
+}
+
+// newPairingCode 生成随机配对码
+func newPairingCode() (string, error) {
+	code := make([]byte, pairingCodeLength)
+	max := big.NewInt(int64(len(pairingCodeAlphabet)))
+	for i := range code {
+		n, err := rand.Int(rand.Reader, max)
+		if err != nil {
+			return "", fmt.Errorf("生成配对码失败: %w", err)
+		}
+		code[i] = pairingCodeAlphabet[n.Int64()]
+	}
+	return string(code), nil
+}
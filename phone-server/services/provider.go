@@ -0,0 +1,189 @@
+package services
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	"phone-server/sse"
+	"phone-server/utils"
+)
+
+// 对话服务提供方名称
+const (
+	// ProviderOpenAI OpenAI兼容接口（/chat/completions），包括豆包、DeepSeek、llama.cpp server等
+	ProviderOpenAI = "openai"
+	// ProviderAnthropic Anthropic Messages接口（/v1/messages）
+	ProviderAnthropic = "anthropic"
+	// ProviderOllama 本地Ollama服务（/api/chat）
+	ProviderOllama = "ollama"
+	// ProviderFake 模拟的提供方，按脚本输出回答，不访问网络
+	ProviderFake = "fake"
+)
+
+// maxErrorBodySize 上游错误响应体最多读取的字节数
+const maxErrorBodySize = 4096
+
+// ChatProvider 对话服务提供方
+// 负责将统一的对话请求转换为具体API的请求格式，并把流式响应中的回答内容依次交给回调函数
+type ChatProvider interface {
+	// Name 提供方名称
+	Name() string
+	// Chat 使用指定模型进行对话（流式），上下文取消时中止上游请求
+	// 返回上游在流中报告的token用量，未报告时为零值
+	Chat(ctx context.Context, model string, request ChatRequest, streamCallback StreamResponseFunc) (Usage, error)
+}
+
+// UpstreamError 上游返回的非200响应
+type UpstreamError struct {
+	StatusCode int    // HTTP状态码
+	Body       string // 响应体（最多maxErrorBodySize字节）
+}
+
+// Error 实现error接口
+func (e *UpstreamError) Error() string {
+	return fmt.Sprintf("请求失败，状态码: %d", e.StatusCode)
+}
+
+// Retryable 是否为可重试的错误（限流或服务端错误）
+func (e *UpstreamError) Retryable() bool {
+	return e.StatusCode == http.StatusTooManyRequests || e.StatusCode >= http.StatusInternalServerError
+}
+
+// NewUpstreamClient 创建请求上游的HTTP客户端
+// 只限制建立连接（含TLS握手）的时间，流式响应的等待时间由AIService按首个片段和片段间隔分别控制
+func NewUpstreamClient(connectTimeout time.Duration) *http.Client {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.DialContext = (&net.Dialer{
+		Timeout:   connectTimeout,
+		KeepAlive: 30 * time.Second,
+	}).DialContext
+	transport.TLSHandshakeTimeout = connectTimeout
+	return &http.Client{Transport: transport}
+}
+
+// normalizeBaseURL 去掉基础URL末尾的斜杠，未指定协议时使用https
+func normalizeBaseURL(baseURL string) string {
+	baseURL = strings.TrimRight(baseURL, "/")
+	if !strings.HasPrefix(baseURL, "http") {
+		baseURL = "https://" + baseURL
+	}
+	return baseURL
+}
+
+// sendStreamRequest 以JSON请求体发送流式请求，状态码不为200时记录上游返回的错误信息并返回错误
+func sendStreamRequest(ctx context.Context, client *http.Client, url string, body interface{}, headers map[string]string) (*http.Response, error) {
+	startTime := time.Now()
+
+	// 转换为JSON
+	jsonData, err := json.Marshal(body)
+	if err != nil {
+		utils.Errorfc(ctx, "[AI_REQUEST] JSON编码失败: %v", err)
+		return nil, err
+	}
+
+	// 记录请求详细信息
+	utils.Debugfc(ctx, "[AI_REQUEST] 请求URL: %s, 请求体: %s", url, string(jsonData))
+
+	// 创建HTTP请求
+	req, err := http.NewRequestWithContext(ctx, "POST", url, bytes.NewBuffer(jsonData))
+	if err != nil {
+		utils.Errorfc(ctx, "[AI_REQUEST] 创建请求失败: %v", err)
+		return nil, err
+	}
+
+	// 设置请求头
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Cache-Control", "no-cache")
+	req.Header.Set("Connection", "keep-alive")
+	for key, value := range headers {
+		req.Header.Set(key, value)
+	}
+
+	// 发送请求
+	resp, err := client.Do(req)
+	if err != nil {
+		utils.Errorfc(ctx, "[AI_REQUEST] 发送请求失败: %v, 耗时: %v", err, time.Since(startTime))
+		return nil, err
+	}
+
+	// 检查响应状态，记录上游返回的错误信息便于排查
+	if resp.StatusCode != http.StatusOK {
+		defer resp.Body.Close()
+		errBody, _ := io.ReadAll(io.LimitReader(resp.Body, maxErrorBodySize))
+		utils.Errorfc(ctx, "[AI_REQUEST] 请求失败，状态码: %d, 响应: %s, 耗时: %v", resp.StatusCode, string(errBody), time.Since(startTime))
+		return nil, &UpstreamError{StatusCode: resp.StatusCode, Body: string(errBody)}
+	}
+
+	// 记录响应状态
+	utils.Infofc(ctx, "[AI_REQUEST] 请求成功，状态码: %d, 耗时: %v", resp.StatusCode, time.Since(startTime))
+	return resp, nil
+}
+
+// decodeSSE 解析SSE流，将每个事件交给handle处理，handle返回true时停止解析
+// 上游在流中返回的错误事件不会交给handle，而是以*sse.ErrorEvent返回
+func decodeSSE(ctx context.Context, body io.Reader, handle func(*sse.Event) (bool, error)) error {
+	reader := sse.NewReader(body)
+	for {
+		event, err := reader.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			utils.Errorfc(ctx, "[AI_RESPONSE] 读取响应失败: %v", err)
+			return err
+		}
+		if errEvent, ok := sse.ParseError(event); ok {
+			utils.Errorfc(ctx, "[AI_RESPONSE] %v", errEvent)
+			return errEvent
+		}
+
+		done, err := handle(event)
+		if err != nil || done {
+			return err
+		}
+	}
+}
+
+// parseDataURL 解析base64编码的data URL，返回MIME类型和base64数据
+func parseDataURL(url string) (string, string, bool) {
+	rest, ok := strings.CutPrefix(url, "data:")
+	if !ok {
+		return "", "", false
+	}
+	meta, data, ok := strings.Cut(rest, ",")
+	if !ok {
+		return "", "", false
+	}
+	mime, ok := strings.CutSuffix(meta, ";base64")
+	if !ok {
+		return "", "", false
+	}
+	return mime, data, true
+}
+
+// thinkingMode 获取本次请求的思考模式，请求未指定时使用提供方配置的思考模式
+func thinkingMode(request ChatRequest, configured string) string {
+	if request.Thinking != "" {
+		return request.Thinking
+	}
+	return configured
+}
+
+// emitChunk 将回答内容或思考过程片段交给回调函数，空片段会被忽略
+func emitChunk(ctx context.Context, streamCallback StreamResponseFunc, chunkType ChunkType, text string) error {
+	if text == "" {
+		return nil
+	}
+	if err := streamCallback(StreamChunk{Type: chunkType, Text: text}); err != nil {
+		utils.Errorfc(ctx, "[AI_RESPONSE] 流式响应回调处理失败: %v", err)
+		return err
+	}
+	return nil
+}
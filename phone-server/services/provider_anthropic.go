@@ -0,0 +1,197 @@
+package services
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"strings"
+
+	"phone-server/sse"
+	"phone-server/utils"
+)
+
+const (
+	// defaultAnthropicBaseURL Anthropic API的默认地址
+	defaultAnthropicBaseURL = "https://api.anthropic.com"
+	// anthropicVersion 请求使用的Anthropic API版本
+	anthropicVersion = "2023-06-01"
+	// minAnthropicThinkingBudget Anthropic扩展思考的最小token预算
+	minAnthropicThinkingBudget = 1024
+)
+
+// AnthropicProvider Anthropic Messages接口的对话服务提供方
+type AnthropicProvider struct {
+	client    *http.Client
+	baseURL   string
+	apiKey    string
+	maxTokens int
+	thinking  string
+}
+
+// NewAnthropicProvider 创建Anthropic Messages接口的对话服务提供方
+// baseURL为空时使用官方地址；思考模式为enabled时开启扩展思考，预算为maxTokens的一半
+func NewAnthropicProvider(client *http.Client, baseURL string, apiKey string, maxTokens int, thinking string) *AnthropicProvider {
+	if baseURL == "" {
+		baseURL = defaultAnthropicBaseURL
+	}
+	return &AnthropicProvider{
+		client:    client,
+		baseURL:   normalizeBaseURL(baseURL),
+		apiKey:    apiKey,
+		maxTokens: maxTokens,
+		thinking:  thinking,
+	}
+}
+
+// anthropicMessage Anthropic Messages接口的请求消息
+type anthropicMessage struct {
+	Role    ChatRole        `json:"role"`
+	Content []anthropicPart `json:"content"`
+}
+
+// anthropicPart Anthropic Messages接口的内容片段
+type anthropicPart struct {
+	Type   string                `json:"type"`
+	Text   string                `json:"text,omitempty"`
+	Source *anthropicImageSource `json:"source,omitempty"`
+}
+
+// anthropicImageSource Anthropic Messages接口的图片来源
+type anthropicImageSource struct {
+	Type      string `json:"type"`                 // base64 或 url
+	MediaType string `json:"media_type,omitempty"` // 图片MIME类型，仅base64
+	Data      string `json:"data,omitempty"`       // base64图片数据
+	URL       string `json:"url,omitempty"`        // 图片地址
+}
+
+// anthropicThinking 扩展思考参数
+type anthropicThinking struct {
+	Type         string `json:"type"`
+	BudgetTokens int    `json:"budget_tokens"`
+}
+
+// anthropicRequest Anthropic Messages接口的请求体
+type anthropicRequest struct {
+	Model     string             `json:"model"`
+	MaxTokens int                `json:"max_tokens"`
+	System    string             `json:"system,omitempty"`
+	Messages  []anthropicMessage `json:"messages"`
+	Thinking  *anthropicThinking `json:"thinking,omitempty"`
+	Stream    bool               `json:"stream"`
+}
+
+// anthropicUsage Anthropic Messages接口的token用量
+type anthropicUsage struct {
+	InputTokens  int64 `json:"input_tokens"`
+	OutputTokens int64 `json:"output_tokens"`
+}
+
+// anthropicEvent Anthropic Messages接口的流式事件
+// 输入token数在message_start事件中返回，累计的输出token数在message_delta事件中返回
+type anthropicEvent struct {
+	Type    string `json:"type"`
+	Message struct {
+		Usage anthropicUsage `json:"usage"`
+	} `json:"message"`
+	Usage *anthropicUsage `json:"usage"`
+	Delta struct {
+		Type     string `json:"type"`
+		Text     string `json:"text"`
+		Thinking string `json:"thinking"`
+	} `json:"delta"`
+}
+
+// Name 提供方名称
+func (p *AnthropicProvider) Name() string {
+	return ProviderAnthropic
+}
+
+// Chat 调用/v1/messages接口进行对话（流式）
+func (p *AnthropicProvider) Chat(ctx context.Context, model string, request ChatRequest, streamCallback StreamResponseFunc) (Usage, error) {
+	headers := map[string]string{
+		"Accept":            "text/event-stream",
+		"x-api-key":         p.apiKey,
+		"anthropic-version": anthropicVersion,
+	}
+
+	resp, err := sendStreamRequest(ctx, p.client, p.baseURL+"/v1/messages", p.buildRequest(model, request), headers)
+	if err != nil {
+		return Usage{}, err
+	}
+	defer resp.Body.Close()
+
+	var usage Usage
+	err = decodeSSE(ctx, resp.Body, func(sseEvent *sse.Event) (bool, error) {
+		var event anthropicEvent
+		if err := json.Unmarshal([]byte(sseEvent.Data), &event); err != nil {
+			utils.Errorfc(ctx, "[AI_RESPONSE] 解析AI响应失败: %v", err)
+			return false, nil
+		}
+
+		switch event.Type {
+		case "message_start":
+			usage.PromptTokens = event.Message.Usage.InputTokens
+			usage.CompletionTokens = event.Message.Usage.OutputTokens
+		case "message_delta":
+			if event.Usage != nil {
+				usage.CompletionTokens = event.Usage.OutputTokens
+			}
+		case "content_block_delta":
+			switch event.Delta.Type {
+			case "text_delta":
+				return false, emitChunk(ctx, streamCallback, ChunkContent, event.Delta.Text)
+			case "thinking_delta":
+				return false, emitChunk(ctx, streamCallback, ChunkReasoning, event.Delta.Thinking)
+			}
+		case "message_stop":
+			// 流式结束标记
+			return true, nil
+		}
+		return false, nil
+	})
+	return usage, err
+}
+
+// buildRequest 将对话请求转换为Anthropic Messages接口的请求体
+// system消息合并为顶层的system字段
+func (p *AnthropicProvider) buildRequest(model string, request ChatRequest) anthropicRequest {
+	var system []string
+	messages := make([]anthropicMessage, 0, len(request.Messages))
+	for _, message := range request.Messages {
+		if message.Role == ChatRoleSystem {
+			system = append(system, message.Text())
+			continue
+		}
+
+		parts := make([]anthropicPart, 0, len(message.Parts))
+		for _, part := range message.Parts {
+			switch part.Type {
+			case ChatPartText:
+				parts = append(parts, anthropicPart{Type: "text", Text: part.Text})
+			case ChatPartImage:
+				source := &anthropicImageSource{Type: "url", URL: part.ImageURL}
+				if mime, data, ok := parseDataURL(part.ImageURL); ok {
+					source = &anthropicImageSource{Type: "base64", MediaType: mime, Data: data}
+				}
+				parts = append(parts, anthropicPart{Type: "image", Source: source})
+			}
+		}
+		messages = append(messages, anthropicMessage{Role: message.Role, Content: parts})
+	}
+
+	body := anthropicRequest{
+		Model:     model,
+		MaxTokens: p.maxTokens,
+		System:    strings.Join(system, "\n\n"),
+		Messages:  messages,
+		Stream:    true,
+	}
+	// 思考预算必须小于max_tokens且不低于最小预算
+	if thinkingMode(request, p.thinking) == ThinkingEnabled && p.maxTokens > minAnthropicThinkingBudget {
+		body.Thinking = &anthropicThinking{
+			Type:         ThinkingEnabled,
+			BudgetTokens: max(p.maxTokens/2, minAnthropicThinkingBudget),
+		}
+	}
+	return body
+}
@@ -0,0 +1,20 @@
+package services
+
+import (
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestAnthropicProviderReplay(t *testing.T) {
+	server := newReplayServer(t, "/v1/messages", "anthropic.sse", "text/event-stream", func(t *testing.T, header http.Header, body map[string]interface{}) {
+		expectField(t, "x-api-key", header.Get("x-api-key"), "test-key")
+		expectField(t, "anthropic-version", header.Get("anthropic-version"), "2023-06-01")
+		expectField(t, "system", lookup(body, "system"), "你是一个测试助手")
+		expectField(t, "thinking.budget_tokens", lookup(body, "thinking", "budget_tokens"), float64(2048))
+		expectField(t, "source.media_type", lookup(body, "messages", 0, "content", 1, "source", "media_type"), "image/png")
+		expectField(t, "source.data", lookup(body, "messages", 0, "content", 1, "source", "data"), testImage)
+	})
+	provider := NewAnthropicProvider(NewUpstreamClient(5*time.Second), server.URL, "test-key", 4096, ThinkingEnabled)
+	runChatTests(t, providerChat(provider, "test-model"), replayTest(Usage{PromptTokens: 12, CompletionTokens: 9}))
+}
@@ -0,0 +1,188 @@
+package services
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"phone-server/sse"
+)
+
+// fakeChunkRunes 回显和脚本回答按多少个字符切分为一个片段
+const fakeChunkRunes = 4
+
+// FakeScript 模拟提供方的脚本规则
+// 每次请求按顺序使用第一条匹配的规则，没有匹配的规则时回显最后一条消息
+type FakeScript struct {
+	Match      string   `json:"match"`       // 最后一条消息包含该文本时使用本规则，为空时匹配所有请求
+	Times      int      `json:"times"`       // 本规则最多使用的次数，用完后继续匹配后面的规则，0表示不限制
+	StatusCode int      `json:"status_code"` // 不为0时不输出内容，直接返回该状态码的上游错误，如429
+	DelayMs    int      `json:"delay_ms"`    // 输出第一个片段前的等待时间（毫秒）
+	LatencyMs  int      `json:"latency_ms"`  // 片段之间的间隔（毫秒），0表示使用配置的间隔
+	Reasoning  string   `json:"reasoning"`   // 在回答前输出的思考过程
+	Reply      string   `json:"reply"`       // 回答内容，为空时回显最后一条消息
+	Chunks     []string `json:"chunks"`      // 逐个输出的回答片段，指定时忽略reply
+	ErrorAfter int      `json:"error_after"` // 输出多少个回答片段后返回流中错误，仅指定error时有效
+	Error      string   `json:"error"`       // 流中错误的信息，为空表示不出错
+	ErrorType  string   `json:"error_type"`  // 流中错误的类型，如overloaded_error（可重试），默认为invalid_request_error
+}
+
+// LoadFakeScripts 从JSON文件加载模拟提供方的脚本规则
+func LoadFakeScripts(path string) ([]FakeScript, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var scripts []FakeScript
+	if err := json.Unmarshal(data, &scripts); err != nil {
+		return nil, fmt.Errorf("解析模拟脚本失败: %w", err)
+	}
+	return scripts, nil
+}
+
+// FakeProvider 模拟的对话服务提供方，不访问网络
+// 按脚本输出回答和思考过程，可以模拟延迟、上游错误码和流中错误，用于本地开发、演示和测试
+type FakeProvider struct {
+	mu       sync.Mutex
+	scripts  []FakeScript
+	used     []int         // 每条规则已使用的次数
+	latency  time.Duration // 片段之间的默认间隔
+	thinking string
+}
+
+// NewFakeProvider 创建模拟的对话服务提供方
+// 没有脚本规则时回显最后一条消息；思考模式为enabled且规则未指定思考过程时，回显前输出一段固定的思考过程
+func NewFakeProvider(scripts []FakeScript, latency time.Duration, thinking string) *FakeProvider {
+	return &FakeProvider{
+		scripts:  scripts,
+		used:     make([]int, len(scripts)),
+		latency:  latency,
+		thinking: thinking,
+	}
+}
+
+// Name 提供方名称
+func (p *FakeProvider) Name() string {
+	return ProviderFake
+}
+
+// Chat 按匹配的脚本规则输出回答（流式）
+func (p *FakeProvider) Chat(ctx context.Context, model string, request ChatRequest, streamCallback StreamResponseFunc) (Usage, error) {
+	last := request.Messages[len(request.Messages)-1]
+	script := p.match(last.Text())
+
+	if script.StatusCode != 0 {
+		return Usage{}, &UpstreamError{StatusCode: script.StatusCode, Body: http.StatusText(script.StatusCode)}
+	}
+	if err := fakeSleep(ctx, time.Duration(script.DelayMs)*time.Millisecond); err != nil {
+		return Usage{}, err
+	}
+	latency := p.latency
+	if script.LatencyMs > 0 {
+		latency = time.Duration(script.LatencyMs) * time.Millisecond
+	}
+
+	reasoning := script.Reasoning
+	if reasoning == "" && thinkingMode(request, p.thinking) == ThinkingEnabled {
+		reasoning = "这是模拟的思考过程。"
+	}
+	for i, text := range splitRunes(reasoning, fakeChunkRunes) {
+		if i > 0 {
+			if err := fakeSleep(ctx, latency); err != nil {
+				return Usage{}, err
+			}
+		}
+		if err := emitChunk(ctx, streamCallback, ChunkReasoning, text); err != nil {
+			return Usage{}, err
+		}
+	}
+
+	chunks := script.Chunks
+	if len(chunks) == 0 {
+		reply := script.Reply
+		if reply == "" {
+			reply = fakeEcho(model, last)
+		}
+		chunks = splitRunes(reply, fakeChunkRunes)
+	}
+	for i, text := range chunks {
+		if script.Error != "" && i == script.ErrorAfter {
+			break
+		}
+		if i > 0 || reasoning != "" {
+			if err := fakeSleep(ctx, latency); err != nil {
+				return Usage{}, err
+			}
+		}
+		if err := emitChunk(ctx, streamCallback, ChunkContent, text); err != nil {
+			return Usage{}, err
+		}
+	}
+
+	if script.Error != "" {
+		errorType := script.ErrorType
+		if errorType == "" {
+			errorType = "invalid_request_error"
+		}
+		return Usage{}, &sse.ErrorEvent{Type: errorType, Message: script.Error}
+	}
+	// 不返回用量，由AIService按内容估算
+	return Usage{}, nil
+}
+
+// match 获取第一条匹配且未用完的脚本规则，没有时返回回显规则
+func (p *FakeProvider) match(text string) FakeScript {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for i, script := range p.scripts {
+		if script.Times > 0 && p.used[i] >= script.Times {
+			continue
+		}
+		if strings.Contains(text, script.Match) {
+			p.used[i]++
+			return script
+		}
+	}
+	return FakeScript{}
+}
+
+// fakeEcho 回显消息内容
+func fakeEcho(model string, message ChatMessage) string {
+	reply := fmt.Sprintf("[%s] 你说：%s", model, message.Text())
+	if count := message.ImageCount(); count > 0 {
+		reply += fmt.Sprintf("（附带%d张图片）", count)
+	}
+	return reply
+}
+
+// splitRunes 按字符数切分文本
+func splitRunes(text string, size int) []string {
+	var parts []string
+	runes := []rune(text)
+	for len(runes) > 0 {
+		n := min(size, len(runes))
+		parts = append(parts, string(runes[:n]))
+		runes = runes[n:]
+	}
+	return parts
+}
+
+// fakeSleep 模拟上游延迟，上下文取消时提前返回
+func fakeSleep(ctx context.Context, d time.Duration) error {
+	if d <= 0 {
+		return nil
+	}
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return context.Cause(ctx)
+	case <-timer.C:
+		return nil
+	}
+}
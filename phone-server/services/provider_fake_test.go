@@ -0,0 +1,95 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"phone-server/sse"
+)
+
+// newFakeAIService 使用示例脚本（testdata/fake_script.json）创建AI服务
+// fake-model支持图片和思考模式，fake-text都不支持
+func newFakeAIService(t *testing.T) *AIService {
+	t.Helper()
+	scripts, err := LoadFakeScripts(filepath.Join("testdata", "fake_script.json"))
+	if err != nil {
+		t.Fatalf("加载模拟脚本失败: %v", err)
+	}
+	provider := NewFakeProvider(scripts, time.Millisecond, "")
+	catalog := NewModelCatalog([]ModelInfo{
+		{Name: "fake-model", Provider: ProviderFake, Capabilities: []ModelCapability{CapabilityVision, CapabilityThinking}},
+		{Name: "fake-text", Provider: ProviderFake},
+	}, "fake-model")
+	return NewAIService(map[string]ChatProvider{ProviderFake: provider}, ProviderFake, nil, catalog,
+		nil, 1, 10*time.Millisecond, NewCircuitBreaker(100, time.Second), 200*time.Millisecond, time.Second)
+}
+
+// fakeRequest 创建发送给模拟提供方的请求，image为true时附带一张图片
+func fakeRequest(model string, thinking string, content string, image bool) ChatRequest {
+	parts := []ChatPart{TextPart(content)}
+	if image {
+		parts = append(parts, ImagePart("image/png", "iVBORw0KGgo="))
+	}
+	return ChatRequest{
+		Model:    model,
+		Thinking: thinking,
+		Messages: []ChatMessage{NewChatMessage(ChatRoleUser, parts...)},
+	}
+}
+
+// expectUnsupportedModel 校验因模型不支持而拒绝请求
+func expectUnsupportedModel(t *testing.T, err error) {
+	if !errors.Is(err, ErrUnsupportedModel) {
+		t.Fatalf("err = %v，期望模型不支持", err)
+	}
+}
+
+// TestFakeProviderScenarios 使用模拟提供方和示例脚本驱动AIService，校验回显、思考过程、429重试、流中错误、首个片段超时和模型能力校验
+func TestFakeProviderScenarios(t *testing.T) {
+	aiService := newFakeAIService(t)
+	chat := func(ctx context.Context, request ChatRequest, streamCallback StreamResponseFunc) (Usage, error) {
+		result, err := aiService.Chat(ctx, request, streamCallback)
+		return result.Usage, err
+	}
+
+	runChatTests(t, chat, []chatTest{
+		{name: "echo", request: fakeRequest("", "", "你好", false), answer: "[fake-model] 你说：你好"},
+		{name: "thinking", request: fakeRequest("", ThinkingEnabled, "你好", false), answer: "[fake-model] 你说：你好", reasoning: "这是模拟的思考过程。"},
+		{name: "scripted reasoning", request: fakeRequest("", "", "[thinking]", false), answer: "想好了。", reasoning: "先想一想。"},
+		{name: "429 retry", request: fakeRequest("", "", "[429] 重试", false), answer: "[fake-model] 你说：[429] 重试"},
+		{
+			name: "mid-stream error", request: fakeRequest("", "", "[error]", false), answer: "部分",
+			check: func(t *testing.T, err error) {
+				var errEvent *sse.ErrorEvent
+				if !errors.As(err, &errEvent) || errEvent.Message != "模拟的流中错误" {
+					t.Fatalf("err = %v，期望流中错误", err)
+				}
+			},
+		},
+		{
+			name: "overloaded", request: fakeRequest("", "", "[overloaded]", false),
+			check: func(t *testing.T, err error) {
+				var errEvent *sse.ErrorEvent
+				if !errors.As(err, &errEvent) || !errEvent.Retryable() {
+					t.Fatalf("err = %v，期望可重试的流中错误", err)
+				}
+			},
+		},
+		{
+			name: "first token timeout", request: fakeRequest("", "", "[slow]", false),
+			check: func(t *testing.T, err error) {
+				if !errors.Is(err, ErrStreamTimeout) {
+					t.Fatalf("err = %v，期望响应超时", err)
+				}
+			},
+		},
+		{name: "image", request: fakeRequest("", "", "看图", true), answer: "[fake-model] 你说：看图（附带1张图片）"},
+		{name: "text model", request: fakeRequest("fake-text", "", "你好", false), answer: "[fake-text] 你说：你好"},
+		{name: "image on text model", request: fakeRequest("fake-text", "", "看图", true), check: expectUnsupportedModel},
+		{name: "thinking on text model", request: fakeRequest("fake-text", ThinkingEnabled, "你好", false), check: expectUnsupportedModel},
+		{name: "unknown model", request: fakeRequest("unknown-model", "", "你好", false), check: expectUnsupportedModel},
+	})
+}
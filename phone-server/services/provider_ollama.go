@@ -0,0 +1,149 @@
+package services
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+
+	"phone-server/utils"
+)
+
+const (
+	// defaultOllamaBaseURL 本地Ollama服务的默认地址
+	defaultOllamaBaseURL = "http://localhost:11434"
+	// maxOllamaLineSize Ollama流式响应单行的最大字节数
+	maxOllamaLineSize = 1024 * 1024
+)
+
+// OllamaProvider 本地Ollama服务的对话服务提供方
+// Ollama以换行分隔的JSON（NDJSON）而非SSE返回流式响应
+type OllamaProvider struct {
+	client   *http.Client
+	baseURL  string
+	thinking string
+}
+
+// NewOllamaProvider 创建本地Ollama服务的对话服务提供方
+// baseURL为空时使用本机默认端口；思考模式为enabled/disabled时传递think参数，auto时由模型决定
+func NewOllamaProvider(client *http.Client, baseURL string, thinking string) *OllamaProvider {
+	if baseURL == "" {
+		baseURL = defaultOllamaBaseURL
+	}
+	return &OllamaProvider{
+		client:   client,
+		baseURL:  normalizeBaseURL(baseURL),
+		thinking: thinking,
+	}
+}
+
+// ollamaMessage Ollama的请求消息，图片以不带前缀的base64数据单独传递
+type ollamaMessage struct {
+	Role    ChatRole `json:"role"`
+	Content string   `json:"content"`
+	Images  []string `json:"images,omitempty"`
+}
+
+// ollamaRequest Ollama的请求体
+type ollamaRequest struct {
+	Model    string          `json:"model"`
+	Messages []ollamaMessage `json:"messages"`
+	Think    *bool           `json:"think,omitempty"`
+	Stream   bool            `json:"stream"`
+}
+
+// ollamaChunk Ollama的流式响应数据
+type ollamaChunk struct {
+	Message struct {
+		Content  string `json:"content"`
+		Thinking string `json:"thinking"`
+	} `json:"message"`
+	Done            bool   `json:"done"`
+	PromptEvalCount int64  `json:"prompt_eval_count"` // 输入token数，仅最后一行
+	EvalCount       int64  `json:"eval_count"`        // 输出token数，仅最后一行
+	Error           string `json:"error"`
+}
+
+// Name 提供方名称
+func (p *OllamaProvider) Name() string {
+	return ProviderOllama
+}
+
+// Chat 调用/api/chat接口进行对话（流式）
+func (p *OllamaProvider) Chat(ctx context.Context, model string, request ChatRequest, streamCallback StreamResponseFunc) (Usage, error) {
+	body, err := p.buildRequest(model, request)
+	if err != nil {
+		return Usage{}, err
+	}
+	resp, err := sendStreamRequest(ctx, p.client, p.baseURL+"/api/chat", body, nil)
+	if err != nil {
+		return Usage{}, err
+	}
+	defer resp.Body.Close()
+
+	scanner := bufio.NewScanner(resp.Body)
+	scanner.Buffer(make([]byte, 64*1024), maxOllamaLineSize)
+	for scanner.Scan() {
+		line := scanner.Bytes()
+		if len(line) == 0 {
+			continue
+		}
+
+		// 解析AI响应数据
+		var chunk ollamaChunk
+		if err := json.Unmarshal(line, &chunk); err != nil {
+			utils.Errorfc(ctx, "[AI_RESPONSE] 解析AI响应失败: %v", err)
+			continue
+		}
+		if chunk.Error != "" {
+			utils.Errorfc(ctx, "[AI_RESPONSE] AI返回错误: %s", chunk.Error)
+			return Usage{}, fmt.Errorf("AI返回错误: %s", chunk.Error)
+		}
+		if err := emitChunk(ctx, streamCallback, ChunkReasoning, chunk.Message.Thinking); err != nil {
+			return Usage{}, err
+		}
+		if err := emitChunk(ctx, streamCallback, ChunkContent, chunk.Message.Content); err != nil {
+			return Usage{}, err
+		}
+		if chunk.Done {
+			return Usage{PromptTokens: chunk.PromptEvalCount, CompletionTokens: chunk.EvalCount}, nil
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		utils.Errorfc(ctx, "[AI_RESPONSE] 读取响应失败: %v", err)
+		return Usage{}, err
+	}
+	return Usage{}, nil
+}
+
+// buildRequest 将对话请求转换为Ollama的请求体，Ollama只支持内嵌的base64图片
+func (p *OllamaProvider) buildRequest(model string, request ChatRequest) (ollamaRequest, error) {
+	messages := make([]ollamaMessage, 0, len(request.Messages))
+	for _, message := range request.Messages {
+		ollamaMsg := ollamaMessage{Role: message.Role, Content: message.Text()}
+		for _, part := range message.Parts {
+			if part.Type != ChatPartImage {
+				continue
+			}
+			_, data, ok := parseDataURL(part.ImageURL)
+			if !ok {
+				return ollamaRequest{}, errors.New("Ollama仅支持base64编码的图片")
+			}
+			ollamaMsg.Images = append(ollamaMsg.Images, data)
+		}
+		messages = append(messages, ollamaMsg)
+	}
+
+	body := ollamaRequest{
+		Model:    model,
+		Messages: messages,
+		Stream:   true,
+	}
+	if thinking := thinkingMode(request, p.thinking); thinking == ThinkingEnabled || thinking == ThinkingDisabled {
+		think := thinking == ThinkingEnabled
+		body.Think = &think
+	}
+	return body, nil
+}
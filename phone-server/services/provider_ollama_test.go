@@ -0,0 +1,17 @@
+package services
+
+import (
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestOllamaProviderReplay(t *testing.T) {
+	server := newReplayServer(t, "/api/chat", "ollama.ndjson", "application/x-ndjson", func(t *testing.T, header http.Header, body map[string]interface{}) {
+		expectField(t, "think", lookup(body, "think"), true)
+		expectField(t, "content", lookup(body, "messages", 1, "content"), "图片里是什么？")
+		expectField(t, "images", lookup(body, "messages", 1, "images", 0), testImage)
+	})
+	provider := NewOllamaProvider(NewUpstreamClient(5*time.Second), server.URL, ThinkingEnabled)
+	runChatTests(t, providerChat(provider, "test-model"), replayTest(Usage{PromptTokens: 26, CompletionTokens: 9}))
+}
@@ -0,0 +1,169 @@
+package services
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+
+	"phone-server/sse"
+	"phone-server/utils"
+)
+
+// OpenAIProvider OpenAI兼容接口的对话服务提供方
+type OpenAIProvider struct {
+	client   *http.Client
+	baseURL  string
+	apiKey   string
+	thinking string
+}
+
+// NewOpenAIProvider 创建OpenAI兼容接口的对话服务提供方
+// thinking不为空时以{"thinking": {"type": thinking}}的形式传递思考模式，请求中指定的思考模式优先
+func NewOpenAIProvider(client *http.Client, baseURL string, apiKey string, thinking string) *OpenAIProvider {
+	return &OpenAIProvider{
+		client:   client,
+		baseURL:  normalizeBaseURL(baseURL),
+		apiKey:   apiKey,
+		thinking: thinking,
+	}
+}
+
+// openAIMessage OpenAI兼容接口的请求消息
+// 只有一个文本片段时content为字符串，否则为内容片段数组
+type openAIMessage struct {
+	Role    ChatRole    `json:"role"`
+	Content interface{} `json:"content"`
+}
+
+// openAIPart OpenAI兼容接口的内容片段
+type openAIPart struct {
+	Type     string          `json:"type"`
+	Text     string          `json:"text,omitempty"`
+	ImageURL *openAIImageURL `json:"image_url,omitempty"`
+}
+
+// openAIImageURL OpenAI兼容接口的图片地址
+type openAIImageURL struct {
+	URL string `json:"url"`
+}
+
+// openAIThinking 思考模式参数
+type openAIThinking struct {
+	Type string `json:"type"`
+}
+
+// openAIStreamOptions 流式响应选项
+type openAIStreamOptions struct {
+	IncludeUsage bool `json:"include_usage"` // 在流的最后返回token用量
+}
+
+// openAIRequest OpenAI兼容接口的请求体
+type openAIRequest struct {
+	Model         string               `json:"model"`
+	Messages      []openAIMessage      `json:"messages"`
+	Thinking      *openAIThinking      `json:"thinking,omitempty"`
+	Stream        bool                 `json:"stream"`
+	StreamOptions *openAIStreamOptions `json:"stream_options,omitempty"`
+}
+
+// openAIChunk OpenAI兼容接口的流式响应数据
+type openAIChunk struct {
+	Choices []struct {
+		Delta struct {
+			Content          string `json:"content"`
+			ReasoningContent string `json:"reasoning_content"` // 思考过程（豆包、DeepSeek、llama.cpp server）
+			Reasoning        string `json:"reasoning"`         // 思考过程（部分兼容服务使用该字段）
+		} `json:"delta"`
+	} `json:"choices"`
+	Usage *struct {
+		PromptTokens     int64 `json:"prompt_tokens"`
+		CompletionTokens int64 `json:"completion_tokens"`
+	} `json:"usage"`
+}
+
+// Name 提供方名称
+func (p *OpenAIProvider) Name() string {
+	return ProviderOpenAI
+}
+
+// Chat 调用/chat/completions接口进行对话（流式）
+func (p *OpenAIProvider) Chat(ctx context.Context, model string, request ChatRequest, streamCallback StreamResponseFunc) (Usage, error) {
+	headers := map[string]string{
+		"Accept": "text/event-stream",
+	}
+	if p.apiKey != "" {
+		headers["Authorization"] = fmt.Sprintf("Bearer %s", p.apiKey)
+	}
+
+	resp, err := sendStreamRequest(ctx, p.client, p.baseURL+"/chat/completions", p.buildRequest(model, request), headers)
+	if err != nil {
+		return Usage{}, err
+	}
+	defer resp.Body.Close()
+
+	var usage Usage
+	err = decodeSSE(ctx, resp.Body, func(event *sse.Event) (bool, error) {
+		if event.Data == "[DONE]" {
+			// 流式结束标记
+			return true, nil
+		}
+
+		// 解析AI响应数据
+		var chunk openAIChunk
+		if err := json.Unmarshal([]byte(event.Data), &chunk); err != nil {
+			utils.Errorfc(ctx, "[AI_RESPONSE] 解析AI响应失败: %v", err)
+			return false, nil
+		}
+		// 用量在流的最后一个数据块中返回，该数据块没有choices
+		if chunk.Usage != nil {
+			usage = Usage{PromptTokens: chunk.Usage.PromptTokens, CompletionTokens: chunk.Usage.CompletionTokens}
+		}
+		if len(chunk.Choices) == 0 {
+			return false, nil
+		}
+		delta := chunk.Choices[0].Delta
+		reasoning := delta.ReasoningContent
+		if reasoning == "" {
+			reasoning = delta.Reasoning
+		}
+		if err := emitChunk(ctx, streamCallback, ChunkReasoning, reasoning); err != nil {
+			return false, err
+		}
+		return false, emitChunk(ctx, streamCallback, ChunkContent, delta.Content)
+	})
+	return usage, err
+}
+
+// buildRequest 将对话请求转换为OpenAI兼容接口的请求体
+func (p *OpenAIProvider) buildRequest(model string, request ChatRequest) openAIRequest {
+	messages := make([]openAIMessage, 0, len(request.Messages))
+	for _, message := range request.Messages {
+		if len(message.Parts) == 1 && message.Parts[0].Type == ChatPartText {
+			messages = append(messages, openAIMessage{Role: message.Role, Content: message.Parts[0].Text})
+			continue
+		}
+
+		parts := make([]openAIPart, 0, len(message.Parts))
+		for _, part := range message.Parts {
+			switch part.Type {
+			case ChatPartText:
+				parts = append(parts, openAIPart{Type: "text", Text: part.Text})
+			case ChatPartImage:
+				parts = append(parts, openAIPart{Type: "image_url", ImageURL: &openAIImageURL{URL: part.ImageURL}})
+			}
+		}
+		messages = append(messages, openAIMessage{Role: message.Role, Content: parts})
+	}
+
+	body := openAIRequest{
+		Model:         model,
+		Messages:      messages,
+		Stream:        true,
+		StreamOptions: &openAIStreamOptions{IncludeUsage: true},
+	}
+	if thinking := thinkingMode(request, p.thinking); thinking != "" {
+		body.Thinking = &openAIThinking{Type: thinking}
+	}
+	return body
+}
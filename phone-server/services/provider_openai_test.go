@@ -0,0 +1,19 @@
+package services
+
+import (
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestOpenAIProviderReplay(t *testing.T) {
+	server := newReplayServer(t, "/chat/completions", "openai.sse", "text/event-stream", func(t *testing.T, header http.Header, body map[string]interface{}) {
+		expectField(t, "Authorization", header.Get("Authorization"), "Bearer test-key")
+		expectField(t, "thinking.type", lookup(body, "thinking", "type"), ThinkingEnabled)
+		expectField(t, "stream_options.include_usage", lookup(body, "stream_options", "include_usage"), true)
+		expectField(t, "system content", lookup(body, "messages", 0, "content"), "你是一个测试助手")
+		expectField(t, "image_url", lookup(body, "messages", 1, "content", 1, "image_url", "url"), "data:image/png;base64,"+testImage)
+	})
+	provider := NewOpenAIProvider(NewUpstreamClient(5*time.Second), server.URL, "test-key", ThinkingEnabled)
+	runChatTests(t, providerChat(provider, "test-model"), replayTest(Usage{PromptTokens: 25, CompletionTokens: 12}))
+}
@@ -0,0 +1,144 @@
+package services
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// testImage 请求中携带的测试图片（base64）
+const testImage = "aGVsbG8="
+
+// chatFunc 发送一次对话（流式），返回上游报告的token用量
+type chatFunc func(ctx context.Context, request ChatRequest, streamCallback StreamResponseFunc) (Usage, error)
+
+// chatTest 对话的表驱动测试用例
+type chatTest struct {
+	name      string
+	request   ChatRequest
+	answer    string                        // 期望拼接出的回答
+	reasoning string                        // 期望拼接出的思考过程
+	usage     *Usage                        // 期望的token用量，nil表示不校验
+	check     func(t *testing.T, err error) // 校验返回的错误，nil表示期望没有错误
+}
+
+// runChatTests 依次发送用例中的对话，校验拼接出的回答、思考过程、token用量和返回的错误
+func runChatTests(t *testing.T, chat chatFunc, tests []chatTest) {
+	t.Helper()
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var answer, reasoning strings.Builder
+			usage, err := chat(context.Background(), tt.request, func(chunk StreamChunk) error {
+				switch chunk.Type {
+				case ChunkContent:
+					answer.WriteString(chunk.Text)
+				case ChunkReasoning:
+					reasoning.WriteString(chunk.Text)
+				}
+				return nil
+			})
+
+			if tt.check != nil {
+				tt.check(t, err)
+			} else if err != nil {
+				t.Fatalf("对话失败: %v", err)
+			}
+			if answer.String() != tt.answer {
+				t.Errorf("answer = %q，期望 %q", answer.String(), tt.answer)
+			}
+			if reasoning.String() != tt.reasoning {
+				t.Errorf("reasoning = %q，期望 %q", reasoning.String(), tt.reasoning)
+			}
+			if tt.usage != nil && usage != *tt.usage {
+				t.Errorf("usage = %+v，期望 %+v", usage, *tt.usage)
+			}
+		})
+	}
+}
+
+// providerChat 使用提供方和固定模型发送对话
+func providerChat(provider ChatProvider, model string) chatFunc {
+	return func(ctx context.Context, request ChatRequest, streamCallback StreamResponseFunc) (Usage, error) {
+		return provider.Chat(ctx, model, request, streamCallback)
+	}
+}
+
+// replayTest 回放录制的上游响应的用例：录制的响应中拼接出的回答和思考过程相同，只有token用量不同
+func replayTest(usage Usage) []chatTest {
+	return []chatTest{{
+		name: "replay",
+		request: ChatRequest{
+			Messages: []ChatMessage{
+				NewChatMessage(ChatRoleSystem, TextPart("你是一个测试助手")),
+				NewChatMessage(ChatRoleUser, TextPart("图片里是什么？"), ImagePart("image/png", testImage)),
+			},
+		},
+		answer:    "你好，我是测试助手。",
+		reasoning: "用户在打招呼。",
+		usage:     &usage,
+	}}
+}
+
+// newReplayServer 启动回放服务器：校验请求路径、模型和流式参数，再由check校验请求头和请求体，最后返回录制的响应
+func newReplayServer(t *testing.T, path string, fixture string, contentType string, check func(t *testing.T, header http.Header, body map[string]interface{})) *httptest.Server {
+	t.Helper()
+	data, err := os.ReadFile(filepath.Join("testdata", fixture))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		raw, err := io.ReadAll(r.Body)
+		if err != nil {
+			t.Errorf("读取请求体失败: %v", err)
+		}
+		var body map[string]interface{}
+		if err := json.Unmarshal(raw, &body); err != nil {
+			t.Errorf("请求体不是有效的JSON: %v", err)
+		}
+		expectField(t, "path", r.URL.Path, path)
+		expectField(t, "model", lookup(body, "model"), "test-model")
+		expectField(t, "stream", lookup(body, "stream"), true)
+		check(t, r.Header, body)
+
+		w.Header().Set("Content-Type", contentType)
+		w.Write(data)
+	}))
+	t.Cleanup(server.Close)
+	return server
+}
+
+// lookup 按键名或下标依次取出JSON中的值，路径不存在时返回nil
+func lookup(value interface{}, path ...interface{}) interface{} {
+	for _, key := range path {
+		switch key := key.(type) {
+		case string:
+			object, ok := value.(map[string]interface{})
+			if !ok {
+				return nil
+			}
+			value = object[key]
+		case int:
+			array, ok := value.([]interface{})
+			if !ok || key >= len(array) {
+				return nil
+			}
+			value = array[key]
+		}
+	}
+	return value
+}
+
+// expectField 比较实际值和期望值，可在回放服务器的处理协程中调用
+func expectField(t *testing.T, field string, actual interface{}, expected interface{}) {
+	t.Helper()
+	if actual != expected {
+		t.Errorf("%s = %v，期望 %v", field, actual, expected)
+	}
+}
@@ -0,0 +1,146 @@
+package services
+
+import (
+	"time"
+
+	"phone-server/models"
+	"phone-server/utils"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// ReceiptEvent 消息回执状态变更事件，推送给用户除回执设备外的其他客户端
+type ReceiptEvent struct {
+	Type       string    `json:"type"`        // 固定为receipt
+	MessageID  uint      `json:"message_id"`  // 消息ID
+	DeviceID   uint      `json:"device_id"`   // 回执设备ID
+	DeviceType string    `json:"device_type"` // 回执设备类型
+	Status     string    `json:"status"`      // delivered 或 read
+	At         time.Time `json:"at"`          // 状态变更时间
+}
+
+// EventType 事件类型
+func (e ReceiptEvent) EventType() string {
+	return "receipt"
+}
+
+// ReceiptService 消息回执服务，记录每个设备的送达和已读状态
+type ReceiptService struct {
+	db     *gorm.DB // 数据库连接
+	broker Broker   // 消息广播服务，用于推送回执状态变更
+}
+
+// NewReceiptService 创建消息回执服务实例
+func NewReceiptService(db *gorm.DB, broker Broker) *ReceiptService {
+	return &ReceiptService{
+		db:     db,
+		broker: broker,
+	}
+}
+
+// MarkDelivered 记录设备已收到消息，返回状态发生变化的消息ID
+func (s *ReceiptService) MarkDelivered(device *models.Device, messageIDs []uint) ([]uint, error) {
+	return s.mark(device, messageIDs, models.ReceiptStatusDelivered)
+}
+
+// MarkRead 记录设备已读消息（已读隐含已送达），返回状态发生变化的消息ID
+func (s *ReceiptService) MarkRead(device *models.Device, messageIDs []uint) ([]uint, error) {
+	return s.mark(device, messageIDs, models.ReceiptStatusRead)
+}
+
+// mark 更新消息回执状态，并向用户的其他客户端推送状态变更
+func (s *ReceiptService) mark(device *models.Device, messageIDs []uint, status string) ([]uint, error) {
+	if len(messageIDs) == 0 {
+		return nil, nil
+	}
+
+	// 只处理属于该用户的消息
+	var ownedIDs []uint
+	if err := s.db.Model(&models.Message{}).
+		Where("id IN ? AND user_id = ?", messageIDs, device.UserID).
+		Pluck("id", &ownedIDs).Error; err != nil {
+		return nil, err
+	}
+	if len(ownedIDs) == 0 {
+		return nil, nil
+	}
+
+	// 查询已有回执，确定哪些消息的状态会发生变化
+	var existing []models.MessageReceipt
+	if err := s.db.Where("message_id IN ? AND device_id = ?", ownedIDs, device.ID).
+		Find(&existing).Error; err != nil {
+		return nil, err
+	}
+	existingStatus := make(map[uint]string, len(existing))
+	for _, receipt := range existing {
+		existingStatus[receipt.MessageID] = receipt.Status
+	}
+
+	now := time.Now()
+	var changedIDs []uint
+	receipts := make([]models.MessageReceipt, 0, len(ownedIDs))
+	for _, id := range ownedIDs {
+		current, ok := existingStatus[id]
+		if current == models.ReceiptStatusRead || (ok && current == status) {
+			continue
+		}
+		receipt := models.MessageReceipt{
+			MessageID:   id,
+			DeviceID:    device.ID,
+			UserID:      device.UserID,
+			Status:      status,
+			DeliveredAt: &now,
+		}
+		if status == models.ReceiptStatusRead {
+			receipt.ReadAt = &now
+		}
+		receipts = append(receipts, receipt)
+		changedIDs = append(changedIDs, id)
+	}
+	if len(receipts) == 0 {
+		return nil, nil
+	}
+
+	// 已存在的回执只更新状态，送达时间保留首次送达的时间
+	updates := clause.Set{
+		{Column: clause.Column{Name: "status"}, Value: status},
+		{Column: clause.Column{Name: "delivered_at"}, Value: gorm.Expr("COALESCE(delivered_at, ?)", now)},
+		{Column: clause.Column{Name: "updated_at"}, Value: now},
+	}
+	if status == models.ReceiptStatusRead {
+		updates = append(updates, clause.Assignment{Column: clause.Column{Name: "read_at"}, Value: now})
+	}
+	if err := s.db.Clauses(clause.OnConflict{
+		Columns:   []clause.Column{{Name: "message_id"}, {Name: "device_id"}},
+		DoUpdates: updates,
+	}).Create(&receipts).Error; err != nil {
+		return nil, err
+	}
+
+	// 推送回执状态变更
+	for _, id := range changedIDs {
+		event := ReceiptEvent{
+			Type:       "receipt",
+			MessageID:  id,
+			DeviceID:   device.ID,
+			DeviceType: device.DeviceType,
+			Status:     status,
+			At:         now,
+		}
+		s.broker.BroadcastEvent(event, device.UserID, TargetOthers(device.ID))
+	}
+
+	utils.Infof("[RECEIPT] 设备 %d 回执 %d 条消息，状态: %s", device.ID, len(changedIDs), status)
+	return changedIDs, nil
+}
+
+// GetReceipts 获取消息在各设备上的回执状态
+func (s *ReceiptService) GetReceipts(userID uint, messageID uint) ([]models.MessageReceipt, error) {
+	var receipts []models.MessageReceipt
+	if err := s.db.Where("message_id = ? AND user_id = ?", messageID, userID).
+		Order("device_id").Find(&receipts).Error; err != nil {
+		return nil, err
+	}
+	return receipts, nil
+}
@@ -0,0 +1,53 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// ErrStreamTimeout 上游在限定时间内没有返回首个片段，或两个片段之间的间隔过长
+var ErrStreamTimeout = errors.New("AI响应超时")
+
+// streamWatchdog 监视一次上游请求的流式响应
+// 发出请求后firstTokenTimeout内未收到首个片段，或之后两个片段间隔超过idleTimeout时，以ErrStreamTimeout为原因取消请求
+// 回调函数（向客户端发送片段）执行期间不计时
+type streamWatchdog struct {
+	timer       *time.Timer
+	cancel      context.CancelCauseFunc
+	idleTimeout time.Duration
+}
+
+// newStreamWatchdog 创建流式响应监视器，返回的上下文用于本次上游请求
+func newStreamWatchdog(ctx context.Context, firstTokenTimeout time.Duration, idleTimeout time.Duration) (context.Context, *streamWatchdog) {
+	ctx, cancel := context.WithCancelCause(ctx)
+	w := &streamWatchdog{cancel: cancel, idleTimeout: idleTimeout}
+	w.timer = time.AfterFunc(firstTokenTimeout, func() {
+		cancel(fmt.Errorf("%w：%v内未收到首个片段", ErrStreamTimeout, firstTokenTimeout))
+	})
+	return ctx, w
+}
+
+// wrap 包装回调函数，每收到一个片段重新开始计算片段间隔
+func (w *streamWatchdog) wrap(streamCallback StreamResponseFunc) StreamResponseFunc {
+	return func(chunk StreamChunk) error {
+		w.timer.Stop()
+		err := streamCallback(chunk)
+		w.timer = time.AfterFunc(w.idleTimeout, func() {
+			w.cancel(fmt.Errorf("%w：%v内未收到新的片段", ErrStreamTimeout, w.idleTimeout))
+		})
+		return err
+	}
+}
+
+// stop 停止监视，返回请求因超时被取消的原因，未超时时返回nil
+func (w *streamWatchdog) stop(ctx context.Context) error {
+	w.timer.Stop()
+	cause := context.Cause(ctx)
+	w.cancel(nil)
+	if errors.Is(cause, ErrStreamTimeout) {
+		return cause
+	}
+	return nil
+}
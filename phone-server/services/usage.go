@@ -0,0 +1,166 @@
+package services
+
+import (
+	"errors"
+	"fmt"
+	"time"
+	"unicode"
+
+	"phone-server/models"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+const (
+	// estimatedImageTokens 估算用量时每张图片计入的输入token数
+	estimatedImageTokens = 765
+	// estimatedMessageTokens 估算用量时每条消息额外计入的token数（角色等格式开销）
+	estimatedMessageTokens = 4
+)
+
+// ErrQuotaExceeded 用户的AI用量已超出配额
+var ErrQuotaExceeded = errors.New("AI用量已超出配额")
+
+// Usage 一次对话的token用量
+type Usage struct {
+	PromptTokens     int64 // 输入token数
+	CompletionTokens int64 // 输出token数（含思考过程）
+	Estimated        bool  // 上游未返回用量，按内容长度估算
+}
+
+// IsZero 上游是否未返回用量
+func (u Usage) IsZero() bool {
+	return u.PromptTokens == 0 && u.CompletionTokens == 0
+}
+
+// estimateTokens 按字符估算文本的token数：汉字等宽字符每个约1个token，其他字符每4个约1个token
+func estimateTokens(text string) int64 {
+	var wide, other int64
+	for _, r := range text {
+		if r >= 0x2E80 || unicode.Is(unicode.Han, r) {
+			wide++
+		} else {
+			other++
+		}
+	}
+	return wide + (other+3)/4
+}
+
+// estimateUsage 上游未返回用量时，按请求消息和已生成的内容估算用量
+func estimateUsage(request ChatRequest, completion string) Usage {
+	usage := Usage{Estimated: true, CompletionTokens: estimateTokens(completion)}
+	for _, message := range request.Messages {
+		usage.PromptTokens += estimatedMessageTokens + estimateTokens(message.Text()) + int64(message.ImageCount())*estimatedImageTokens
+	}
+	return usage
+}
+
+// UsageSummary 一段时间内的用量汇总
+type UsageSummary struct {
+	Requests         int64 `json:"requests"`          // 请求次数
+	PromptTokens     int64 `json:"prompt_tokens"`     // 输入token数
+	CompletionTokens int64 `json:"completion_tokens"` // 输出token数
+	TotalTokens      int64 `json:"total_tokens"`      // 总token数
+	Quota            int64 `json:"quota"`             // 配额，0表示不限制
+}
+
+// UsageService AI用量服务，按用户、模型和日期记录token用量并检查配额
+type UsageService struct {
+	db           *gorm.DB // 数据库连接
+	dailyQuota   int64    // 每个用户每天的token配额，0表示不限制
+	monthlyQuota int64    // 每个用户每月的token配额，0表示不限制
+}
+
+// NewUsageService 创建AI用量服务实例
+func NewUsageService(db *gorm.DB, dailyQuota int64, monthlyQuota int64) *UsageService {
+	return &UsageService{
+		db:           db,
+		dailyQuota:   dailyQuota,
+		monthlyQuota: monthlyQuota,
+	}
+}
+
+// Record 累加用户当天在该模型上的用量
+func (s *UsageService) Record(userID uint, model string, usage Usage) error {
+	record := models.AIUsage{
+		UserID:           userID,
+		Model:            model,
+		Date:             time.Now().Format(models.AIUsageDateFormat),
+		Requests:         1,
+		PromptTokens:     usage.PromptTokens,
+		CompletionTokens: usage.CompletionTokens,
+	}
+	if usage.Estimated {
+		record.EstimatedTokens = usage.PromptTokens + usage.CompletionTokens
+	}
+
+	return s.db.Clauses(clause.OnConflict{
+		Columns: []clause.Column{{Name: "user_id"}, {Name: "model"}, {Name: "date"}},
+		DoUpdates: clause.Set{
+			{Column: clause.Column{Name: "requests"}, Value: gorm.Expr("requests + 1")},
+			{Column: clause.Column{Name: "prompt_tokens"}, Value: gorm.Expr("prompt_tokens + ?", record.PromptTokens)},
+			{Column: clause.Column{Name: "completion_tokens"}, Value: gorm.Expr("completion_tokens + ?", record.CompletionTokens)},
+			{Column: clause.Column{Name: "estimated_tokens"}, Value: gorm.Expr("estimated_tokens + ?", record.EstimatedTokens)},
+			{Column: clause.Column{Name: "updated_at"}, Value: time.Now()},
+		},
+	}).Create(&record).Error
+}
+
+// CheckQuota 检查用户当天和当月的用量是否已达到配额，达到时返回包装了ErrQuotaExceeded的错误
+func (s *UsageService) CheckQuota(userID uint) error {
+	if s.dailyQuota <= 0 && s.monthlyQuota <= 0 {
+		return nil
+	}
+
+	today, month, err := s.Summary(userID)
+	if err != nil {
+		return err
+	}
+	if s.dailyQuota > 0 && today.TotalTokens >= s.dailyQuota {
+		return fmt.Errorf("%w：今日已使用 %d tokens，每日上限 %d tokens", ErrQuotaExceeded, today.TotalTokens, s.dailyQuota)
+	}
+	if s.monthlyQuota > 0 && month.TotalTokens >= s.monthlyQuota {
+		return fmt.Errorf("%w：本月已使用 %d tokens，每月上限 %d tokens", ErrQuotaExceeded, month.TotalTokens, s.monthlyQuota)
+	}
+	return nil
+}
+
+// Summary 汇总用户当天和当月的用量
+func (s *UsageService) Summary(userID uint) (today UsageSummary, month UsageSummary, err error) {
+	now := time.Now()
+	monthStart := time.Date(now.Year(), now.Month(), 1, 0, 0, 0, 0, now.Location())
+
+	records, err := s.List(userID, monthStart.Format(models.AIUsageDateFormat))
+	if err != nil {
+		return today, month, err
+	}
+
+	todayDate := now.Format(models.AIUsageDateFormat)
+	for _, record := range records {
+		month.add(record)
+		if record.Date == todayDate {
+			today.add(record)
+		}
+	}
+	today.Quota = s.dailyQuota
+	month.Quota = s.monthlyQuota
+	return today, month, nil
+}
+
+// List 按日期倒序查询用户从since（YYYY-MM-DD）开始每天每个模型的用量
+func (s *UsageService) List(userID uint, since string) ([]models.AIUsage, error) {
+	var records []models.AIUsage
+	err := s.db.Where("user_id = ? AND date >= ?", userID, since).
+		Order("date DESC, model").
+		Find(&records).Error
+	return records, err
+}
+
+// add 累加一条用量记录
+func (s *UsageSummary) add(record models.AIUsage) {
+	s.Requests += record.Requests
+	s.PromptTokens += record.PromptTokens
+	s.CompletionTokens += record.CompletionTokens
+	s.TotalTokens += record.TotalTokens()
+}
@@ -0,0 +1,90 @@
+package sse
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+)
+
+// ErrorEvent 上游在事件流中返回的错误
+// Anthropic以event: error事件返回，OpenAI兼容接口以包含error字段的data返回
+type ErrorEvent struct {
+	Type    string // 错误类型，如overloaded_error、server_error
+	Code    string // 错误码，OpenAI兼容接口返回，如rate_limit_exceeded
+	Message string // 错误信息
+	Data    string // 原始事件数据
+}
+
+// retryableErrorTypes 可以重试的上游错误类型或错误码（过载、限流和服务端错误）
+var retryableErrorTypes = map[string]bool{
+	"overloaded_error":    true,
+	"rate_limit_error":    true,
+	"rate_limit_exceeded": true,
+	"api_error":           true,
+	"server_error":        true,
+}
+
+// Error 实现error接口
+func (e *ErrorEvent) Error() string {
+	kind := e.Type
+	if kind == "" {
+		kind = e.Code
+	}
+	if kind == "" {
+		return fmt.Sprintf("AI返回错误: %s", e.Message)
+	}
+	return fmt.Sprintf("AI返回错误: %s (%s)", e.Message, kind)
+}
+
+// Retryable 是否为可以重试的错误
+func (e *ErrorEvent) Retryable() bool {
+	return retryableErrorTypes[e.Type] || retryableErrorTypes[e.Code]
+}
+
+// errorPayload 错误事件的数据格式，error字段可能是对象或字符串
+type errorPayload struct {
+	Error json.RawMessage `json:"error"`
+}
+
+// errorDetail 错误详情，OpenAI兼容接口的code可能是字符串或数字
+type errorDetail struct {
+	Type    string          `json:"type"`
+	Code    json.RawMessage `json:"code"`
+	Message string          `json:"message"`
+}
+
+// ParseError 判断事件是否为上游返回的错误，是则解析为ErrorEvent
+func ParseError(event *Event) (*ErrorEvent, bool) {
+	var payload errorPayload
+	if err := json.Unmarshal([]byte(event.Data), &payload); err != nil || isNull(payload.Error) {
+		// 无法解析的error事件仍视为错误，原样返回数据
+		if event.Event == "error" {
+			return &ErrorEvent{Message: event.Data, Data: event.Data}, true
+		}
+		return nil, false
+	}
+
+	errEvent := &ErrorEvent{Data: event.Data}
+	var message string
+	if err := json.Unmarshal(payload.Error, &message); err == nil {
+		errEvent.Message = message
+		return errEvent, true
+	}
+
+	var detail errorDetail
+	if err := json.Unmarshal(payload.Error, &detail); err != nil {
+		errEvent.Message = string(payload.Error)
+		return errEvent, true
+	}
+	errEvent.Type = detail.Type
+	if !isNull(detail.Code) {
+		errEvent.Code = strings.Trim(string(detail.Code), `"`)
+	}
+	errEvent.Message = detail.Message
+	return errEvent, true
+}
+
+// isNull 字段是否不存在或为null
+func isNull(raw json.RawMessage) bool {
+	return len(raw) == 0 || string(raw) == "null"
+}
@@ -0,0 +1,173 @@
+// Package sse 按照WHATWG HTML标准中的Server-Sent Events格式解析上游返回的事件流
+package sse
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"strconv"
+	"time"
+)
+
+// MaxLineSize 单行的最大字节数，超出时Next返回bufio.ErrTooLong
+const MaxLineSize = 1024 * 1024
+
+// utf8BOM 流开头可能出现的UTF-8字节顺序标记
+var utf8BOM = []byte{0xEF, 0xBB, 0xBF}
+
+// Event 一个SSE事件
+type Event struct {
+	ID    string // 事件ID，未指定时沿用之前最后一次设置的ID
+	Event string // 事件类型，未指定时为空（即默认的message类型）
+	Data  string // 事件数据，多个data字段以换行连接
+}
+
+// Reader SSE事件流读取器
+// 支持LF、CRLF和CR三种换行符，多行data，event、id、retry字段以及以冒号开头的注释行
+// 与标准不同的是，流结束时最后一个没有以空行结尾的事件也会被返回，以兼容省略了结尾空行的上游
+type Reader struct {
+	scanner *bufio.Scanner
+	started bool          // 是否已读取第一行（用于去掉字节顺序标记）
+	lastID  string        // 最后一次设置的事件ID
+	retry   time.Duration // 上游通过retry字段指定的重连间隔
+	event   string        // 当前事件的类型
+	data    []byte        // 当前事件的数据，每个data字段后追加换行
+}
+
+// NewReader 创建SSE事件流读取器
+func NewReader(r io.Reader) *Reader {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 0, 4096), MaxLineSize)
+	scanner.Split(scanLines)
+	return &Reader{scanner: scanner}
+}
+
+// Next 读取下一个事件，流结束时返回io.EOF
+// 只有注释或没有data字段的事件不会被返回
+func (r *Reader) Next() (*Event, error) {
+	for r.scanner.Scan() {
+		line := r.scanner.Bytes()
+		if !r.started {
+			line = bytes.TrimPrefix(line, utf8BOM)
+			r.started = true
+		}
+
+		// 空行表示一个事件结束
+		if len(line) == 0 {
+			if event := r.dispatch(); event != nil {
+				return event, nil
+			}
+			continue
+		}
+		r.processLine(line)
+	}
+	if err := r.scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	// 流结束时返回最后一个未以空行结尾的事件
+	if event := r.dispatch(); event != nil {
+		return event, nil
+	}
+	return nil, io.EOF
+}
+
+// LastEventID 最后一次设置的事件ID，可在重连时作为Last-Event-ID请求头
+func (r *Reader) LastEventID() string {
+	return r.lastID
+}
+
+// Retry 上游通过retry字段指定的重连间隔，未指定时为0
+func (r *Reader) Retry() time.Duration {
+	return r.retry
+}
+
+// processLine 处理一行字段
+func (r *Reader) processLine(line []byte) {
+	// 以冒号开头的是注释
+	if line[0] == ':' {
+		return
+	}
+
+	// 字段名和值以第一个冒号分隔，值开头的一个空格会被去掉；没有冒号时整行为字段名，值为空
+	field, value := line, []byte(nil)
+	if i := bytes.IndexByte(line, ':'); i >= 0 {
+		field, value = line[:i], line[i+1:]
+		value = bytes.TrimPrefix(value, []byte(" "))
+	}
+
+	switch string(field) {
+	case "event":
+		r.event = string(value)
+	case "data":
+		r.data = append(r.data, value...)
+		r.data = append(r.data, '\n')
+	case "id":
+		// 包含NULL字符的ID会被忽略
+		if bytes.IndexByte(value, 0) < 0 {
+			r.lastID = string(value)
+		}
+	case "retry":
+		if isDigits(value) {
+			if ms, err := strconv.ParseInt(string(value), 10, 64); err == nil {
+				r.retry = time.Duration(ms) * time.Millisecond
+			}
+		}
+	}
+}
+
+// dispatch 结束当前事件，没有data字段时返回nil
+func (r *Reader) dispatch() *Event {
+	defer func() {
+		r.event = ""
+		r.data = r.data[:0]
+	}()
+	if len(r.data) == 0 {
+		return nil
+	}
+	return &Event{
+		ID:    r.lastID,
+		Event: r.event,
+		Data:  string(r.data[:len(r.data)-1]), // 去掉最后一个data字段后追加的换行
+	}
+}
+
+// scanLines 按LF、CRLF或CR切分行
+func scanLines(data []byte, atEOF bool) (int, []byte, error) {
+	if atEOF && len(data) == 0 {
+		return 0, nil, nil
+	}
+	if i := bytes.IndexAny(data, "\r\n"); i >= 0 {
+		if data[i] == '\n' {
+			return i + 1, data[:i], nil
+		}
+		// CR之后需要再读一个字节才能判断是否为CRLF
+		if i+1 < len(data) {
+			if data[i+1] == '\n' {
+				return i + 2, data[:i], nil
+			}
+			return i + 1, data[:i], nil
+		}
+		if atEOF {
+			return i + 1, data[:i], nil
+		}
+		return 0, nil, nil
+	}
+	if atEOF {
+		return len(data), data, nil
+	}
+	return 0, nil, nil
+}
+
+// isDigits 是否全部为ASCII数字
+func isDigits(value []byte) bool {
+	if len(value) == 0 {
+		return false
+	}
+	for _, c := range value {
+		if c < '0' || c > '9' {
+			return false
+		}
+	}
+	return true
+}
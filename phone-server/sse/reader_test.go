@@ -0,0 +1,165 @@
+package sse
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+	"testing/iotest"
+	"time"
+)
+
+// chunkRounds 每个事件流以随机切分方式读取的轮数
+const chunkRounds = 200
+
+// basicEvents basic_*.sse 中应解析出的事件，三种换行符的结果相同
+var basicEvents = []Event{
+	{ID: "1", Event: "message", Data: "第一行\n第二行"},
+	{ID: "1", Data: ""},
+	{ID: "2", Data: `{"text":"你好"}`},
+	{ID: "2", Data: "无结尾空行"},
+}
+
+func TestReaderFixtures(t *testing.T) {
+	tests := []struct {
+		fixture string
+		events  []Event
+		retry   time.Duration
+		lastID  string
+		err     *ErrorEvent // 期望解析出的上游错误，nil表示没有错误
+	}{
+		{fixture: "basic_lf.sse", events: basicEvents, retry: 3 * time.Second, lastID: "2"},
+		{fixture: "basic_crlf.sse", events: basicEvents, retry: 3 * time.Second, lastID: "2"},
+		{fixture: "basic_cr.sse", events: basicEvents, retry: 3 * time.Second, lastID: "2"},
+		{fixture: "bom.sse", events: []Event{{Data: "带字节顺序标记"}}},
+		{
+			fixture: "anthropic_error.sse",
+			events:  []Event{{Event: "message_start", Data: `{"type":"message_start"}`}},
+			err:     &ErrorEvent{Type: "overloaded_error", Message: "Overloaded"},
+		},
+		{
+			fixture: "openai_error.sse",
+			err:     &ErrorEvent{Type: "requests", Code: "rate_limit_exceeded", Message: "Rate limit reached"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.fixture, func(t *testing.T) {
+			data, err := os.ReadFile(filepath.Join("testdata", tt.fixture))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			// 第0轮整块读取，之后每次读取随机长度，检查跨读取边界的换行符（如CRLF被拆开）
+			random := rand.New(rand.NewSource(1))
+			for round := range chunkRounds {
+				var input io.Reader = bytes.NewReader(data)
+				if round > 0 {
+					input = &chunkReader{data: data, random: random}
+				}
+				events, upstreamErr, reader, err := readAll(input)
+				if err != nil {
+					t.Fatalf("第%d轮读取失败: %v", round, err)
+				}
+				if !slices.Equal(events, tt.events) {
+					t.Fatalf("第%d轮 事件 = %+v，期望 %+v", round, events, tt.events)
+				}
+
+				if tt.err != nil {
+					if upstreamErr == nil || upstreamErr.Type != tt.err.Type || upstreamErr.Code != tt.err.Code || upstreamErr.Message != tt.err.Message {
+						t.Fatalf("第%d轮 上游错误 = %v，期望 %v", round, upstreamErr, tt.err)
+					}
+					if !upstreamErr.Retryable() {
+						t.Fatalf("上游错误 %v 应可以重试", upstreamErr)
+					}
+					continue
+				}
+				if upstreamErr != nil {
+					t.Fatalf("第%d轮 解析出意外的上游错误 %v", round, upstreamErr)
+				}
+				if reader.Retry() != tt.retry {
+					t.Fatalf("retry = %v，期望 %v", reader.Retry(), tt.retry)
+				}
+				if reader.LastEventID() != tt.lastID {
+					t.Fatalf("last event id = %q，期望 %q", reader.LastEventID(), tt.lastID)
+				}
+			}
+		})
+	}
+}
+
+// FuzzReader 检查任意输入都不会panic，且整块读取和逐字节读取的结果相同
+// 以testdata中的事件流作为种子语料：go test ./sse -fuzz FuzzReader
+func FuzzReader(f *testing.F) {
+	fixtures, err := filepath.Glob(filepath.Join("testdata", "*.sse"))
+	if err != nil {
+		f.Fatal(err)
+	}
+	for _, fixture := range fixtures {
+		data, err := os.ReadFile(fixture)
+		if err != nil {
+			f.Fatal(err)
+		}
+		f.Add(data)
+	}
+	f.Add([]byte("data:\r\rid:\x00\nretry:12a\n\n:\xef\xbb\xbf"))
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		expected, expectedErr, expectedReader, err := readAll(bytes.NewReader(data))
+		if err != nil {
+			t.Skip()
+		}
+		actual, actualErr, actualReader, err := readAll(iotest.OneByteReader(bytes.NewReader(data)))
+		if err != nil {
+			t.Fatalf("逐字节读取失败: %v", err)
+		}
+		if !slices.Equal(actual, expected) {
+			t.Fatalf("逐字节读取的事件 = %+v，整块读取为 %+v", actual, expected)
+		}
+		if (actualErr == nil) != (expectedErr == nil) {
+			t.Fatalf("逐字节读取的上游错误 = %v，整块读取为 %v", actualErr, expectedErr)
+		}
+		if actualReader.LastEventID() != expectedReader.LastEventID() || actualReader.Retry() != expectedReader.Retry() {
+			t.Fatalf("逐字节读取的状态与整块读取不同")
+		}
+	})
+}
+
+// readAll 读取全部事件，遇到上游错误事件时停止
+func readAll(input io.Reader) ([]Event, *ErrorEvent, *Reader, error) {
+	reader := NewReader(input)
+	var events []Event
+	for {
+		event, err := reader.Next()
+		if errors.Is(err, io.EOF) {
+			return events, nil, reader, nil
+		}
+		if err != nil {
+			return nil, nil, reader, err
+		}
+		if upstreamErr, ok := ParseError(event); ok {
+			return events, upstreamErr, reader, nil
+		}
+		events = append(events, *event)
+	}
+}
+
+// chunkReader 每次返回随机长度的数据
+type chunkReader struct {
+	data   []byte
+	random *rand.Rand
+}
+
+// Read 实现io.Reader接口
+func (r *chunkReader) Read(p []byte) (int, error) {
+	if len(r.data) == 0 {
+		return 0, io.EOF
+	}
+	n := min(1+r.random.Intn(8), len(p), len(r.data))
+	copy(p, r.data[:n])
+	r.data = r.data[n:]
+	return n, nil
+}
@@ -11,6 +11,7 @@ import (
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -72,6 +73,7 @@ type Logger struct {
 	ctx          context.Context
 	cancel       context.CancelFunc
 	requestIDKey string
+	lazyFile     atomic.Bool // 首次写入时才创建日志目录和文件
 }
 
 var (
@@ -93,8 +95,8 @@ func init() {
 		Type:     LoggerTypeServer,
 	}
 
-	// 初始化默认日志器
-	logger, err := NewLogger(defaultConfig)
+	// 初始化默认日志器，启动时通常会按配置重新初始化，首次写入时才创建日志文件，避免未写日志时在工作目录下创建logs目录
+	logger, err := newLogger(defaultConfig, true)
 	if err != nil {
 		log.Fatalf("初始化默认日志器失败: %v", err)
 	}
@@ -103,11 +105,11 @@ func init() {
 
 // NewLogger 创建新的日志器
 func NewLogger(config LoggerConfig) (*Logger, error) {
-	// 确保日志目录存在
-	if err := os.MkdirAll(config.FilePath, 0755); err != nil {
-		return nil, fmt.Errorf("创建日志目录失败: %v", err)
-	}
+	return newLogger(config, false)
+}
 
+// newLogger 创建新的日志器，lazyFile为true时首次写入才创建日志目录和文件
+func newLogger(config LoggerConfig, lazyFile bool) (*Logger, error) {
 	// 创建上下文用于控制协程
 	ctx, cancel := context.WithCancel(context.Background())
 
@@ -126,8 +128,11 @@ func NewLogger(config LoggerConfig) (*Logger, error) {
 	}
 
 	// 初始化文件日志器
-	if err := logger.updateLogFile(); err != nil {
-		return nil, fmt.Errorf("初始化日志文件失败: %v", err)
+	if lazyFile {
+		logger.lazyFile.Store(true)
+	} else if err := logger.openLogFile(); err != nil {
+		cancel()
+		return nil, err
 	}
 
 	// 启动异步写入协程
@@ -141,6 +146,18 @@ func NewLogger(config LoggerConfig) (*Logger, error) {
 	return logger, nil
 }
 
+// openLogFile 创建日志目录并打开日志文件
+func (l *Logger) openLogFile() error {
+	// 确保日志目录存在
+	if err := os.MkdirAll(l.config.FilePath, 0755); err != nil {
+		return fmt.Errorf("创建日志目录失败: %v", err)
+	}
+	if err := l.updateLogFile(); err != nil {
+		return fmt.Errorf("初始化日志文件失败: %v", err)
+	}
+	return nil
+}
+
 // updateLogFile 更新日志文件（如果日期已变化或文件大小超过限制）
 func (l *Logger) updateLogFile() error {
 	currentDate := time.Now().Format("2006-01-02")
@@ -212,7 +229,13 @@ func (l *Logger) writeLoop() {
 				l.console.Print(logStr)
 			}
 
-			// 写入文件
+			// 写入文件，延迟创建的日志文件在首次写入时打开
+			if l.lazyFile.CompareAndSwap(true, false) {
+				if err := l.openLogFile(); err != nil {
+					// 使用标准日志记录错误，避免死锁
+					log.Printf("打开日志文件失败: %v", err)
+				}
+			}
 			if l.file != nil {
 				l.file.Print(logStr)
 			}
@@ -238,6 +261,10 @@ func (l *Logger) checkLogFileLoop() {
 	for {
 		select {
 		case <-ticker.C:
+			// 日志文件尚未创建时无需轮转
+			if l.lazyFile.Load() {
+				continue
+			}
 			if err := l.updateLogFile(); err != nil {
 				// 使用标准日志记录错误，避免死锁
 				log.Printf("更新日志文件失败: %v", err)
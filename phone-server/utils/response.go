@@ -1,9 +1,15 @@
 package utils
 
 import (
+	"crypto/rand"
+	"encoding/hex"
 	"encoding/json"
+	"errors"
+	"fmt"
 	"net/http"
 
+	"phone-server/models"
+
 	"github.com/gin-gonic/gin"
 )
 
@@ -62,3 +68,109 @@ func ParseClientMessage(message string) (string, string, error) {
 
 	return msg.Type, msg.Content, nil
 }
+
+// AIChatMessage 客户端发送给AI的消息
+// 消息格式为：{"type":"text","content":"xxx","conversation_id":12,"thinking":"enabled","model":"xxx"}
+// 图片消息格式为：{"type":"image","images":["base64"],"prompt":"xxx"}，content中的图片排在images之前
+// conversation_id为空时创建新会话，thinking为空时使用配置的思考模式，model为空时使用默认模型，prompt为空时使用配置的默认提示词
+type AIChatMessage struct {
+	Type           string   `json:"type"`            // text 或 image
+	Content        string   `json:"content"`         // 文本内容或图片base64
+	Images         []string `json:"images"`          // 图片base64或data URL，仅type为image时有效
+	Prompt         string   `json:"prompt"`          // 对图片的提问，仅type为image时有效
+	ConversationID uint     `json:"conversation_id"` // 继续的会话ID
+	Thinking       string   `json:"thinking"`        // 思考模式：enabled/disabled/auto
+	Model          string   `json:"model"`           // 模型名称，需在模型目录中
+}
+
+// ParseAIChatMessage 解析客户端发送给AI的消息
+func ParseAIChatMessage(message string) (*AIChatMessage, error) {
+	var msg AIChatMessage
+	if err := json.Unmarshal([]byte(message), &msg); err != nil {
+		return nil, err
+	}
+	return &msg, nil
+}
+
+// AckMessage 客户端回执消息
+// 消息格式为：{"type":"ack","message_ids":[1,2]} 或 {"type":"read","message_ids":[1,2]}
+type AckMessage struct {
+	Type       string `json:"type"`        // ack 表示已送达，read 表示已读
+	MessageIDs []uint `json:"message_ids"` // 消息ID列表
+}
+
+// ParseAckMessage 解析客户端回执消息
+func ParseAckMessage(message string) (*AckMessage, error) {
+	var msg AckMessage
+	if err := json.Unmarshal([]byte(message), &msg); err != nil {
+		return nil, err
+	}
+	return &msg, nil
+}
+
+// RouteMessage 客户端发送给其他设备的消息
+// 消息格式为：{"type":"message","message_type":"text","content":"xxx","target":"pc","target_device_id":0}
+type RouteMessage struct {
+	Type           string `json:"type"`             // 固定为message
+	MessageType    string `json:"message_type"`     // text 或 image，默认为text
+	Content        string `json:"content"`          // 消息内容
+	Target         string `json:"target"`           // 投递目标：all/others/pc/phone/device，默认为others
+	TargetDeviceID uint   `json:"target_device_id"` // Target为device时的目标设备ID
+}
+
+// ParseRouteMessage 解析客户端发送给其他设备的消息
+func ParseRouteMessage(message string) (*RouteMessage, error) {
+	var msg RouteMessage
+	if err := json.Unmarshal([]byte(message), &msg); err != nil {
+		return nil, err
+	}
+	return &msg, nil
+}
+
+// CancelMessage 客户端取消AI生成的消息
+// 消息格式为：{"type":"cancel","generation_id":"xxx"}，generation_id为空时取消该连接上所有进行中的生成
+type CancelMessage struct {
+	Type         string `json:"type"`          // 固定为cancel
+	GenerationID string `json:"generation_id"` // 生成ID，即stream_start帧中的stream_id，也可以是发起生成的请求帧ID
+}
+
+// ParseCancelMessage 解析客户端取消AI生成的消息
+func ParseCancelMessage(message string) (*CancelMessage, error) {
+	var msg CancelMessage
+	if err := json.Unmarshal([]byte(message), &msg); err != nil {
+		return nil, err
+	}
+	return &msg, nil
+}
+
+// ParseEnvelope 按协议版本解析客户端帧
+// 旧版协议的消息没有封装，整条消息作为Payload，类型取自type字段
+func ParseEnvelope(message []byte, version int) (*models.Envelope, error) {
+	var env models.Envelope
+	if err := json.Unmarshal(message, &env); err != nil {
+		return nil, err
+	}
+
+	if version < models.ProtocolVersion {
+		return &models.Envelope{
+			V:       models.ProtocolVersionLegacy,
+			Type:    env.Type,
+			Payload: json.RawMessage(message),
+		}, nil
+	}
+
+	if env.V != version {
+		return nil, fmt.Errorf("不支持的协议版本: %d", env.V)
+	}
+	if env.Type == "" {
+		return nil, errors.New("缺少帧类型")
+	}
+	return &env, nil
+}
+
+// NewFrameID 生成帧ID
+func NewFrameID() string {
+	b := make([]byte, 8)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}